@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Address index. It maps every address to the transactions of the current
+// chain that pay it or spend its outputs, and to its unspent outputs, so
+// balance and history queries need not walk the unspent set or the chain.
+// The index is held in memory, built when a node started with -addrindex
+// loads its chain, and kept up to date as blocks are connected and
+// disconnected, from their undo data. A node started from a snapshot only
+// has the history of the blocks above it. Outputs locked by a script are
+// indexed under the hex of the script.
+
+// transactions a page of address history holds unless asked otherwise, and
+// at most
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 1000
+)
+
+var errAddrIndexOff = errors.New("the address index is off, start the node with -addrindex")
+
+// AddressTx is a transaction that pays an address or spends its outputs
+type AddressTx struct {
+	TxID string `json:"txId"`
+	// -1 for a pool transaction
+	Height    int    `json:"height"`
+	BlockHash string `json:"blockHash,omitempty"`
+	// what the transaction pays the address and what it spends of the
+	// outputs of the address
+	Received int `json:"received"`
+	Sent     int `json:"sent"`
+}
+
+// AddressIndex is the address index of the current chain
+type AddressIndex struct {
+	// history holds the transactions of each address in chain order
+	history map[string][]AddressTx
+	// unspent holds the amounts of the unspent outputs of each address
+	unspent map[string]map[outPoint]int
+}
+
+// addrIndex is the address index, nil unless the node runs with -addrindex
+var addrIndex *AddressIndex
+
+func newAddressIndex() *AddressIndex {
+	return &AddressIndex{
+		history: map[string][]AddressTx{},
+		unspent: map[string]map[outPoint]int{},
+	}
+}
+
+// indexAddress returns the address an output is indexed under
+func indexAddress(address string, script Script) string {
+	if len(script) > 0 {
+		return hex.EncodeToString(script)
+	}
+	return address
+}
+
+// buildAddressIndex indexes aBlockchain, the current chain, whose unspent
+// set is db. The blocks are read back with their undo data.
+func buildAddressIndex(aBlockchain []Block, db *UtxoDB) (*AddressIndex, error) {
+	x := newAddressIndex()
+
+	start := 0
+	if checkpoint, ok := chainParams.snapshotOn(aBlockchain); ok {
+		start = checkpoint.Height + 1
+	}
+	for _, block := range aBlockchain[start:] {
+		undo := BlockUndo{}
+		if block.Index > 0 {
+			var ok bool
+			if undo, ok = db.getUndo(block.Hash); !ok {
+				if err := db.Err(); err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("no undo data for block %d", block.Index)
+			}
+		}
+		x.connect(block, undo)
+	}
+
+	// the history under a snapshot is missing, its outputs are not
+	x.unspent = map[string]map[outPoint]int{}
+	db.forEach(func(uTxO UnspentTxOut) bool {
+		x.addUnspent(indexAddress(uTxO.Address, uTxO.Script), outPoint{uTxO.TxOutID, uTxO.TxOutIndex}, uTxO.Amount)
+		return true
+	})
+	if err := db.Err(); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("indexed %d addresses\n", len(x.unspent))
+	return x, nil
+}
+
+// blockSpends returns the outputs block may spend: those in undo, the
+// outputs it spent from the chain before it, and its own outputs, which
+// later transactions of the block can spend and undo leaves out
+func blockSpends(block Block, undo BlockUndo) map[outPoint]UnspentTxOut {
+	spends := map[outPoint]UnspentTxOut{}
+	for _, uTxO := range undo.SpentTxOuts {
+		spends[outPoint{uTxO.TxOutID, uTxO.TxOutIndex}] = uTxO
+	}
+	for _, tx := range block.Data {
+		for index, out := range tx.TxOuts {
+			spends[outPoint{tx.ID, index}] = UnspentTxOut{
+				TxOutID:    tx.ID,
+				TxOutIndex: index,
+				Address:    out.Address,
+				Amount:     out.Amount,
+				Script:     out.Script,
+			}
+		}
+	}
+	return spends
+}
+
+// connect indexes block, connected on top of the indexed chain with undo
+func (x *AddressIndex) connect(block Block, undo BlockUndo) {
+	spends := blockSpends(block, undo)
+	for i, tx := range block.Data {
+		entries := map[string]*AddressTx{}
+		entry := func(address string) *AddressTx {
+			if entries[address] == nil {
+				entries[address] = &AddressTx{TxID: tx.ID, Height: block.Index, BlockHash: block.Hash}
+			}
+			return entries[address]
+		}
+
+		if i > 0 {
+			for _, txIn := range tx.TxIns {
+				point := outPoint{txIn.TxOutID, txIn.TxOutIndex}
+				uTxO := spends[point]
+				address := indexAddress(uTxO.Address, uTxO.Script)
+				x.dropUnspent(address, point)
+				entry(address).Sent += uTxO.Amount
+			}
+		}
+		for index, out := range tx.TxOuts {
+			address := indexAddress(out.Address, out.Script)
+			x.addUnspent(address, outPoint{tx.ID, index}, out.Amount)
+			entry(address).Received += out.Amount
+		}
+
+		for address, e := range entries {
+			x.history[address] = append(x.history[address], *e)
+		}
+	}
+}
+
+// disconnect reverts connect for block, the tip of the indexed chain
+func (x *AddressIndex) disconnect(block Block, undo BlockUndo) {
+	spends := blockSpends(block, undo)
+	for i := len(block.Data) - 1; i >= 0; i-- {
+		tx := block.Data[i]
+		for index, out := range tx.TxOuts {
+			address := indexAddress(out.Address, out.Script)
+			x.dropUnspent(address, outPoint{tx.ID, index})
+			x.dropHistory(address, tx.ID)
+		}
+		if i == 0 {
+			continue
+		}
+		for _, txIn := range tx.TxIns {
+			uTxO := spends[outPoint{txIn.TxOutID, txIn.TxOutIndex}]
+			x.dropHistory(indexAddress(uTxO.Address, uTxO.Script), tx.ID)
+		}
+	}
+	for _, uTxO := range undo.SpentTxOuts {
+		x.addUnspent(indexAddress(uTxO.Address, uTxO.Script), outPoint{uTxO.TxOutID, uTxO.TxOutIndex}, uTxO.Amount)
+	}
+}
+
+func (x *AddressIndex) addUnspent(address string, point outPoint, amount int) {
+	if x.unspent[address] == nil {
+		x.unspent[address] = map[outPoint]int{}
+	}
+	x.unspent[address][point] = amount
+}
+
+func (x *AddressIndex) dropUnspent(address string, point outPoint) {
+	delete(x.unspent[address], point)
+	if len(x.unspent[address]) == 0 {
+		delete(x.unspent, address)
+	}
+}
+
+// dropHistory takes txID off the end of the history of address
+func (x *AddressIndex) dropHistory(address string, txID string) {
+	history := x.history[address]
+	if len(history) == 0 || history[len(history)-1].TxID != txID {
+		return
+	}
+	if len(history) == 1 {
+		delete(x.history, address)
+		return
+	}
+	x.history[address] = history[:len(history)-1]
+}
+
+// balance returns the confirmed balance of address
+func (x *AddressIndex) balance(address string) int {
+	sum := 0
+	for _, amount := range x.unspent[address] {
+		sum += amount
+	}
+	return sum
+}
+
+// unspentTxOuts returns the unspent outputs of address in view, the unspent
+// set of the indexed chain, oldest first
+func (x *AddressIndex) unspentTxOuts(address string, view UtxoView) []UnspentTxOut {
+	uTxOs := map[outPoint]UnspentTxOut{}
+	for point := range x.unspent[address] {
+		if uTxO, ok := view.lookup(point); ok {
+			uTxOs[point] = uTxO
+		}
+	}
+	return sortedUnspentTxOuts(uTxOs)
+}
+
+// poolTxs returns what the transactions of aTransactionPool, oldest first,
+// pay address and spend of its outputs in aUnspentTxOuts or in the pool
+func poolTxs(address string, aTransactionPool []Transaction, aUnspentTxOuts UtxoView) []AddressTx {
+	view := withPoolOutputs(aUnspentTxOuts, aTransactionPool, nextBlockContext())
+	result := []AddressTx{}
+	for _, tx := range aTransactionPool {
+		entry := AddressTx{TxID: tx.ID, Height: -1}
+		touched := false
+		for _, in := range tx.TxIns {
+			uTxO, ok := view.lookup(outPoint{in.TxOutID, in.TxOutIndex})
+			if ok && indexAddress(uTxO.Address, uTxO.Script) == address {
+				entry.Sent += uTxO.Amount
+				touched = true
+			}
+		}
+		for _, out := range tx.TxOuts {
+			if indexAddress(out.Address, out.Script) == address {
+				entry.Received += out.Amount
+				touched = true
+			}
+		}
+		if touched {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// AddressBalance is the balance of an address
+type AddressBalance struct {
+	Address   string `json:"address"`
+	Confirmed int    `json:"confirmed"`
+	// what pool transactions pay the address less what they spend of it
+	Unconfirmed int `json:"unconfirmed"`
+}
+
+func getAddressBalance(address string) AddressBalance {
+	result := AddressBalance{Address: address, Confirmed: addrIndex.balance(address)}
+	for _, tx := range poolTxs(address, getTransactionPool(), getUnspentTxOuts()) {
+		result.Unconfirmed += tx.Received - tx.Sent
+	}
+	return result
+}
+
+// AddressUnspentTxOut is an unspent output of an address
+type AddressUnspentTxOut struct {
+	UnspentTxOut
+	// false for an output of a pool transaction
+	Confirmed bool `json:"confirmed"`
+	// a pool transaction spends the output
+	SpentInPool bool `json:"spentInPool,omitempty"`
+}
+
+// getAddressUnspentTxOuts returns the unspent outputs of address, those of
+// the chain first, then those of pool transactions
+func getAddressUnspentTxOuts(address string) []AddressUnspentTxOut {
+	result := []AddressUnspentTxOut{}
+	for _, uTxO := range addrIndex.unspentTxOuts(address, getUnspentTxOuts()) {
+		_, spent := mempool.spends[outPoint{uTxO.TxOutID, uTxO.TxOutIndex}]
+		result = append(result, AddressUnspentTxOut{UnspentTxOut: uTxO, Confirmed: true, SpentInPool: spent})
+	}
+
+	at := nextBlockContext()
+	for _, tx := range getTransactionPool() {
+		for index, out := range tx.TxOuts {
+			if indexAddress(out.Address, out.Script) != address {
+				continue
+			}
+			_, spent := mempool.spends[outPoint{tx.ID, index}]
+			result = append(result, AddressUnspentTxOut{
+				UnspentTxOut: UnspentTxOut{
+					TxOutID:    tx.ID,
+					TxOutIndex: index,
+					Address:    out.Address,
+					Amount:     out.Amount,
+					Script:     out.Script,
+					Height:     at.Height,
+					Time:       at.Time,
+				},
+				SpentInPool: spent,
+			})
+		}
+	}
+	return result
+}
+
+// AddressHistory is a page of the transactions of an address
+type AddressHistory struct {
+	Address string `json:"address"`
+	// transactions in the chain and the pool
+	Total int         `json:"total"`
+	Txs   []AddressTx `json:"txs"`
+}
+
+// getAddressHistory returns limit transactions of address after the first
+// skip, newest first. Pool transactions come before those of the chain.
+func getAddressHistory(address string, skip int, limit int) AddressHistory {
+	pool := poolTxs(address, getTransactionPool(), getUnspentTxOuts())
+	confirmed := addrIndex.history[address]
+	result := AddressHistory{Address: address, Total: len(pool) + len(confirmed), Txs: []AddressTx{}}
+
+	for i := skip; i < result.Total && len(result.Txs) < limit; i++ {
+		if i < len(pool) {
+			result.Txs = append(result.Txs, pool[len(pool)-1-i])
+		} else {
+			result.Txs = append(result.Txs, confirmed[result.Total-1-i])
+		}
+	}
+	return result
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testTransaction(ins []TxIn, outs []TxOut) Transaction {
+	tx := Transaction{TxIns: ins, TxOuts: outs}
+	tx.ID = getTransactionID(tx)
+	return tx
+}
+
+func TestAddressIndexSpendInBlock(t *testing.T) {
+	coinbase := GetCoinBaseTransaction("04aa", 1, 0)
+	block1 := Block{Index: 1, Hash: "b1", Data: []Transaction{coinbase}}
+
+	// parent spends the coinbase of block 1, child spends the parent in
+	// the same block
+	parent := testTransaction(
+		[]TxIn{{TxOutID: coinbase.ID, TxOutIndex: 0}},
+		[]TxOut{{Address: "04bb", Amount: 30}, {Address: "04aa", Amount: 20}},
+	)
+	child := testTransaction(
+		[]TxIn{{TxOutID: parent.ID, TxOutIndex: 0}},
+		[]TxOut{{Address: "04cc", Amount: 30}},
+	)
+	block2 := Block{Index: 2, Hash: "b2", Data: []Transaction{GetCoinBaseTransaction("04cc", 2, 0), parent, child}}
+	// connectBlock leaves outputs of the block itself out of the undo data
+	undo2 := BlockUndo{SpentTxOuts: []UnspentTxOut{
+		{TxOutID: coinbase.ID, TxOutIndex: 0, Address: "04aa", Amount: 50, Height: 1, Coinbase: true},
+	}}
+
+	x := newAddressIndex()
+	x.connect(block1, BlockUndo{})
+	want := newAddressIndex()
+	want.connect(block1, BlockUndo{})
+
+	x.connect(block2, undo2)
+	for address, balance := range map[string]int{"04aa": 20, "04bb": 0, "04cc": 80} {
+		if got := x.balance(address); got != balance {
+			t.Errorf("balance of %s is %d, want %d", address, got, balance)
+		}
+	}
+	history := x.history["04bb"]
+	if len(history) != 2 || history[0].TxID != parent.ID || history[0].Received != 30 || history[1].TxID != child.ID || history[1].Sent != 30 {
+		t.Errorf("history of 04bb is %v", history)
+	}
+	history = x.history["04aa"]
+	if len(history) != 2 || history[1].TxID != parent.ID || history[1].Sent != 50 || history[1].Received != 20 {
+		t.Errorf("history of 04aa is %v", history)
+	}
+
+	x.disconnect(block2, undo2)
+	if !reflect.DeepEqual(x, want) {
+		t.Errorf("disconnecting left %v, want %v", x, want)
+	}
+}
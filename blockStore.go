@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	blocksFileName = "blocks.dat"
+	indexFileName  = "index.dat"
+)
+
+// blockLocation is where a block record lives inside blocks.dat
+type blockLocation struct {
+	Offset int64
+	Length uint32
+}
+
+// BlockStore is an append-only on-disk block store.
+//
+// blocks.dat holds length-prefixed block records in the binary encoding. index.dat is a log of
+// (height, hash, location) entries: an entry for height h makes that block
+// the active block at h and drops every active block above it, so replacing
+// the chain only ever appends to both files. Entries written by PutBody
+// keep the blocks above.
+type BlockStore struct {
+	dir        string
+	blocksFile *os.File
+	indexFile  *os.File
+	blocksSize int64
+
+	// active chain, by height
+	heights []blockLocation
+	// every block ever stored, by hash
+	hashes map[string]blockLocation
+}
+
+// OpenBlockStore opens or creates a block store in dir
+func OpenBlockStore(dir string) (*BlockStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	blocksFile, err := os.OpenFile(filepath.Join(dir, blocksFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := os.OpenFile(filepath.Join(dir, indexFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		blocksFile.Close()
+		return nil, err
+	}
+
+	s := &BlockStore{
+		dir:        dir,
+		blocksFile: blocksFile,
+		indexFile:  indexFile,
+		hashes:     map[string]blockLocation{},
+	}
+
+	if err := s.loadIndex(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close closes the underlying files
+func (s *BlockStore) Close() error {
+	err := s.blocksFile.Close()
+	if indexErr := s.indexFile.Close(); err == nil {
+		err = indexErr
+	}
+	return err
+}
+
+// Height returns the number of blocks in the active chain
+func (s *BlockStore) Height() int {
+	return len(s.heights)
+}
+
+// HasBlock reports whether a block with hash has ever been stored
+func (s *BlockStore) HasBlock(hash string) bool {
+	_, ok := s.hashes[hash]
+	return ok
+}
+
+// BlockAt reads the active block at height
+func (s *BlockStore) BlockAt(height int) (*Block, error) {
+	if height < 0 || height >= len(s.heights) {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	return s.readBlock(s.heights[height])
+}
+
+// BlockByHash reads any stored block by its hash
+func (s *BlockStore) BlockByHash(hash string) (*Block, error) {
+	loc, ok := s.hashes[hash]
+	if !ok {
+		return nil, errors.New("block not found")
+	}
+	return s.readBlock(loc)
+}
+
+// Blocks reads the whole active chain
+func (s *BlockStore) Blocks() ([]Block, error) {
+	blocks := make([]Block, 0, len(s.heights))
+	for height := range s.heights {
+		block, err := s.BlockAt(height)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, *block)
+	}
+	return blocks, nil
+}
+
+// PutBlock makes block the active block at block.Index, dropping every
+// active block above it
+func (s *BlockStore) PutBlock(block Block) error {
+	if block.Index < 0 || block.Index > len(s.heights) {
+		return fmt.Errorf("cannot store block %d on a chain of height %d", block.Index, len(s.heights))
+	}
+
+	loc, ok := s.hashes[block.Hash]
+	if !ok {
+		var err error
+		loc, err = s.appendBlock(block)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := s.appendIndex(block.Index, block.Hash, loc); err != nil {
+		return err
+	}
+
+	s.hashes[block.Hash] = loc
+	s.heights = append(s.heights[:block.Index], loc)
+
+	return nil
+}
+
+// PutBody stores block in place of the header of it the active chain
+// holds, leaving the blocks above it alone. The blocks under a snapshot
+// are stored as headers first and get their transactions later.
+func (s *BlockStore) PutBody(block Block) error {
+	loc, ok := s.hashes[block.Hash]
+	if block.Index < 0 || block.Index >= len(s.heights) || !ok || s.heights[block.Index] != loc {
+		return fmt.Errorf("block %d is not in the stored chain", block.Index)
+	}
+
+	loc, err := s.appendBlock(block)
+	if err != nil {
+		return err
+	}
+	if err := s.appendIndex(block.Index|indexBodyFlag, block.Hash, loc); err != nil {
+		return err
+	}
+
+	s.hashes[block.Hash] = loc
+	s.heights[block.Index] = loc
+
+	return nil
+}
+
+// ReplaceBlocks makes newBlocks the active chain, writing only the blocks
+// after the point where it forks from the stored chain
+func (s *BlockStore) ReplaceBlocks(newBlocks []Block) error {
+	forkHeight := 0
+	for forkHeight < len(newBlocks) && forkHeight < len(s.heights) {
+		loc, ok := s.hashes[newBlocks[forkHeight].Hash]
+		if !ok || loc != s.heights[forkHeight] {
+			break
+		}
+		forkHeight++
+	}
+
+	for _, block := range newBlocks[forkHeight:] {
+		if err := s.PutBlock(block); err != nil {
+			return err
+		}
+	}
+
+	if len(newBlocks) < len(s.heights) {
+		// newBlocks is a prefix of the stored chain, re-put its tip to drop the rest
+		return s.PutBlock(newBlocks[len(newBlocks)-1])
+	}
+
+	return nil
+}
+
+func (s *BlockStore) appendBlock(block Block) (blockLocation, error) {
+	data, err := block.MarshalBinary()
+	if err != nil {
+		return blockLocation{}, err
+	}
+
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+
+	if _, err := s.blocksFile.WriteAt(record, s.blocksSize); err != nil {
+		return blockLocation{}, err
+	}
+	if err := s.blocksFile.Sync(); err != nil {
+		return blockLocation{}, err
+	}
+
+	loc := blockLocation{Offset: s.blocksSize + 4, Length: uint32(len(data))}
+	s.blocksSize += int64(len(record))
+
+	return loc, nil
+}
+
+func (s *BlockStore) readBlock(loc blockLocation) (*Block, error) {
+	data := make([]byte, loc.Length)
+	if _, err := s.blocksFile.ReadAt(data, loc.Offset); err != nil {
+		return nil, err
+	}
+
+	var block Block
+	if err := block.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// index entry: height uint64 | offset uint64 | length uint32 | hash length uint16 | hash
+const indexEntryHeaderSize = 8 + 8 + 4 + 2
+
+// indexBodyFlag marks an index entry written by PutBody, which moves the
+// block at its height and keeps the blocks above it
+const indexBodyFlag = 1 << 62
+
+func (s *BlockStore) appendIndex(height int, hash string, loc blockLocation) error {
+	entry := make([]byte, indexEntryHeaderSize+len(hash))
+	binary.BigEndian.PutUint64(entry[0:], uint64(height))
+	binary.BigEndian.PutUint64(entry[8:], uint64(loc.Offset))
+	binary.BigEndian.PutUint32(entry[16:], loc.Length)
+	binary.BigEndian.PutUint16(entry[20:], uint16(len(hash)))
+	copy(entry[indexEntryHeaderSize:], hash)
+
+	if _, err := s.indexFile.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := s.indexFile.Write(entry); err != nil {
+		return err
+	}
+	return s.indexFile.Sync()
+}
+
+// loadIndex replays index.dat. A record cut short by a crash is dropped.
+func (s *BlockStore) loadIndex() error {
+	info, err := s.blocksFile.Stat()
+	if err != nil {
+		return err
+	}
+	s.blocksSize = info.Size()
+
+	if _, err := s.indexFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var validSize int64
+	header := make([]byte, indexEntryHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.indexFile, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+
+		height := int(binary.BigEndian.Uint64(header[0:]))
+		body := height&indexBodyFlag != 0
+		height &^= indexBodyFlag
+		loc := blockLocation{
+			Offset: int64(binary.BigEndian.Uint64(header[8:])),
+			Length: binary.BigEndian.Uint32(header[16:]),
+		}
+		hash := make([]byte, binary.BigEndian.Uint16(header[20:]))
+		if _, err := io.ReadFull(s.indexFile, hash); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+
+		if loc.Offset+int64(loc.Length) > s.blocksSize || height > len(s.heights) || body && height == len(s.heights) {
+			return fmt.Errorf("corrupt block index at offset %d", validSize)
+		}
+
+		s.hashes[string(hash)] = loc
+		if body {
+			s.heights[height] = loc
+		} else {
+			s.heights = append(s.heights[:height], loc)
+		}
+		validSize += int64(indexEntryHeaderSize + len(hash))
+	}
+
+	return s.indexFile.Truncate(validSize)
+}
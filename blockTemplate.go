@@ -0,0 +1,147 @@
+package main
+
+import "fmt"
+
+// Block templates. A template is everything a miner needs to build the
+// next block: the header fields, the target, the pool transactions the
+// block takes and what its coinbase may pay. Miners outside the node fetch
+// one, grind the nonce and timestamp of the header and submit the solved
+// block.
+
+// maxBlockTransactions is how many pool transactions a template takes at
+// most, to bound the work of validating the block
+const maxBlockTransactions = 2000
+
+// TemplateTransaction is a transaction of a block template. Depends are the
+// positions in the block, counting the coinbase as 0, of the transactions
+// it spends outputs of, which must stay in front of it.
+type TemplateTransaction struct {
+	Transaction Transaction `json:"transaction"`
+	Fee         int         `json:"fee"`
+	Size        int         `json:"size"`
+	Depends     []int       `json:"depends"`
+}
+
+// BlockTemplate is the next block to mine on top of PreviousHash. The
+// timestamp may be anything from MinTimestamp to MaxTimestamp. Coinbase
+// pays CoinbaseValue, the subsidy and fees, to the addresses the template
+// was asked for; a miner may replace it with a coinbase of its own paying
+// no more, and then recalculates MerkleRoot.
+type BlockTemplate struct {
+	Index         int                   `json:"index"`
+	PreviousHash  string                `json:"previousHash"`
+	Timestamp     int64                 `json:"timestamp"`
+	MinTimestamp  int64                 `json:"minTimestamp"`
+	MaxTimestamp  int64                 `json:"maxTimestamp"`
+	Bits          uint32                `json:"bits"`
+	Target        string                `json:"target"`
+	Coinbase      Transaction           `json:"coinbase"`
+	CoinbaseValue int                   `json:"coinbaseValue"`
+	Transactions  []TemplateTransaction `json:"transactions"`
+	MerkleRoot    string                `json:"merkleRoot"`
+	SizeLimit     int                   `json:"sizeLimit"`
+}
+
+// payoutSplit returns the outputs a coinbase paying amount has. A larger
+// amount never gets fewer outputs.
+type payoutSplit func(amount int) []TxOut
+
+// payTo is the split paying everything to address
+func payTo(address string) payoutSplit {
+	return func(amount int) []TxOut {
+		return []TxOut{{Address: address, Amount: amount}}
+	}
+}
+
+// createBlockTemplate returns the template of the next block, paying
+// address, filled with the pool transactions paying the highest fee rates.
+// The caller holds chainMutex.
+func createBlockTemplate(address string) BlockTemplate {
+	return createPayoutBlockTemplate(payTo(address))
+}
+
+// createPayoutBlockTemplate returns the template of the next block, its
+// coinbase split between addresses by split. The caller holds chainMutex.
+func createPayoutBlockTemplate(split payoutSplit) BlockTemplate {
+	previousBlock := GetLatestBlock()
+	nextIndex := previousBlock.Index + 1
+	now := getCurrentTimestamp()
+	bits := getDifficulty(GetBlockchain())
+
+	// amounts encode to the same size whatever they are, and no reward gets
+	// more outputs than the largest
+	emptyBlock := GenerageBlock(nextIndex, previousBlock.Hash, now, []Transaction{getPayoutCoinbaseTransaction(split(maxAmount), nextIndex)}, "", bits, 0)
+	encoded, _ := emptyBlock.MarshalBinary()
+
+	entries := selectTransactions(getUnspentTxOuts(), maxBlockSize-len(encoded), maxBlockTransactions)
+
+	fees := 0
+	blockData := []Transaction{{}}
+	position := map[string]int{}
+	templateTxs := []TemplateTransaction{}
+	for i, entry := range entries {
+		tx := entry.Transaction
+		position[tx.ID] = i + 1
+		depends := []int{}
+		for _, txIn := range tx.TxIns {
+			if p, ok := position[txIn.TxOutID]; ok {
+				depends = append(depends, p)
+			}
+		}
+		templateTxs = append(templateTxs, TemplateTransaction{
+			Transaction: tx,
+			Fee:         entry.Fee,
+			Size:        entry.Size,
+			Depends:     depends,
+		})
+		blockData = append(blockData, tx)
+		fees += entry.Fee
+	}
+	value := blockSubsidy(nextIndex) + fees
+	coinbase := getPayoutCoinbaseTransaction(split(value), nextIndex)
+	blockData[0] = coinbase
+
+	return BlockTemplate{
+		Index:         nextIndex,
+		PreviousHash:  previousBlock.Hash,
+		Timestamp:     now,
+		MinTimestamp:  previousBlock.Timestamp - maxPastBlockTime + 1,
+		MaxTimestamp:  now + maxFutureBlockTime - 1,
+		Bits:          bits,
+		Target:        fmt.Sprintf("%064x", compactToBig(bits)),
+		Coinbase:      coinbase,
+		CoinbaseValue: value,
+		Transactions:  templateTxs,
+		MerkleRoot:    calculateMerkleRoot(blockData),
+		SizeLimit:     maxBlockSize,
+	}
+}
+
+// block returns the unsolved block of template
+func (template BlockTemplate) block() Block {
+	blockData := []Transaction{template.Coinbase}
+	for _, tx := range template.Transactions {
+		blockData = append(blockData, tx.Transaction)
+	}
+	return *GenerageBlock(template.Index, template.PreviousHash, template.Timestamp, blockData, "", template.Bits, 0)
+}
+
+// submitBlock adds a block solved outside the node to the chain and
+// announces it to peers. It returns why the block was rejected, a
+// *RuleError if it breaks a consensus rule.
+func submitBlock(block Block) error {
+	chainMutex.Lock()
+	if blockTree.hasBlock(block.Hash) {
+		chainMutex.Unlock()
+		return fmt.Errorf("block %s is already known", block.Hash)
+	}
+	err := addBlockToChain(block)
+	chainMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("accepted submitted block %d %s\n", block.Index, block.Hash)
+	syncer.announce(block)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// mineTemplate fetches a template paying address from the HTTP API, solves
+// it and submits the block, all through JSON as a miner outside the node
+// does
+func mineTemplate(t *testing.T, address string) BlockTemplate {
+	t.Helper()
+	w := httptest.NewRecorder()
+	blockTemplateHandler(w, httptest.NewRequest("GET", "/blockTemplate?address="+address, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("template: %d %s", w.Code, w.Body)
+	}
+	var template BlockTemplate
+	if err := json.Unmarshal(w.Body.Bytes(), &template); err != nil {
+		t.Fatal(err)
+	}
+
+	block := template.block()
+	if block.MerkleRoot != template.MerkleRoot {
+		t.Fatalf("the template transactions give Merkle root %s, the template %s", block.MerkleRoot, template.MerkleRoot)
+	}
+	for block.Hash = calculateHashForBlock(block); !hashMatchesDifficulty(block.Hash, block.Bits); block.Hash = calculateHashForBlock(block) {
+		block.Nonce++
+	}
+
+	body, err := json.Marshal(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	submitBlockHandler(w, httptest.NewRequest("POST", "/submitBlock", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("submitting block %d: %d %s", block.Index, w.Code, w.Body)
+	}
+	return template
+}
+
+func TestMineTemplateWithPoolTransaction(t *testing.T) {
+	useTestChain(t, &regTestParams)
+	key := generatePrivateKey()
+	address := getPublicKey(key)
+
+	// mine past coinbase maturity
+	for i := 0; i <= regTestParams.CoinbaseMaturity; i++ {
+		mineTemplate(t, address)
+	}
+
+	chainMutex.Lock()
+	tx, err := createTransaction(TxOut{Address: getPublicKey(generatePrivateKey()), Amount: 10}, 1, TxLocks{}, key, getUnspentTxOuts(), getTransactionPool())
+	if err == nil {
+		err = addToTransactionPool(tx, getUnspentTxOuts())
+	}
+	chainMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := mineTemplate(t, address)
+	if len(template.Transactions) != 1 || template.Transactions[0].Transaction.ID != tx.ID {
+		t.Fatalf("template holds %v, want %s", template.Transactions, tx.ID)
+	}
+
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+	tip := GetLatestBlock()
+	if tip.Index != template.Index || len(tip.Data) != 2 || tip.Data[1].ID != tx.ID {
+		t.Fatalf("tip is block %d with %d transactions", tip.Index, len(tip.Data))
+	}
+	if len(getTransactionPool()) != 0 {
+		t.Fatal("the mined transaction is still in the pool")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+)
+
+// blockNode is a block in the block tree along with the work of the chain
+// ending in it
+type blockNode struct {
+	block    Block
+	parent   *blockNode
+	children map[string]*blockNode
+	work     *big.Int
+}
+
+// BlockTree keeps every valid block we know of, including side branches, so
+// switching to another branch needs nothing from peers
+type BlockTree struct {
+	nodes map[string]*blockNode
+	tips  map[string]*blockNode
+	// why each block dropped from the tree for its header was rejected
+	invalid map[string]*RuleError
+	// why the last copy of each block dropped for its body was rejected.
+	// Another copy of the block can still be added.
+	badBodies map[string]*RuleError
+}
+
+func newBlockTree(aBlockchain []Block) *BlockTree {
+	t := &BlockTree{
+		nodes:     map[string]*blockNode{},
+		tips:      map[string]*blockNode{},
+		invalid:   map[string]*RuleError{},
+		badBodies: map[string]*RuleError{},
+	}
+
+	var parent *blockNode
+	for _, block := range aBlockchain {
+		parent = t.insert(block, parent)
+	}
+
+	return t
+}
+
+func (t *BlockTree) insert(block Block, parent *blockNode) *blockNode {
+	node := &blockNode{
+		block:    block,
+		parent:   parent,
+		children: map[string]*blockNode{},
+		work:     blockWork(block),
+	}
+	if parent != nil {
+		node.work.Add(node.work, parent.work)
+		parent.children[block.Hash] = node
+		delete(t.tips, parent.block.Hash)
+	}
+
+	t.nodes[block.Hash] = node
+	t.tips[block.Hash] = node
+
+	return node
+}
+
+func (t *BlockTree) hasBlock(hash string) bool {
+	_, ok := t.nodes[hash]
+	return ok
+}
+
+// addBlock adds a block whose parent is already in the tree
+func (t *BlockTree) addBlock(block Block) error {
+	if t.hasBlock(block.Hash) {
+		return nil
+	}
+	if reason, ok := t.invalid[block.Hash]; ok {
+		return reason
+	}
+	if _, ok := t.invalid[block.PreviousHash]; ok {
+		return ruleError(ruleBadPrevBlock, "block %d builds on invalid block %s", block.Index, block.PreviousHash)
+	}
+
+	parent, ok := t.nodes[block.PreviousHash]
+	if !ok {
+		return errors.New("parent block is unknown")
+	}
+
+	if err := validateNewBlock(block, t.chainTo(parent)); err != nil {
+		return err
+	}
+
+	t.insert(block, parent)
+	delete(t.badBodies, block.Hash)
+
+	return nil
+}
+
+// invalidate drops the block with hash, which broke reason, and every block
+// built on it. Unless reason is about the header the hashes are not marked
+// invalid, so the blocks can be added again with other bodies.
+func (t *BlockTree) invalidate(hash string, reason *RuleError) {
+	node, ok := t.nodes[hash]
+	if !ok {
+		return
+	}
+
+	var drop func(n *blockNode)
+	drop = func(n *blockNode) {
+		for _, child := range n.children {
+			drop(child)
+		}
+		switch {
+		case !headerFailures[reason.Rule]:
+			if n == node {
+				t.badBodies[n.block.Hash] = reason
+			}
+		case n == node:
+			t.invalid[n.block.Hash] = reason
+		default:
+			t.invalid[n.block.Hash] = ruleError(ruleBadPrevBlock, "block %d builds on invalid block %s", n.block.Index, hash)
+		}
+		delete(t.nodes, n.block.Hash)
+		delete(t.tips, n.block.Hash)
+	}
+	drop(node)
+
+	if parent := node.parent; parent != nil {
+		delete(parent.children, hash)
+		if len(parent.children) == 0 {
+			t.tips[parent.block.Hash] = parent
+		}
+	}
+}
+
+// invalidReason returns why the block with hash is not in the tree
+func (t *BlockTree) invalidReason(hash string) error {
+	if reason, ok := t.invalid[hash]; ok {
+		return reason
+	}
+	if reason, ok := t.badBodies[hash]; ok {
+		return reason
+	}
+	return errors.New("block is not in the block tree")
+}
+
+// bestTip returns the tip with the most accumulated work. Equal work goes to
+// the lower hash so that every node picks the same tip.
+func (t *BlockTree) bestTip() *blockNode {
+	var best *blockNode
+	for _, tip := range t.tips {
+		if best == nil {
+			best = tip
+			continue
+		}
+		if cmp := tip.work.Cmp(best.work); cmp > 0 || (cmp == 0 && tip.block.Hash < best.block.Hash) {
+			best = tip
+		}
+	}
+	return best
+}
+
+// chainTo returns the blocks from genesis up to node
+func (t *BlockTree) chainTo(node *blockNode) []Block {
+	chain := make([]Block, node.block.Index+1)
+	for n := node; n != nil; n = n.parent {
+		chain[n.block.Index] = n.block
+	}
+	return chain
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"math"
-	"reflect"
-	"strings"
+	"math/big"
+	"sync"
 	"time"
 )
 
@@ -16,32 +17,14 @@ const (
 	difficultyAdjustmentInterval = 10
 )
 
-func getDifficulty(aBlockchain []Block) int {
-	latestBlock := aBlockchain[len(aBlockchain)-1]
-	if latestBlock.Index%difficultyAdjustmentInterval == 0 && latestBlock.Index != 0 {
-		return getAdjustedDifficulty(latestBlock, aBlockchain)
-	}
-
-	return latestBlock.Difficulty
-}
-
-func getAdjustedDifficulty(latestBlock Block, aBlockchain []Block) int {
-	prevAdjustmentBlock := aBlockchain[len(blockchain)-difficultyAdjustmentInterval]
-	timeExpected := int64(blockGenerationInterval * difficultyAdjustmentInterval)
-	timeTaken := latestBlock.Timestamp - prevAdjustmentBlock.Timestamp
-
-	if timeTaken < timeExpected/2 {
-		return prevAdjustmentBlock.Difficulty + 1
-	}
-	if timeTaken > timeExpected*2 {
-		return prevAdjustmentBlock.Difficulty - 1
-	}
-	return prevAdjustmentBlock.Difficulty
+// getDifficulty returns the compact target bits of the block after aBlockchain
+func getDifficulty(aBlockchain []Block) uint32 {
+	return chainParams.Difficulty.NextBits(aBlockchain)
 }
 
+// getCurrentTimestamp returns the time in seconds since the Unix epoch
 func getCurrentTimestamp() int64 {
-	now := time.Now()
-	return int64(math.Round(float64(now.Unix() / 1000)))
+	return time.Now().Unix()
 }
 
 // Block is a one of chain
@@ -49,99 +32,152 @@ type Block struct {
 	Index        int           `json:"index,omitempty"`
 	PreviousHash string        `json:"previousHash,omitempty"`
 	Timestamp    int64         `json:"timestamp,omitempty"`
+	MerkleRoot   string        `json:"merkleRoot,omitempty"`
 	Data         []Transaction `json:"data,omitempty"`
 	Hash         string        `json:"hash,omitempty"`
-	Difficulty   int           `json:"difficulty"`
+	Bits         uint32        `json:"bits"`
 	Nonce        int           `json:"nonce"`
 }
 
+// BlockHeader is the part of a block its hash is calculated from. The
+// transactions are committed to by the Merkle root.
+type BlockHeader struct {
+	Index        int    `json:"index,omitempty"`
+	PreviousHash string `json:"previousHash,omitempty"`
+	Timestamp    int64  `json:"timestamp,omitempty"`
+	MerkleRoot   string `json:"merkleRoot,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+	Bits         uint32 `json:"bits"`
+	Nonce        int    `json:"nonce"`
+}
+
+// Header returns the header of block
+func (block Block) Header() BlockHeader {
+	return BlockHeader{
+		Index:        block.Index,
+		PreviousHash: block.PreviousHash,
+		Timestamp:    block.Timestamp,
+		MerkleRoot:   block.MerkleRoot,
+		Hash:         block.Hash,
+		Bits:         block.Bits,
+		Nonce:        block.Nonce,
+	}
+}
+
+// hasBody reports whether we have the transactions of block. Every block
+// has a coinbase, but the blocks under the snapshot a node started from are
+// headers only until they are downloaded.
+func (block Block) hasBody() bool {
+	return len(block.Data) > 0
+}
+
 // GenerageBlock generates a Block by information
-func GenerageBlock(index int, previousHash string, timestamp int64, data []Transaction, hash string, difficulty int, nonce int) *Block {
+func GenerageBlock(index int, previousHash string, timestamp int64, data []Transaction, hash string, bits uint32, nonce int) *Block {
 	return &Block{
 		Index:        index,
 		Hash:         hash,
 		PreviousHash: previousHash,
 		Timestamp:    timestamp,
+		MerkleRoot:   calculateMerkleRoot(data),
 		Data:         data,
-		Difficulty:   difficulty,
+		Bits:         bits,
 		Nonce:        nonce,
 	}
 }
 
-// GenerateNextBlock generates a next Block
-func GenerateNextBlock() *Block {
-	publicKey, err := GetPublicFromWallet()
+// GenerateNextBlock mines a block of the pool transactions on top of the
+// current chain. It fails with errMiningCancelled if the chain tip changes
+// first.
+func GenerateNextBlock() (*Block, error) {
+	chainMutex.Lock()
+	template, err := getBlockTemplate()
+	chainMutex.Unlock()
 
 	if err != nil {
-		return nil
+		fmt.Println("cannot build a block:", err)
+		return nil, err
 	}
 
-	coinbaseTx := GetCoinBaseTransaction(publicKey, GetLatestBlock().Index+1)
+	return miner.mineTemplate(template)
+}
 
-	blockData := append([]Transaction{coinbaseTx}, getTransactionPool()...)
+func generateRawNextBlock(blockData []Transaction) (*Block, error) {
+	chainMutex.Lock()
+	template := newBlockTemplate(blockData)
+	chainMutex.Unlock()
 
-	return generateRawNextBlock(blockData)
+	return miner.mineTemplate(template)
 }
 
-func generateRawNextBlock(blockData []Transaction) *Block {
+// getBlockTemplate returns an unsolved block paying our wallet, filled with
+// the pool transactions paying the highest fee rates
+func getBlockTemplate() (Block, error) {
+	publicKey, err := GetPublicFromWallet()
+
+	if err != nil {
+		return Block{}, err
+	}
+
+	return createBlockTemplate(publicKey).block(), nil
+}
+
+// newBlockTemplate returns an unsolved block of blockData on top of the
+// current chain
+func newBlockTemplate(blockData []Transaction) Block {
 	previousBlock := GetLatestBlock()
-	difficulty := getDifficulty(GetBlockchain())
+	bits := getDifficulty(GetBlockchain())
 
 	nextIndex := previousBlock.Index + 1
 	nextTimestamp := getCurrentTimestamp()
 
-	newBlock := findBlock(nextIndex, previousBlock.Hash, nextTimestamp, blockData, difficulty)
-	if addBlockToChain(*newBlock) {
-		// broadcastLatest()
-		return newBlock
-	}
-	return nil
+	return *GenerageBlock(nextIndex, previousBlock.Hash, nextTimestamp, blockData, "", bits, 0)
 }
 
-func findBlock(index int, previousHash string, timestamp int64, data []Transaction, difficulty int) *Block {
-	nonce := 0
-	for true {
-		hash := calculateHash(index, previousHash, timestamp, data, difficulty, nonce)
-		if hashMatchesDifficulty(hash, difficulty) {
-			return GenerageBlock(index, previousHash, timestamp, data, hash, difficulty, nonce)
-		}
-		nonce++
-	}
-	return nil
+// blockWork is the expected number of hashes it took to find block
+func blockWork(block Block) *big.Int {
+	return calcWork(block.Bits)
 }
 
-func getAccumulatedDifficulty(aBlockchain []Block) float64 {
-	result := float64(0)
+// getAccumulatedDifficulty is the total work of aBlockchain
+func getAccumulatedDifficulty(aBlockchain []Block) *big.Int {
+	result := big.NewInt(0)
 	for _, block := range aBlockchain {
-		result += math.Pow(2, float64(block.Difficulty))
+		result.Add(result, blockWork(block))
 	}
 
 	return result
 }
 
-func isValidTimestamp(newBlock Block, previousBlock Block) bool {
-	return (previousBlock.Timestamp-60 < newBlock.Timestamp) && newBlock.Timestamp-60 < getCurrentTimestamp()
-}
-
-func calculateHash(index int, prevHash string, nextTimestamp int64, blockData []Transaction, difficulty, nonce int) string {
-	h := sha256.New()
-
-	s := fmt.Sprintf("%d%s%d%s%d%d", index, prevHash, nextTimestamp, blockData, difficulty, nonce)
-	h.Write([]byte(s))
+func calculateHash(index int, prevHash string, nextTimestamp int64, merkleRoot string, bits uint32, nonce int) string {
+	e := &encoder{}
+	e.blockHeader(BlockHeader{
+		Index:        index,
+		PreviousHash: prevHash,
+		Timestamp:    nextTimestamp,
+		MerkleRoot:   merkleRoot,
+		Bits:         bits,
+		Nonce:        nonce,
+	})
 
-	bs := h.Sum(nil)
+	bs := sha256.Sum256(e.buf)
 
-	return string(bs)
+	return hex.EncodeToString(bs[:])
 }
 
-func hashMatchesDifficulty(hash string, difficulty int) bool {
-	hashInBinary := hexToBinary(hash)
-	requiredPrefix := ""
-	for i := 0; i < difficulty; i++ {
-		requiredPrefix += "0"
+// hashMatchesDifficulty reports whether hash, read as a 256-bit number, does
+// not exceed the target of bits
+func hashMatchesDifficulty(hash string, bits uint32) bool {
+	target := compactToBig(bits)
+	if target.Sign() <= 0 || target.Cmp(powLimit) > 0 {
+		return false
+	}
+
+	hashNum, ok := new(big.Int).SetString(hash, 16)
+	if !ok || len(hash) != 64 {
+		return false
 	}
 
-	return strings.HasPrefix(hashInBinary, requiredPrefix) // true
+	return hashNum.Cmp(target) <= 0
 }
 
 var genesisTransaction = []Transaction{Transaction{
@@ -154,48 +190,50 @@ var genesisTransaction = []Transaction{Transaction{
 		Address: "04bfcab8722991ae774db48f934ca79cfb7dd991229153b9f732ba5334aafcd8e7266e47076996b55a14bf9913ee3145ce0cfc1372ada8ada74bd287450313534a",
 		Amount:  50,
 	}},
-	ID: "e655f6a5f26dc9b4cac6e46f52336428287759cf81ef5ff10854f69d68f43fa3",
+	ID: "406dfe51e12963222ac5771a0e027cf7013340ea737bc5ec05b1466bf2b3d1f4",
 }}
 
-var genesisBlock = GenerageBlock(0, "", 1465154705, genesisTransaction, "91a73664bc84c0baa1fc75ea6e4aa6d1d20c5df664c724e3159aefc2e1186627", 0, 0)
+var genesisBlock = GenerageBlock(0, "", 1465154705, genesisTransaction, "e13f568f1860aafc932af8e87e8af6db75898256960e357ef06b3c09068316ff", powLimitBits, 0)
 var blockchain = []Block{*genesisBlock}
 
-func isValidNewBlock(newBlock Block, previousBlock Block) bool {
-	if previousBlock.Index+1 != newBlock.Index {
-		return false
-	} else if previousBlock.Hash != newBlock.PreviousHash {
-		return false
-	} else if calculateHashForBlock(newBlock) != newBlock.Hash {
-		return false
+// chainMutex guards the chain, the unspent set and the transaction pool. It
+// is taken where requests enter the node: peer messages, HTTP handlers and
+// the miner.
+var chainMutex sync.Mutex
+
+// ReplaceChain adds the blocks of a chain received from a peer to the block
+// tree and switches to it if it now holds the most work. It returns why the
+// chain was rejected.
+func ReplaceChain(newBlocks []Block) error {
+	tip := newBlocks[len(newBlocks)-1]
+	if err := validateChain(newBlocks); err != nil {
+		logRejection("block", tip.Hash, asRuleError(err))
+		return err
 	}
-	return true
-}
 
-// ReplaceChain handle whether to relace to new chain or ignore new chain
-func ReplaceChain(newBlocks []Block) {
-	if isValidChain(newBlocks) && len(newBlocks) > len(GetBlockchain()) {
-		blockchain = newBlocks
-		// broadcastLatest()
-	} else {
-		fmt.Println("Received blockchain invalid")
+	for _, block := range newBlocks[1:] {
+		if err := blockTree.addBlock(block); err != nil {
+			if ruleErr := asRuleError(err); ruleErr != nil {
+				logRejection("block", block.Hash, ruleErr)
+			} else {
+				fmt.Println("Received blockchain invalid:", err)
+			}
+			return err
+		}
 	}
-}
 
-func isValidChain(blockchainToValidate []Block) bool {
-	isValidGenesis := func(block Block) bool {
-		return reflect.DeepEqual(block, *genesisBlock)
+	if getAccumulatedDifficulty(newBlocks).Cmp(getAccumulatedDifficulty(GetBlockchain())) <= 0 {
+		fmt.Println("Received blockchain has no more work than ours, keeping it as a side branch")
 	}
 
-	if !isValidGenesis(blockchainToValidate[0]) {
-		return false
+	if err := activateBestChain(); err != nil {
+		fmt.Println("failed to switch to the best chain:", err)
 	}
 
-	for i := 1; i < len(blockchainToValidate); i++ {
-		if !isValidNewBlock(blockchainToValidate[i], blockchainToValidate[i-1]) {
-			return false
-		}
+	if !blockTree.hasBlock(tip.Hash) {
+		return blockTree.invalidReason(tip.Hash)
 	}
-	return true
+	return nil
 }
 
 // GetBlockchain gets blockchain
@@ -209,43 +247,341 @@ func GetLatestBlock() Block {
 }
 
 func calculateHashForBlock(block Block) string {
-	return calculateHash(block.Index, block.PreviousHash, block.Timestamp, block.Data, block.Difficulty, block.Nonce)
+	return calculateHash(block.Index, block.PreviousHash, block.Timestamp, block.MerkleRoot, block.Bits, block.Nonce)
+}
+
+// addBlockToChain adds a block whose parent we know to the block tree and
+// makes the chain with the most work current. It returns why the block was
+// rejected, a *RuleError if it breaks a consensus rule.
+func addBlockToChain(newBlock Block) error {
+	if err := blockTree.addBlock(newBlock); err != nil {
+		if ruleErr := asRuleError(err); ruleErr != nil {
+			logRejection("block", newBlock.Hash, ruleErr)
+		} else {
+			fmt.Println("block not added:", err)
+		}
+		return err
+	}
+
+	if err := activateBestChain(); err != nil {
+		fmt.Println("failed to switch to the best chain:", err)
+	}
+
+	if !blockTree.hasBlock(newBlock.Hash) {
+		return blockTree.invalidReason(newBlock.Hash)
+	}
+	return nil
+}
+
+// activateBestChain makes the best tip of the block tree the current chain.
+// Blocks that turn out to be invalid while connecting are dropped from the
+// tree and the next best tip is tried.
+func activateBestChain() error {
+	for {
+		best := blockTree.bestTip()
+		latestBlock := GetLatestBlock()
+		if best.block.Hash == latestBlock.Hash {
+			return nil
+		}
+
+		var err error
+		if best.parent != nil && best.parent.block.Hash == latestBlock.Hash {
+			err = connectTip(best.block)
+		} else {
+			err = reorganizeChain(blockTree.chainTo(best))
+		}
+
+		if rejected, ok := err.(*blockRejectedError); ok {
+			logRejection("block", rejected.Hash, rejected.Reason)
+			blockTree.invalidate(rejected.Hash, rejected.Reason)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		notifyTip(GetLatestBlock().Hash)
+	}
+}
+
+// tipSubscribers are sent the hash of every new chain tip
+var (
+	tipSubscribers = map[chan string]bool{}
+	tipMutex       sync.Mutex
+)
+
+// subscribeTip returns a channel that receives the hash of the chain tip
+// whenever it changes. A slow receiver only misses intermediate tips.
+func subscribeTip() chan string {
+	tipMutex.Lock()
+	defer tipMutex.Unlock()
+
+	ch := make(chan string, 1)
+	tipSubscribers[ch] = true
+	return ch
+}
+
+func unsubscribeTip(ch chan string) {
+	tipMutex.Lock()
+	defer tipMutex.Unlock()
+
+	delete(tipSubscribers, ch)
+}
+
+func notifyTip(hash string) {
+	tipMutex.Lock()
+	defer tipMutex.Unlock()
+
+	for ch := range tipSubscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- hash
+	}
 }
 
-func addBlockToChain(newBlock Block) bool {
-	if isValidNewBlock(newBlock, GetLatestBlock()) {
-		blockchain = append(blockchain, newBlock)
-		return true
+// connectTip connects newBlock on top of the current chain
+func connectTip(newBlock Block) error {
+	changes, undo, err := connectBlock(newBlock, GetLatestBlock(), utxoDB)
+	if err != nil {
+		if dbErr := utxoDB.Err(); dbErr != nil {
+			return dbErr
+		}
+		return rejectBlock(newBlock, err)
+	}
+
+	if blockStore != nil {
+		if err := blockStore.PutBlock(newBlock); err != nil {
+			return err
+		}
+	}
+
+	blockchain = append(blockchain, newBlock)
+	changes.writeTo(utxoDB)
+	utxoDB.putUndo(newBlock.Hash, *undo)
+	utxoDB.setTip(newBlock.Hash, newBlock.Index)
+	if err := utxoDB.flushIfFull(); err != nil {
+		fmt.Println("cannot write the unspent set:", err)
 	}
-	return false
+	if addrIndex != nil {
+		addrIndex.connect(newBlock, *undo)
+	}
+	mempool.removeForBlock(newBlock)
+	updateTransactionPool(utxoDB)
+	return nil
 }
 
-// // the unspent txOut of genesis block is set to unspentTxOuts on startup
-var unspentTxOuts []UnspentTxOut = ProcessTransactions(blockchain[0].Data, []UnspentTxOut{}, 0)
+// utxoDB is the unspent set of the current chain. It holds the genesis
+// outputs in memory until loadBlockchain opens the one on disk.
+var utxoDB = genesisUtxoDB()
+
+// blockTree holds every valid block we know of
+var blockTree = newBlockTree(blockchain)
+
+// blockStore persists the chain when the node runs with a data directory
+var blockStore *BlockStore
+
+// loadBlockchain opens the block store and the unspent set in dataDir and
+// makes the stored chain current. The unspent set catches up with the
+// blocks stored after the last time it was written. An empty store is
+// seeded with the genesis block.
+func loadBlockchain(dataDir string, utxoCache int) error {
+	store, err := OpenBlockStore(dataDir)
+	if err != nil {
+		return err
+	}
+
+	if store.Height() == 0 {
+		if err := store.PutBlock(*genesisBlock); err != nil {
+			store.Close()
+			return err
+		}
+	}
+
+	blocks, err := store.Blocks()
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	// the blocks under the snapshot the node started from may be headers
+	// only
+	snapshotHeight := 0
+	if checkpoint, ok := chainParams.snapshotOn(blocks); ok {
+		snapshotHeight = checkpoint.Height
+	}
+	if err := validateChainUnder(blocks, snapshotHeight); err != nil {
+		store.Close()
+		return fmt.Errorf("stored blockchain is invalid: %v", err)
+	}
+
+	db, err := OpenUtxoDB(dataDir, utxoCache)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	if err := catchUpUtxoDB(db, store, blocks); err != nil {
+		db.Close()
+		store.Close()
+		return err
+	}
+
+	blockStore = store
+	blockchain = blocks
+	blockTree = newBlockTree(blocks)
+	utxoDB = db
+	fmt.Printf("loaded %d blocks from %s\n", len(blocks), dataDir)
+
+	return resumeSnapshotValidation(blocks, utxoCache)
+}
+
+// catchUpUtxoDB brings db to the tip of blocks, the stored chain. Blocks
+// db is at that the chain left are disconnected first; if that cannot be
+// done the set is built again from genesis.
+func catchUpUtxoDB(db *UtxoDB, store *BlockStore, blocks []Block) error {
+	for db.tipHeight >= 0 && (db.tipHeight >= len(blocks) || blocks[db.tipHeight].Hash != db.tipHash) {
+		block, err := store.BlockByHash(db.tipHash)
+		undo, ok := db.getUndo(db.tipHash)
+		if err != nil || !ok {
+			fmt.Println("unspent set is on an unknown block, building it again")
+			if err := db.reset(); err != nil {
+				return err
+			}
+			break
+		}
+		disconnectBlock(*block, undo, db).writeTo(db)
+		db.dropUndo(block.Hash)
+		db.setTip(block.PreviousHash, block.Index-1)
+	}
+
+	if db.tipHeight < 0 {
+		// a set cut short while loading a snapshot has no tip either
+		if err := db.resetToGenesis(); err != nil {
+			return err
+		}
+	}
+
+	for _, block := range blocks[db.tipHeight+1:] {
+		if !block.hasBody() {
+			return fmt.Errorf("the unspent set of the snapshot under block %d is lost, start again from an empty data directory", block.Index)
+		}
+		changes, undo, err := connectBlock(block, blocks[block.Index-1], db)
+		if err != nil {
+			if dbErr := db.Err(); dbErr != nil {
+				return dbErr
+			}
+			return fmt.Errorf("stored chain: %v", err)
+		}
+		changes.writeTo(db)
+		db.putUndo(block.Hash, *undo)
+		db.setTip(block.Hash, block.Index)
+		if err := db.flushIfFull(); err != nil {
+			return err
+		}
+	}
+	return db.flush()
+}
 
-func getUnspentTxOuts() []UnspentTxOut {
-	b := append(unspentTxOuts[:0:0], unspentTxOuts...)
-	return b
+// getUnspentTxOuts returns the unspent set of the current chain. The
+// caller holds chainMutex.
+func getUnspentTxOuts() UtxoView {
+	return utxoDB
 }
 
 // const getUnspentTxOuts = (): UnspentTxOut[] => _.cloneDeep(unspentTxOuts);
 
-func sendTransaction(address string, amount int) *Transaction {
+// sendTransaction pays receiver, an address or a locking script, from our
+// wallet, with fee going to the miner. A non-zero feeRate sets the fee from
+// the size of the transaction instead, per 1000 bytes. A transaction the
+// pool turns down is returned with the *RuleError it broke.
+func sendTransaction(receiver TxOut, fee int, feeRate int, locks TxLocks) (*Transaction, error) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	tx, err := buildTransaction(receiver, fee, feeRate, locks)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addToTransactionPool(tx, getUnspentTxOuts()); err != nil {
+		return tx, err
+	}
+
+	return tx, nil
+}
+
+// buildTransaction signs the transaction sendTransaction would send
+// without sending it, so one that is time locked can be kept until it can
+// go into a block. The caller holds chainMutex.
+func buildTransaction(receiver TxOut, fee int, feeRate int, locks TxLocks) (*Transaction, error) {
 	wallet, err := GetPrivateFromWallet()
 
 	if err != nil {
-		return nil
+		return nil, err
+	}
+
+	// change of pending transactions can be spent right away
+	pool := getTransactionPool()
+	view := withPoolOutputs(getUnspentTxOuts(), pool, nextBlockContext())
+	if feeRate != 0 {
+		return createTransactionWithFeeRate(receiver, feeRate, locks, wallet, view, pool)
 	}
+	return createTransaction(receiver, fee, locks, wallet, view, pool)
+}
 
-	tx, err := createTransaction(address, amount, wallet, getUnspentTxOuts(), getTransactionPool())
+// bumpTransactionFee replaces the pool transaction txID of our wallet with
+// one paying at least feeRate per 1000 bytes
+func bumpTransactionFee(txID string, feeRate int) (*Transaction, error) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
 
+	wallet, err := GetPrivateFromWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := getTransactionPool()
+	tx, err := bumpFee(txID, feeRate, wallet, withPoolOutputs(getUnspentTxOuts(), pool, nextBlockContext()), pool)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addToTransactionPool(tx, getUnspentTxOuts()); err != nil {
+		return tx, err
+	}
+
+	return tx, nil
+}
+
+// signTransaction signs the inputs of tx our wallet can spend with
+// hashType, for transactions built together with others
+func signTransaction(tx Transaction, hashType byte) (*Transaction, error) {
+	if !isValidHashType(hashType) {
+		return nil, fmt.Errorf("unknown signature hash type %#x", hashType)
+	}
+
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	wallet, err := GetPrivateFromWallet()
 	if err != nil {
-		return nil
+		return nil, err
+	}
+
+	tx.TxIns = append([]TxIn{}, tx.TxIns...)
+	tx.ID = getTransactionID(tx)
+	if signInputs(&tx, wallet, getUnspentTxOuts(), hashType) == 0 {
+		return nil, errors.New("no input of the transaction is ours to sign")
 	}
+	return &tx, nil
+}
 
-	addToTransactionPool(tx, getUnspentTxOuts())
+// submitTransaction adds a transaction built elsewhere to the pool
+func submitTransaction(tx Transaction) error {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
 
-	return tx
+	return addToTransactionPool(&tx, getUnspentTxOuts())
 }
 
 // const sendTransaction = (address: string, amount: number): Transaction => {
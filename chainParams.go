@@ -0,0 +1,121 @@
+package main
+
+import "fmt"
+
+// ChainParams are the consensus parameters of a network
+type ChainParams struct {
+	Name string
+	// signatures commit to it, so they cannot be replayed on other networks
+	ChainID uint32
+
+	// seconds between blocks the difficulty aims for
+	BlockGenerationInterval int64
+	// how the target of the next block is chosen
+	Difficulty DifficultyAlgorithm
+
+	// subsidy of the genesis block and the ones after it
+	InitialSubsidy int
+	// blocks between halvings of the subsidy, 0 to never halve
+	HalvingInterval int
+	// coins the subsidies may add up to, 0 for no cap
+	MaxSupply int
+	// blocks a coinbase output must be buried under before it is spent
+	CoinbaseMaturity int
+
+	// snapshots of the unspent set a new node may start from
+	Snapshots []SnapshotCheckpoint
+}
+
+// SnapshotCheckpoint pins the hash of the snapshot of the unspent set at a
+// block. A node trusts a snapshot file with that hash until it has
+// validated the blocks under it.
+type SnapshotCheckpoint struct {
+	Height    int
+	BlockHash string
+	Hash      string
+}
+
+var mainNetParams = ChainParams{
+	Name:                    "main",
+	ChainID:                 1,
+	BlockGenerationInterval: blockGenerationInterval,
+	Difficulty: &stepDifficulty{
+		TargetSpacing:    blockGenerationInterval,
+		AdjustmentBlocks: difficultyAdjustmentInterval,
+	},
+	InitialSubsidy:   50,
+	HalvingInterval:  210000,
+	MaxSupply:        21000000,
+	CoinbaseMaturity: 100,
+}
+
+var testNetParams = ChainParams{
+	Name:                    "test",
+	ChainID:                 2,
+	BlockGenerationInterval: blockGenerationInterval,
+	Difficulty: &lwmaDifficulty{
+		TargetSpacing: blockGenerationInterval,
+		Window:        45,
+	},
+	InitialSubsidy:   50,
+	HalvingInterval:  210000,
+	MaxSupply:        21000000,
+	CoinbaseMaturity: 100,
+}
+
+var regTestParams = ChainParams{
+	Name:                    "regtest",
+	ChainID:                 3,
+	BlockGenerationInterval: blockGenerationInterval,
+	Difficulty: &asertDifficulty{
+		TargetSpacing: blockGenerationInterval,
+		HalfLife:      60 * 60,
+		AnchorHeight:  1,
+	},
+	InitialSubsidy:   50,
+	HalvingInterval:  150,
+	CoinbaseMaturity: 10,
+	// of the chain -genregtest builds, see regtestChain.go
+	Snapshots: []SnapshotCheckpoint{
+		{Height: 110, BlockHash: "1f9eadcf5aea1495fdad5ac76cf4c895b14f997aa27a6230b9a19c667468b7c2", Hash: "ac2c4a48d32c8d5eab573c217563a91f39b7b3dd70579b4fe6c0001c3e178ad2"},
+	},
+}
+
+var networks = map[string]*ChainParams{
+	mainNetParams.Name: &mainNetParams,
+	testNetParams.Name: &testNetParams,
+	regTestParams.Name: &regTestParams,
+}
+
+// chainParams are the parameters of the network this node runs on
+var chainParams = &mainNetParams
+
+func selectNetwork(name string) error {
+	params, ok := networks[name]
+	if !ok {
+		return fmt.Errorf("unknown network %q", name)
+	}
+	chainParams = params
+	return nil
+}
+
+// snapshotAt returns the snapshot pinned at the block hash at height
+func (params *ChainParams) snapshotAt(height int, hash string) (SnapshotCheckpoint, bool) {
+	for _, checkpoint := range params.Snapshots {
+		if checkpoint.Height == height && checkpoint.BlockHash == hash {
+			return checkpoint, true
+		}
+	}
+	return SnapshotCheckpoint{}, false
+}
+
+// snapshotOn returns the highest snapshot pinned at a block of aBlockchain
+func (params *ChainParams) snapshotOn(aBlockchain []Block) (SnapshotCheckpoint, bool) {
+	best, found := SnapshotCheckpoint{}, false
+	for _, checkpoint := range params.Snapshots {
+		if checkpoint.Height < len(aBlockchain) && aBlockchain[checkpoint.Height].Hash == checkpoint.BlockHash && (!found || checkpoint.Height > best.Height) {
+			best, found = checkpoint, true
+		}
+	}
+	return best, found
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,14 +21,12 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer. Large enough for a full batch
+	// of headers or blocks.
+	maxMessageSize = 4 << 20
 )
 
-var (
-	newline = []byte{'\n'}
-	space   = []byte{' '}
-)
+var space = []byte{' '}
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
@@ -43,12 +42,112 @@ type Client struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// closed when the peer is gone, sends to it are dropped from then on
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
-// Message is a message
+// Message is a message. Blocks travel in Data as a JSON array of their
+// binary encodings.
 type Message struct {
-	Type int         `json:"type"`
-	Data interface{} `json:"data,omitempty"`
+	Type int             `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+func blocksMsg(msgType int, blocks []Block) Message {
+	encoded := make([][]byte, len(blocks))
+	for i, block := range blocks {
+		encoded[i], _ = block.MarshalBinary()
+	}
+	data, _ := json.Marshal(encoded)
+
+	return Message{
+		Type: msgType,
+		Data: data,
+	}
+}
+
+func headersMsg(headers []BlockHeader) Message {
+	encoded := make([][]byte, len(headers))
+	for i, header := range headers {
+		encoded[i], _ = header.MarshalBinary()
+	}
+	data, _ := json.Marshal(encoded)
+
+	return Message{
+		Type: responseHeaders,
+		Data: data,
+	}
+}
+
+func queryHeadersMsg(locator []string) Message {
+	data, _ := json.Marshal(locator)
+
+	return Message{
+		Type: queryHeaders,
+		Data: data,
+	}
+}
+
+func queryBlocksMsg(hashes []string) Message {
+	data, _ := json.Marshal(hashes)
+
+	return Message{
+		Type: queryBlocks,
+		Data: data,
+	}
+}
+
+func rejectMsg(rejection Rejection) Message {
+	data, _ := json.Marshal(rejection)
+
+	return Message{
+		Type: reject,
+		Data: data,
+	}
+}
+
+func (m Message) rejection() (Rejection, error) {
+	var rejection Rejection
+	err := json.Unmarshal(m.Data, &rejection)
+	return rejection, err
+}
+
+func (m Message) headers() ([]BlockHeader, error) {
+	var encoded [][]byte
+	if err := json.Unmarshal(m.Data, &encoded); err != nil {
+		return nil, err
+	}
+
+	headers := make([]BlockHeader, len(encoded))
+	for i, b := range encoded {
+		if err := headers[i].UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+	}
+	return headers, nil
+}
+
+func (m Message) hashes() ([]string, error) {
+	var hashes []string
+	err := json.Unmarshal(m.Data, &hashes)
+	return hashes, err
+}
+
+func (m Message) blocks() ([]Block, error) {
+	var encoded [][]byte
+	if err := json.Unmarshal(m.Data, &encoded); err != nil {
+		return nil, err
+	}
+
+	blocks := make([]Block, len(encoded))
+	for i, b := range encoded {
+		if err := blocks[i].UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -58,6 +157,7 @@ type Message struct {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
+		syncer.removePeer(c)
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
@@ -67,9 +167,6 @@ func (c *Client) readPump() {
 	for {
 		var message Message
 		err := c.conn.ReadJSON(&message)
-		fmt.Printf("Got message: %#v\n", message)
-		fmt.Printf("err: %#v\n", err)
-
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
@@ -78,42 +175,118 @@ func (c *Client) readPump() {
 		}
 		switch message.Type {
 		case queryLatest:
-			c.sendMesssage(Message{
-				Type: responseBlockchain,
-				Data: GetLatestBlock(),
-			})
-		case queryAll:
-			c.sendMesssage(Message{
-				Type: responseBlockchain,
-				Data: GetBlockchain(),
-			})
+			chainMutex.Lock()
+			response := responseLatestMsg()
+			chainMutex.Unlock()
+			c.sendMesssage(response)
+		case queryHeaders:
+			locator, err := message.hashes()
+			if err != nil {
+				log.Printf("error: %v", err)
+				break
+			}
+			chainMutex.Lock()
+			response := headersMsg(getHeadersAfter(locator))
+			chainMutex.Unlock()
+			c.sendMesssage(response)
+		case queryBlocks:
+			hashes, err := message.hashes()
+			if err != nil {
+				log.Printf("error: %v", err)
+				break
+			}
+			chainMutex.Lock()
+			response := blocksMsg(responseBlocks, getBlocksByHash(hashes))
+			chainMutex.Unlock()
+			c.sendMesssage(response)
+		case responseHeaders:
+			headers, err := message.headers()
+			if err != nil {
+				log.Printf("error: %v", err)
+				break
+			}
+			syncer.handleHeaders(c, headers)
+		case responseBlocks:
+			blocks, err := message.blocks()
+			if err != nil {
+				log.Printf("error: %v", err)
+				break
+			}
+			syncer.handleBlocks(c, blocks)
+			if validator != nil {
+				validator.handleBlocks(c, blocks)
+			}
 		case responseBlockchain:
 			if message.Data == nil {
 				break
 			}
+			receivedBlocks, err := message.blocks()
+			if err != nil {
+				log.Printf("error: %v", err)
+				break
+			}
+			c.handleBlockchainResponse(receivedBlocks)
+		case reject:
+			rejection, err := message.rejection()
+			if err != nil {
+				log.Printf("error: %v", err)
+				break
+			}
+			fmt.Printf("peer %s rejected %s %s: %s: %s\n", c.conn.RemoteAddr(), rejection.Kind, rejection.Hash, rejection.Rule, rejection.Message)
 		}
-
-		c.handleBlockchainResponse(message.Data.([]Block))
 	}
 }
 func responseLatestMsg() Message {
-	return Message{
-		Type: responseBlockchain,
-		Data: GetLatestBlock(),
-	}
+	return blocksMsg(responseBlockchain, []Block{GetLatestBlock()})
 }
 
-func queryAllMsg() Message {
+func queryLatestMsg() Message {
 	return Message{
-		Type: queryAll,
+		Type: queryLatest,
 		Data: nil,
 	}
-
 }
+
+// sendMesssage queues message for the peer without blocking. A peer too
+// slow to keep its queue from filling up is dropped.
 func (c *Client) sendMesssage(message Message) {
 	byte, _ := json.Marshal(message)
-	c.send <- byte
+	select {
+	case <-c.done:
+	case c.send <- byte:
+	default:
+		c.drop("it does not read what we send")
+	}
+}
+
+// stop tells writePump the peer is gone
+func (c *Client) stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// sendReject tells the peer why we rejected the block or transaction with
+// hash it sent us
+func (c *Client) sendReject(kind string, hash string, err *RuleError) {
+	c.sendMesssage(rejectMsg(Rejection{Kind: kind, Hash: hash, Rule: err.Rule, Message: err.Message}))
 }
+
+// rejectBlock tells the peer why we rejected the block with hash it sent us,
+// and drops the peer if it sent a broken body
+func (c *Client) rejectBlock(hash string, err *RuleError) {
+	c.sendReject("block", hash, err)
+	if isBadBody(err) {
+		c.drop(fmt.Sprintf("it sent block %s with a bad body", hash))
+	}
+}
+
+// drop disconnects c for why
+func (c *Client) drop(why string) {
+	fmt.Printf("dropping peer %s, %s\n", c.conn.RemoteAddr(), why)
+	c.conn.Close()
+}
+
 func (c *Client) broadcast(message Message) {
 	byte, _ := json.Marshal(message)
 	c.hub.broadcast <- byte
@@ -126,23 +299,37 @@ func (c *Client) handleBlockchainResponse(receivedBlocks []Block) {
 	}
 	latestBlockReceived := receivedBlocks[len(receivedBlocks)-1]
 
+	chainMutex.Lock()
+	var reply *Message
+	var err error
+	needSync := false
 	latestBlockHeld := GetLatestBlock()
 
-	if latestBlockReceived.Index > latestBlockHeld.Index {
-		fmt.Println(fmt.Sprintf("blockchain possibly behind. We got: %#v Peer got: %#v", latestBlockReceived.Index, latestBlockReceived.Index))
-		if latestBlockHeld.Hash == latestBlockReceived.PreviousHash {
-			if addBlockToChain(latestBlockReceived) {
-				c.broadcast(responseLatestMsg())
-			}
-		} else if len(receivedBlocks) == 1 {
-			fmt.Println("We have to query the chain from our peer")
-			c.broadcast(queryAllMsg())
-		} else {
-			fmt.Println("Received blockchain is longer than current blockchain")
-			ReplaceChain(receivedBlocks)
+	if blockTree.hasBlock(latestBlockReceived.Hash) {
+		fmt.Println("received block is already known. Do nothing")
+	} else if blockTree.hasBlock(latestBlockReceived.PreviousHash) {
+		err = addBlockToChain(latestBlockReceived)
+		if err == nil && GetLatestBlock().Hash != latestBlockHeld.Hash {
+			latest := responseLatestMsg()
+			reply = &latest
 		}
+	} else if len(receivedBlocks) == 1 {
+		fmt.Println("We have to sync the chain from our peer")
+		needSync = true
 	} else {
-		fmt.Println("received blockchain is not longer than received blockchain. Do nothing")
+		fmt.Println(fmt.Sprintf("blockchain possibly behind. We got: %#v Peer got: %#v", latestBlockHeld.Index, latestBlockReceived.Index))
+		err = ReplaceChain(receivedBlocks)
+	}
+	chainMutex.Unlock()
+
+	if ruleErr := asRuleError(err); ruleErr != nil {
+		c.rejectBlock(latestBlockReceived.Hash, ruleErr)
+	}
+	if reply != nil {
+		c.broadcast(*reply)
+	}
+	if needSync {
+		syncer.start(c)
 	}
 }
 
@@ -159,28 +346,17 @@ func (c *Client) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
+		case <-c.done:
+			// The hub is done with the peer.
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case message := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.send)
-			}
 
-			if err := w.Close(); err != nil {
+			// one message per frame, the reader decodes one JSON value
+			// from each
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -194,8 +370,12 @@ func (c *Client) writePump() {
 
 const (
 	queryLatest        = 0
-	queryAll           = 1
 	responseBlockchain = 2
+	queryHeaders       = 3
+	responseHeaders    = 4
+	queryBlocks        = 5
+	responseBlocks     = 6
+	reject             = 7
 )
 
 // serveWs handles websocket requests from the peer.
@@ -205,11 +385,28 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	startClient(hub, conn)
+}
+
+// connectToPeer opens a websocket connection to the peer at address
+func connectToPeer(hub *Hub, address string) error {
+	conn, _, err := websocket.DefaultDialer.Dial(address, nil)
+	if err != nil {
+		return err
+	}
+	startClient(hub, conn)
+	return nil
+}
+
+func startClient(hub *Hub, conn *websocket.Conn) {
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), done: make(chan struct{})}
 	client.hub.register <- client
+	syncer.addPeer(client)
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go client.writePump()
 	go client.readPump()
+
+	client.sendMesssage(queryLatestMsg())
 }
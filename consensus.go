@@ -0,0 +1,571 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Consensus rules. Blocks and transactions are checked by running them
+// through lists of rules, each named after what it rejects. The first rule
+// that fails turns the block or transaction down with a RuleError, which is
+// logged, kept for the API and sent back to the peer it came from.
+
+const (
+	ruleBadGenesis     = "bad-genesis"
+	ruleBadIndex       = "bad-index"
+	ruleBadPrevHash    = "bad-prevhash"
+	ruleBadPrevBlock   = "bad-prevblk"
+	ruleBadHash        = "bad-hash"
+	ruleBadPow         = "bad-pow"
+	ruleBadDiffBits    = "bad-diffbits"
+	ruleTimeTooOld     = "time-too-old"
+	ruleTimeTooNew     = "time-too-new"
+	ruleBadMerkleRoot  = "bad-merkleroot"
+	ruleBadBlockLength = "bad-blk-length"
+	ruleNoCoinbase     = "bad-cb-missing"
+	ruleBadCoinbase    = "bad-cb"
+	ruleCoinbaseAmount = "coinbase-amount"
+	ruleImmatureSpend  = "bad-txns-premature-spend-of-coinbase"
+	ruleDuplicateInput = "duplicate-inputs"
+
+	ruleBadTxID               = "bad-txid"
+	ruleBadTxStructure        = "bad-tx-structure"
+	ruleBadTxAmount           = "bad-tx-amount"
+	ruleMissingInputs         = "missing-inputs"
+	ruleNonFinal              = "bad-txns-nonfinal"
+	ruleRelativeLocked        = "non-BIP68-final"
+	ruleBadScript             = "bad-script"
+	ruleInputsLessThanOutputs = "inputs-less-than-outputs"
+	ruleMempoolConflict       = "txn-mempool-conflict"
+)
+
+const (
+	// how far past our clock, in seconds, a block timestamp may be
+	maxFutureBlockTime = 60
+	// how far before its parent, in seconds, a block timestamp may be
+	maxPastBlockTime = 60
+	// most bytes the encoding of a block may take. Sixteen blocks must fit
+	// in a peer message.
+	maxBlockSize = 128 << 10
+	// no amount can get anywhere near this, so sums of amounts below it
+	// cannot overflow
+	maxAmount = 1 << 53
+)
+
+// chainContext is the block a transaction is checked for, which lock times
+// are measured against. Time is the timestamp of the parent of the block.
+type chainContext struct {
+	Height int
+	Time   int64
+}
+
+// blockContext is the context of block, built on parent
+func blockContext(block Block, parent Block) chainContext {
+	return chainContext{Height: block.Index, Time: parent.Timestamp}
+}
+
+// genesisContext is the context the genesis outputs are confirmed in
+func genesisContext() chainContext {
+	return chainContext{Height: 0, Time: genesisBlock.Timestamp}
+}
+
+// nextBlockContext is the context of the block following our tip, which is
+// where pool transactions go
+func nextBlockContext() chainContext {
+	tip := GetLatestBlock()
+	return chainContext{Height: tip.Index + 1, Time: tip.Timestamp}
+}
+
+// RuleError is returned when a block or transaction breaks a consensus rule,
+// or when the pool turns a transaction down under the policy in policy.go
+type RuleError struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Rule, e.Message)
+}
+
+func ruleError(rule string, format string, a ...interface{}) *RuleError {
+	return &RuleError{Rule: rule, Message: fmt.Sprintf(format, a...)}
+}
+
+// asRuleError returns the rule err breaks, or nil if err is not about a
+// consensus rule
+func asRuleError(err error) *RuleError {
+	var ruleErr *RuleError
+	if errors.As(err, &ruleErr) {
+		return ruleErr
+	}
+	return nil
+}
+
+// Rejection is a block or transaction we turned down
+type Rejection struct {
+	Kind    string `json:"kind"`
+	Hash    string `json:"hash"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	Time    int64  `json:"time,omitempty"`
+}
+
+const maxRecentRejections = 100
+
+// recentRejections are the last blocks and transactions we rejected, oldest
+// first. It is guarded by chainMutex.
+var recentRejections = []Rejection{}
+
+// logRejection logs that the block or transaction with hash broke a rule and
+// returns the rejection to tell peers about
+func logRejection(kind string, hash string, err *RuleError) Rejection {
+	fmt.Printf("%s %s rejected: %v\n", kind, hash, err)
+
+	rejection := Rejection{
+		Kind:    kind,
+		Hash:    hash,
+		Rule:    err.Rule,
+		Message: err.Message,
+		Time:    time.Now().Unix(),
+	}
+	recentRejections = append(recentRejections, rejection)
+	if len(recentRejections) > maxRecentRejections {
+		recentRejections = recentRejections[1:]
+	}
+
+	return rejection
+}
+
+// headerFailures are the rules a block breaks whatever body it comes with:
+// its hash commits to its header. A block breaking any other rule may be a
+// valid block a peer broke on the way, so only that copy is dropped, and a
+// block too far in the future can become valid.
+var headerFailures = map[string]bool{
+	ruleBadIndex:     true,
+	ruleBadPrevHash:  true,
+	ruleBadPrevBlock: true,
+	ruleBadPow:       true,
+	ruleBadDiffBits:  true,
+	ruleTimeTooOld:   true,
+}
+
+// isBadBody reports whether a block was rejected for the body or hash it
+// came with, which the peer that sent it is to blame for
+func isBadBody(err *RuleError) bool {
+	return !headerFailures[err.Rule] && err.Rule != ruleTimeTooNew
+}
+
+// headerRules need nothing but the header
+var headerRules = []func(header BlockHeader) error{
+	checkHeaderHash,
+	checkProofOfWork,
+}
+
+// chainHeaderRules check the header of a block against chain, the blocks
+// from genesis up to its parent
+var chainHeaderRules = []func(block Block, chain []Block) error{
+	checkIndex,
+	checkPreviousHash,
+	checkDifficultyBits,
+	checkTimestamp,
+}
+
+// blockRules check the transactions of a block against its header
+var blockRules = []func(block Block, chain []Block) error{
+	checkMerkleRoot,
+	checkBlockSize,
+}
+
+// blockTransactionRules check the transactions of a block against the
+// unspent outputs it is connected to, at is the block itself
+var blockTransactionRules = []func(aTransactions []Transaction, aUnspentTxOuts UtxoView, at chainContext) error{
+	checkCoinbase,
+	checkBlockDuplicateInputs,
+	checkBlockTransactions,
+	checkCoinbaseAmount,
+}
+
+// transactionRules check a transaction going into the block at against the
+// unspent outputs it spends
+var transactionRules = []func(transaction Transaction, aUnspentTxOuts UtxoView, at chainContext) error{
+	checkTransactionID,
+	checkTransactionStructure,
+	checkTransactionInputs,
+	checkCoinbaseMaturity,
+	checkTransactionFinal,
+	checkRelativeLocks,
+	checkScripts,
+	checkTransactionAmounts,
+}
+
+// checkBlockHeader applies the rules that need nothing but header, so
+// headers can be checked before we have their blocks
+func checkBlockHeader(header BlockHeader) error {
+	for _, rule := range headerRules {
+		if err := rule(header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateNewBlock checks newBlock as the block following chain, which runs
+// from genesis up to its parent. The transactions are checked against the
+// unspent outputs when the block is connected.
+func validateNewBlock(newBlock Block, chain []Block) error {
+	if err := validateNewHeader(newBlock, chain); err != nil {
+		return err
+	}
+	for _, rule := range blockRules {
+		if err := rule(newBlock, chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateNewHeader checks the header of newBlock as the block following
+// chain, without looking at its transactions
+func validateNewHeader(newBlock Block, chain []Block) error {
+	if err := checkBlockHeader(newBlock.Header()); err != nil {
+		return err
+	}
+	for _, rule := range chainHeaderRules {
+		if err := rule(newBlock, chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateChain checks that blockchainToValidate starts at our genesis block
+// and that every block follows the one before it
+func validateChain(blockchainToValidate []Block) error {
+	return validateChainUnder(blockchainToValidate, 0)
+}
+
+// validateChainUnder is validateChain for a chain whose blocks up to height
+// may be headers only, like the blocks under the snapshot a node started
+// from
+func validateChainUnder(blockchainToValidate []Block, height int) error {
+	if len(blockchainToValidate) == 0 || !reflect.DeepEqual(blockchainToValidate[0], *genesisBlock) {
+		return ruleError(ruleBadGenesis, "chain does not start at our genesis block")
+	}
+
+	for i := 1; i < len(blockchainToValidate); i++ {
+		block := blockchainToValidate[i]
+		var err error
+		if i <= height && !block.hasBody() {
+			err = validateNewHeader(block, blockchainToValidate[:i])
+		} else {
+			err = validateNewBlock(block, blockchainToValidate[:i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkHeaderHash(header BlockHeader) error {
+	hash := calculateHash(header.Index, header.PreviousHash, header.Timestamp, header.MerkleRoot, header.Bits, header.Nonce)
+	if hash != header.Hash {
+		return ruleError(ruleBadHash, "block %d has hash %s, its header hashes to %s", header.Index, header.Hash, hash)
+	}
+	return nil
+}
+
+func checkProofOfWork(header BlockHeader) error {
+	if !hashMatchesDifficulty(header.Hash, header.Bits) {
+		return ruleError(ruleBadPow, "hash of block %d is above its target %08x", header.Index, header.Bits)
+	}
+	return nil
+}
+
+func checkIndex(block Block, chain []Block) error {
+	if want := len(chain); block.Index != want {
+		return ruleError(ruleBadIndex, "block has index %d, expected %d", block.Index, want)
+	}
+	return nil
+}
+
+func checkPreviousHash(block Block, chain []Block) error {
+	if parent := chain[len(chain)-1]; block.PreviousHash != parent.Hash {
+		return ruleError(ruleBadPrevHash, "block %d builds on %s, expected %s", block.Index, block.PreviousHash, parent.Hash)
+	}
+	return nil
+}
+
+func checkDifficultyBits(block Block, chain []Block) error {
+	if want := getDifficulty(chain); block.Bits != want {
+		return ruleError(ruleBadDiffBits, "block %d has bits %08x, expected %08x", block.Index, block.Bits, want)
+	}
+	return nil
+}
+
+func checkTimestamp(block Block, chain []Block) error {
+	parent := chain[len(chain)-1]
+	if block.Timestamp <= parent.Timestamp-maxPastBlockTime {
+		return ruleError(ruleTimeTooOld, "block %d has timestamp %d, its parent %d", block.Index, block.Timestamp, parent.Timestamp)
+	}
+	if now := getCurrentTimestamp(); block.Timestamp >= now+maxFutureBlockTime {
+		return ruleError(ruleTimeTooNew, "block %d has timestamp %d, our clock says %d", block.Index, block.Timestamp, now)
+	}
+	return nil
+}
+
+func checkMerkleRoot(block Block, chain []Block) error {
+	if root := calculateMerkleRoot(block.Data); root != block.MerkleRoot {
+		return ruleError(ruleBadMerkleRoot, "block %d has Merkle root %s, its transactions give %s", block.Index, block.MerkleRoot, root)
+	}
+	return nil
+}
+
+func checkBlockSize(block Block, chain []Block) error {
+	b, _ := block.MarshalBinary()
+	if len(b) > maxBlockSize {
+		return ruleError(ruleBadBlockLength, "block %d takes %d bytes, at most %d are allowed", block.Index, len(b), maxBlockSize)
+	}
+	return nil
+}
+
+// validateBlockTransactions checks the transactions of the block at against
+// the unspent outputs before it
+func validateBlockTransactions(aTransactions []Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	for _, rule := range blockTransactionRules {
+		if err := rule(aTransactions, aUnspentTxOuts, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkCoinbase(aTransactions []Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	if len(aTransactions) == 0 {
+		return ruleError(ruleNoCoinbase, "block %d has no coinbase transaction", at.Height)
+	}
+	return validateCoinbaseTx(aTransactions[0], at.Height)
+}
+
+// validateCoinbaseTx checks that transaction is a well formed coinbase for
+// the block at blockIndex. What it may claim is checked once the fees of the
+// block are known.
+func validateCoinbaseTx(transaction Transaction, blockIndex int) error {
+	if err := checkTransactionID(transaction, nil, chainContext{Height: blockIndex}); err != nil {
+		return err
+	}
+	if len(transaction.TxIns) != 1 || transaction.TxIns[0].TxOutID != "" {
+		return ruleError(ruleBadCoinbase, "coinbase must have a single input spending nothing")
+	}
+	if transaction.TxIns[0].TxOutIndex != blockIndex {
+		return ruleError(ruleBadCoinbase, "coinbase input must hold the block index %d, it holds %d", blockIndex, transaction.TxIns[0].TxOutIndex)
+	}
+	if len(transaction.TxOuts) == 0 {
+		return ruleError(ruleBadCoinbase, "coinbase has no outputs")
+	}
+	for index, txOut := range transaction.TxOuts {
+		if txOut.Amount < 0 || txOut.Amount > maxAmount {
+			return ruleError(ruleCoinbaseAmount, "output %d of the coinbase pays %d", index, txOut.Amount)
+		}
+	}
+	return nil
+}
+
+// checkCoinbaseAmount lets the outputs of the coinbase claim the block
+// reward plus the fees of the other transactions, which have been checked
+// already
+func checkCoinbaseAmount(aTransactions []Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	fees := 0
+	view := newUtxoOverlay(aUnspentTxOuts)
+	for _, tx := range aTransactions[1:] {
+		fees += getTransactionFee(tx, view)
+		view.apply([]Transaction{tx}, at)
+	}
+
+	// each output is at most maxAmount, so stopping past it cannot overflow
+	claimed := 0
+	for _, txOut := range aTransactions[0].TxOuts {
+		claimed += txOut.Amount
+		if claimed > maxAmount {
+			break
+		}
+	}
+
+	subsidy := blockSubsidy(at.Height)
+	if claimed > subsidy+fees {
+		return ruleError(ruleCoinbaseAmount, "coinbase pays %d, the block reward is %d and the fees %d", claimed, subsidy, fees)
+	}
+	return nil
+}
+
+func checkBlockDuplicateInputs(aTransactions []Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	txIns := []TxIn{}
+	for _, tx := range aTransactions {
+		txIns = append(txIns, tx.TxIns...)
+	}
+
+	if hasDuplicates(txIns) {
+		return ruleError(ruleDuplicateInput, "block %d spends an output twice", at.Height)
+	}
+	return nil
+}
+
+// checkBlockTransactions validates the transactions of a block in order,
+// each of which may spend outputs of those before it
+func checkBlockTransactions(aTransactions []Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	view := newUtxoOverlay(aUnspentTxOuts)
+	for _, tx := range aTransactions[1:] {
+		if err := validateTransaction(tx, view, at); err != nil {
+			return err
+		}
+		view.apply([]Transaction{tx}, at)
+	}
+	return nil
+}
+
+func hasDuplicates(txIns []TxIn) bool {
+	seen := map[string]bool{}
+
+	for _, txIn := range txIns {
+		key := fmt.Sprintf("%s:%d", txIn.TxOutID, txIn.TxOutIndex)
+		if seen[key] {
+			return true
+		}
+		seen[key] = true
+	}
+	return false
+}
+
+// validateTransaction checks a transaction spending aUnspentTxOuts in the
+// block at
+func validateTransaction(transaction Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	for _, rule := range transactionRules {
+		if err := rule(transaction, aUnspentTxOuts, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkTransactionID(transaction Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	if id := getTransactionID(transaction); id != transaction.ID {
+		return ruleError(ruleBadTxID, "transaction %s hashes to %s", transaction.ID, id)
+	}
+	return nil
+}
+
+func checkTransactionStructure(transaction Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	if len(transaction.TxIns) == 0 {
+		return ruleError(ruleBadTxStructure, "transaction %s has no inputs", transaction.ID)
+	}
+	if len(transaction.TxOuts) == 0 {
+		return ruleError(ruleBadTxStructure, "transaction %s has no outputs", transaction.ID)
+	}
+	if hasDuplicates(transaction.TxIns) {
+		return ruleError(ruleDuplicateInput, "transaction %s spends an output twice", transaction.ID)
+	}
+	for index, txIn := range transaction.TxIns {
+		if txIn.Signature != "" && len(txIn.Script) > 0 {
+			return ruleError(ruleBadTxStructure, "input %d of transaction %s has both a signature and a script", index, transaction.ID)
+		}
+		if len(txIn.Script) > maxScriptSize {
+			return ruleError(ruleBadTxStructure, "input %d of transaction %s has a %d byte script", index, transaction.ID, len(txIn.Script))
+		}
+	}
+	for index, txOut := range transaction.TxOuts {
+		if txOut.Amount <= 0 || txOut.Amount > maxAmount {
+			return ruleError(ruleBadTxAmount, "output %d of transaction %s has amount %d", index, transaction.ID, txOut.Amount)
+		}
+		if txOut.Address != "" && len(txOut.Script) > 0 {
+			return ruleError(ruleBadTxStructure, "output %d of transaction %s has both an address and a script", index, transaction.ID)
+		}
+		if len(txOut.Script) > maxScriptSize {
+			return ruleError(ruleBadTxStructure, "output %d of transaction %s has a %d byte script", index, transaction.ID, len(txOut.Script))
+		}
+	}
+	return nil
+}
+
+func checkTransactionInputs(transaction Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	for _, txIn := range transaction.TxIns {
+		if findUnspentTxOut(txIn.TxOutID, txIn.TxOutIndex, aUnspentTxOuts) == nil {
+			return ruleError(ruleMissingInputs, "transaction %s spends %s:%d, which is not unspent", transaction.ID, txIn.TxOutID, txIn.TxOutIndex)
+		}
+	}
+	return nil
+}
+
+func checkCoinbaseMaturity(transaction Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	for index, txIn := range transaction.TxIns {
+		spent := findUnspentTxOut(txIn.TxOutID, txIn.TxOutIndex, aUnspentTxOuts)
+		if !isMature(*spent, at) {
+			return ruleError(ruleImmatureSpend, "input %d of transaction %s spends a coinbase of block %d in block %d, %d blocks are needed in between", index, transaction.ID, spent.Height, at.Height, chainParams.CoinbaseMaturity)
+		}
+	}
+	return nil
+}
+
+func checkTransactionFinal(transaction Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	if err := isFinal(transaction, at); err != nil {
+		return ruleError(ruleNonFinal, "transaction %s cannot go into block %d: %v", transaction.ID, at.Height, err)
+	}
+	return nil
+}
+
+func checkRelativeLocks(transaction Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	for index, txIn := range transaction.TxIns {
+		spent := findUnspentTxOut(txIn.TxOutID, txIn.TxOutIndex, aUnspentTxOuts)
+		if err := checkRelativeLock(txIn.RelativeLock, *spent, at); err != nil {
+			return ruleError(ruleRelativeLocked, "input %d of transaction %s cannot go into block %d: %v", index, transaction.ID, at.Height, err)
+		}
+	}
+	return nil
+}
+
+func checkScripts(transaction Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	for index, txIn := range transaction.TxIns {
+		if err := validateTxIn(txIn, transaction, index, aUnspentTxOuts, at); err != nil {
+			return ruleError(ruleBadScript, "input %d of transaction %s: %v", index, transaction.ID, err)
+		}
+	}
+	return nil
+}
+
+func checkTransactionAmounts(transaction Transaction, aUnspentTxOuts UtxoView, at chainContext) error {
+	totalTxInValues := 0
+	for _, txIn := range transaction.TxIns {
+		totalTxInValues += findUnspentTxOut(txIn.TxOutID, txIn.TxOutIndex, aUnspentTxOuts).Amount
+	}
+
+	totalTxOutValues := 0
+	for _, txOut := range transaction.TxOuts {
+		totalTxOutValues += txOut.Amount
+		if totalTxOutValues > maxAmount {
+			return ruleError(ruleBadTxAmount, "transaction %s pays out more than can exist", transaction.ID)
+		}
+	}
+
+	if totalTxInValues < totalTxOutValues {
+		return ruleError(ruleInputsLessThanOutputs, "transaction %s spends %d but pays out %d", transaction.ID, totalTxInValues, totalTxOutValues)
+	}
+	return nil
+}
+
+// validateTxIn runs the unlocking script of txIn, input index of
+// transaction, against the locking script of the output it spends
+func validateTxIn(txIn TxIn, transaction Transaction, index int, aUnspentTxOuts UtxoView, at chainContext) error {
+	referencedUTxOut := findUnspentTxOut(txIn.TxOutID, txIn.TxOutIndex, aUnspentTxOuts)
+	if referencedUTxOut == nil {
+		return errors.New("spent output not found")
+	}
+
+	context := scriptContext{
+		tx:         transaction,
+		inputIndex: index,
+		spent:      *referencedUTxOut,
+		at:         at,
+	}
+	return verifyScript(unlockingScript(txIn), lockingScript(*referencedUTxOut), context)
+}
@@ -0,0 +1,152 @@
+package main
+
+import "math/big"
+
+// DifficultyAlgorithm chooses the compact target bits of the block that
+// follows aBlockchain
+type DifficultyAlgorithm interface {
+	Name() string
+	NextBits(aBlockchain []Block) uint32
+}
+
+func clampTarget(target *big.Int) uint32 {
+	if target.Cmp(powLimit) > 0 {
+		target = powLimit
+	}
+	if target.Sign() <= 0 {
+		target = big.NewInt(1)
+	}
+	return bigToCompact(target)
+}
+
+// stepDifficulty keeps the target for AdjustmentBlocks blocks, then halves
+// it if they came in less than half the expected time or doubles it if they
+// took more than twice as long
+type stepDifficulty struct {
+	TargetSpacing    int64
+	AdjustmentBlocks int
+}
+
+func (a *stepDifficulty) Name() string {
+	return "step"
+}
+
+func (a *stepDifficulty) NextBits(aBlockchain []Block) uint32 {
+	latestBlock := aBlockchain[len(aBlockchain)-1]
+	if latestBlock.Index%a.AdjustmentBlocks != 0 || latestBlock.Index == 0 {
+		return latestBlock.Bits
+	}
+
+	prevAdjustmentBlock := aBlockchain[len(aBlockchain)-a.AdjustmentBlocks]
+	timeExpected := a.TargetSpacing * int64(a.AdjustmentBlocks)
+	timeTaken := latestBlock.Timestamp - prevAdjustmentBlock.Timestamp
+
+	target := compactToBig(prevAdjustmentBlock.Bits)
+	if timeTaken < timeExpected/2 {
+		target.Rsh(target, 1)
+	}
+	if timeTaken > timeExpected*2 {
+		target.Lsh(target, 1)
+	}
+	return clampTarget(target)
+}
+
+// lwmaDifficulty retargets every block from the average target of the last
+// Window blocks, scaled by their solve times weighted linearly so that
+// recent blocks count the most (zawy12's LWMA-1)
+type lwmaDifficulty struct {
+	TargetSpacing int64
+	Window        int
+}
+
+func (a *lwmaDifficulty) Name() string {
+	return "lwma"
+}
+
+func (a *lwmaDifficulty) NextBits(aBlockchain []Block) uint32 {
+	n := a.Window
+	if len(aBlockchain) <= n {
+		return aBlockchain[len(aBlockchain)-1].Bits
+	}
+
+	t := a.TargetSpacing
+	// the sum of the weights times the target spacing
+	k := int64(n) * int64(n+1) * t / 2
+
+	blocks := aBlockchain[len(aBlockchain)-n-1:]
+	sumTargets := big.NewInt(0)
+	weightedSolveTimes := int64(0)
+	previousTimestamp := blocks[0].Timestamp
+	for i := 1; i <= n; i++ {
+		// timestamps may go backwards, solve times may not
+		timestamp := blocks[i].Timestamp
+		if timestamp <= previousTimestamp {
+			timestamp = previousTimestamp + 1
+		}
+		solveTime := timestamp - previousTimestamp
+		if solveTime > 6*t {
+			solveTime = 6 * t
+		}
+		previousTimestamp = timestamp
+
+		weightedSolveTimes += solveTime * int64(i)
+		sumTargets.Add(sumTargets, compactToBig(blocks[i].Bits))
+	}
+
+	// keep a run of fast blocks from raising the difficulty too far
+	if weightedSolveTimes < k/10 {
+		weightedSolveTimes = k / 10
+	}
+
+	target := sumTargets.Div(sumTargets, big.NewInt(int64(n)))
+	target.Mul(target, big.NewInt(weightedSolveTimes))
+	target.Div(target, big.NewInt(k))
+	return clampTarget(target)
+}
+
+// asertDifficulty sets the target from how far the chain is ahead of or
+// behind schedule since the anchor block, doubling or halving it for each
+// HalfLife seconds of difference (the aserti3-2d algorithm). Blocks up to
+// the anchor keep the target of their parent.
+type asertDifficulty struct {
+	TargetSpacing int64
+	HalfLife      int64
+	AnchorHeight  int
+}
+
+func (a *asertDifficulty) Name() string {
+	return "asert"
+}
+
+func (a *asertDifficulty) NextBits(aBlockchain []Block) uint32 {
+	latestBlock := aBlockchain[len(aBlockchain)-1]
+	if len(aBlockchain) <= a.AnchorHeight {
+		return latestBlock.Bits
+	}
+	anchor := aBlockchain[a.AnchorHeight]
+
+	timeDelta := latestBlock.Timestamp - anchor.Timestamp
+	heightDelta := int64(latestBlock.Index - anchor.Index)
+
+	// 16.16 fixed point number of half lives we are behind schedule
+	exponent := ((timeDelta - a.TargetSpacing*heightDelta) * 65536) / a.HalfLife
+	shifts := exponent >> 16
+	frac := uint64(exponent & 0xffff)
+
+	// 2^frac by a cubic approximation, in 16.16 fixed point
+	factor := uint64(65536) + ((195766423245049*frac + 971821376*frac*frac + 5127*frac*frac*frac + (1 << 47)) >> 48)
+
+	target := compactToBig(anchor.Bits)
+	target.Mul(target, new(big.Int).SetUint64(factor))
+	shifts -= 16
+	if shifts < 0 {
+		target.Rsh(target, uint(-shifts))
+	} else {
+		if shifts > 256 {
+			shifts = 256
+		}
+		target.Lsh(target, uint(shifts))
+	}
+
+	return clampTarget(target)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"math/rand"
+	"text/tabwriter"
+)
+
+// The difficulty simulator mines synthetic chains with each difficulty
+// algorithm while the network hashrate swings, and reports how block times
+// hold up. Nothing is hashed: each solve time is drawn from the exponential
+// distribution a miner of the given hashrate would follow.
+
+const simulationBaseHashrate = 1e6
+
+// hashratePhase is a stretch of the simulation with a hashrate profile
+type hashratePhase struct {
+	name     string
+	hashrate func(height int) float64
+}
+
+var simulationPhases = []hashratePhase{
+	{"steady", func(int) float64 { return simulationBaseHashrate }},
+	{"10x jump", func(int) float64 { return 10 * simulationBaseHashrate }},
+	{"back to steady", func(int) float64 { return simulationBaseHashrate }},
+	{"10x drop", func(int) float64 { return simulationBaseHashrate / 10 }},
+	{"hopping", func(height int) float64 {
+		if height/50%2 == 0 {
+			return 5 * simulationBaseHashrate
+		}
+		return simulationBaseHashrate
+	}},
+}
+
+func simulationAlgorithms(targetSpacing int64) []DifficultyAlgorithm {
+	return []DifficultyAlgorithm{
+		&stepDifficulty{TargetSpacing: targetSpacing, AdjustmentBlocks: difficultyAdjustmentInterval},
+		&lwmaDifficulty{TargetSpacing: targetSpacing, Window: 45},
+		&asertDifficulty{TargetSpacing: targetSpacing, HalfLife: 60 * 60, AnchorHeight: 1},
+	}
+}
+
+type blockTimeStats struct {
+	count   int
+	sum     float64
+	sumSq   float64
+	longest float64
+	slow    int
+}
+
+func (s *blockTimeStats) add(solveTime float64, targetSpacing int64) {
+	s.count++
+	s.sum += solveTime
+	s.sumSq += solveTime * solveTime
+	if solveTime > s.longest {
+		s.longest = solveTime
+	}
+	if solveTime > float64(6*targetSpacing) {
+		s.slow++
+	}
+}
+
+func (s *blockTimeStats) mean() float64 {
+	return s.sum / float64(s.count)
+}
+
+func (s *blockTimeStats) stddev() float64 {
+	mean := s.mean()
+	return math.Sqrt(math.Max(0, s.sumSq/float64(s.count)-mean*mean))
+}
+
+// simulateDifficulty mines blocksPerPhase blocks in every hashrate phase
+// with algorithm and returns the block time statistics of each phase
+func simulateDifficulty(algorithm DifficultyAlgorithm, targetSpacing int64, blocksPerPhase int, seed int64) []blockTimeStats {
+	rng := rand.New(rand.NewSource(seed))
+
+	// start at the target that suits the base hashrate
+	initialTarget := new(big.Int).Lsh(big.NewInt(1), 256)
+	initialTarget.Div(initialTarget, big.NewInt(int64(simulationBaseHashrate)*targetSpacing))
+
+	chain := []Block{{Index: 0, Timestamp: 0, Bits: clampTarget(initialTarget)}}
+	clock := 0.0
+	stats := make([]blockTimeStats, len(simulationPhases))
+
+	for p, phase := range simulationPhases {
+		for i := 0; i < blocksPerPhase; i++ {
+			height := len(chain)
+			bits := algorithm.NextBits(chain)
+
+			work, _ := new(big.Float).SetInt(calcWork(bits)).Float64()
+			solveTime := rng.ExpFloat64() * work / phase.hashrate(height)
+			clock += solveTime
+
+			chain = append(chain, Block{Index: height, Timestamp: int64(clock), Bits: bits})
+			stats[p].add(solveTime, targetSpacing)
+		}
+	}
+
+	return stats
+}
+
+// runDifficultySimulation prints the block time statistics of every
+// algorithm for targetSpacing
+func runDifficultySimulation(out io.Writer, targetSpacing int64, blocksPerPhase int) {
+	fmt.Fprintf(out, "target block time %ds, %d blocks per phase\n\n", targetSpacing, blocksPerPhase)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "algorithm\tphase\tmean (s)\tstddev (s)\tlongest (s)\tover 6x target\t")
+	for _, algorithm := range simulationAlgorithms(targetSpacing) {
+		total := blockTimeStats{}
+		for p, stats := range simulateDifficulty(algorithm, targetSpacing, blocksPerPhase, 1) {
+			fmt.Fprintf(w, "%s\t%s\t%.1f\t%.1f\t%.0f\t%d\t\n", algorithm.Name(), simulationPhases[p].name, stats.mean(), stats.stddev(), stats.longest, stats.slow)
+			total.count += stats.count
+			total.sum += stats.sum
+			total.sumSq += stats.sumSq
+			total.longest = math.Max(total.longest, stats.longest)
+			total.slow += stats.slow
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%.1f\t%.0f\t%d\t\n", algorithm.Name(), "all", total.mean(), total.stddev(), total.longest, total.slow)
+	}
+	w.Flush()
+}
@@ -0,0 +1,71 @@
+package main
+
+import "fmt"
+
+// Time locks. A transaction with a LockTime cannot go into a block before
+// that height or time. An input with a RelativeLock cannot go into a block
+// until the output it spends has been confirmed for that many blocks or
+// seconds. Times are measured against the parent of the block, since the
+// miner of a block chooses its timestamp.
+
+// A RelativeLock with relativeLockTypeFlag set counts seconds in units of
+// 1<<relativeLockGranularity, otherwise it counts blocks. Only the bits of
+// relativeLockMask hold the count.
+const (
+	relativeLockTypeFlag    = 1 << 22
+	relativeLockMask        = 0x0000ffff
+	relativeLockGranularity = 9
+)
+
+// relativeLockBlocks is the relative lock of blocks blocks
+func relativeLockBlocks(blocks int) uint32 {
+	return uint32(blocks) & relativeLockMask
+}
+
+// relativeLockSeconds is the relative lock of at least seconds seconds
+func relativeLockSeconds(seconds int64) uint32 {
+	units := (seconds + 1<<relativeLockGranularity - 1) >> relativeLockGranularity
+	return relativeLockTypeFlag | uint32(units)&relativeLockMask
+}
+
+// isFinal checks that transaction may go into the block at
+func isFinal(transaction Transaction, at chainContext) error {
+	if transaction.LockTime == 0 {
+		return nil
+	}
+	return checkLockTime(transaction.LockTime, at)
+}
+
+// checkRelativeLock checks that spent, confirmed at its Height and Time, is
+// old enough in the block at for an input locked by lock
+func checkRelativeLock(lock uint32, spent UnspentTxOut, at chainContext) error {
+	if lock == 0 {
+		return nil
+	}
+
+	count := int64(lock & relativeLockMask)
+	if lock&relativeLockTypeFlag != 0 {
+		seconds := count << relativeLockGranularity
+		if age := at.Time - spent.Time; age < seconds {
+			return fmt.Errorf("output is %d seconds old, needs %d", age, seconds)
+		}
+		return nil
+	}
+
+	if age := int64(at.Height - spent.Height); age < count {
+		return fmt.Errorf("output is %d blocks old, needs %d", age, count)
+	}
+	return nil
+}
+
+// checkRelativeLockCovers checks that the relative lock of an input is at
+// least required and counts in the same unit
+func checkRelativeLockCovers(lock uint32, required uint32) error {
+	if lock&relativeLockTypeFlag != required&relativeLockTypeFlag {
+		return fmt.Errorf("relative lock %d counts blocks and seconds unlike %d", lock, required)
+	}
+	if lock&relativeLockMask < required&relativeLockMask {
+		return fmt.Errorf("relative lock %d is shorter than %d", lock, required)
+	}
+	return nil
+}
@@ -1,7 +1,37 @@
 package main
 
 import (
-	"net/http"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+)
+
+var (
+	dataDir       = flag.String("datadir", "./node/data", "directory the blockchain is stored in")
+	mine          = flag.Bool("mine", false, "mine blocks in the background")
+	minerWorkers  = flag.Int("minerworkers", runtime.NumCPU(), "number of goroutines searching nonces")
+	network       = flag.String("network", mainNetParams.Name, "network to run on: main, test or regtest")
+	maxMempool    = flag.Int("maxmempool", defaultMaxMempool/1000000, "megabytes of transactions the pool holds")
+	mempoolExpiry = flag.Duration("mempoolexpiry", defaultMempoolExpiry, "how long a transaction stays in the pool")
+	utxoCache     = flag.Int("utxocache", defaultUtxoCache, "unspent outputs kept in memory before they are written to disk")
+	addrIndexOn   = flag.Bool("addrindex", false, "index the transactions and unspent outputs of every address")
+	poolAddress   = flag.String("pool", "", "address to run a mining pool for Stratum workers on, like :3333")
+	poolShares    = flag.Int64("poolsharefactor", 1000, "how many times easier than a block a pool share is")
+	poolPayout    = flag.String("poolpayout", payoutPPLNS, "how the pool splits block rewards: pplns or proportional")
+	pplnsWindow   = flag.Int("pplnswindow", 2000, "how many of the last pool shares pplns pays")
+
+	loadSnapshotFile = flag.String("loadsnapshot", "", "start a new node from this snapshot of the unspent set")
+	dumpSnapshotFile = flag.String("dumpsnapshot", "", "write a snapshot of the unspent set to this file and exit")
+	snapshotHeight   = flag.Int("snapshotheight", -1, "block -dumpsnapshot writes the unspent set at, the tip if negative")
+	genRegtest       = flag.Int("genregtest", 0, "extend the regtest chain to this height with the blocks of the pinned snapshot")
+
+	simDifficulty = flag.Bool("simdifficulty", false, "simulate the difficulty algorithms against hashrate swings and exit")
+	simInterval   = flag.Int64("siminterval", blockGenerationInterval, "target block time in seconds for -simdifficulty")
+	simBlocks     = flag.Int("simblocks", 500, "blocks mined in each hashrate phase of -simdifficulty")
 )
 
 // var clients = make(map[*websocket.Conn]bool)
@@ -13,9 +43,104 @@ import (
 // }
 
 func main() {
+	flag.Parse()
+
+	if *simDifficulty {
+		runDifficultySimulation(os.Stdout, *simInterval, *simBlocks)
+		return
+	}
+
+	if err := selectNetwork(*network); err != nil {
+		log.Fatal(err)
+	}
+
+	mempool = newMempool(*maxMempool*1000000, *mempoolExpiry)
+
+	if err := loadBlockchain(*dataDir, *utxoCache); err != nil {
+		log.Fatal(err)
+	}
+
+	if *genRegtest > 0 {
+		if err := genRegtestChain(*genRegtest); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *dumpSnapshotFile != "" {
+		height := *snapshotHeight
+		if height < 0 {
+			height = GetLatestBlock().Index
+		}
+		info, err := dumpSnapshot(*dumpSnapshotFile, height)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("wrote the unspent set at block %d %s to %s: %d outputs, hash %s\n", info.Height, info.BlockHash, *dumpSnapshotFile, info.Outputs, info.Hash)
+		utxoDB.Close()
+		blockStore.Close()
+		return
+	}
+	if *loadSnapshotFile != "" {
+		if err := loadSnapshot(*loadSnapshotFile, *utxoCache); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *addrIndexOn {
+		index, err := buildAddressIndex(blockchain, utxoDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		addrIndex = index
+	}
+	if validator != nil {
+		go validator.run()
+	}
+
+	if !fileExists(privateKeyLocation) {
+		if err := initWallet(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	miner = newMiner(*minerWorkers)
+	if *mine {
+		miner.Start()
+	}
+
+	if *poolAddress != "" {
+		pool, err := newMiningPool(*poolShares, *poolPayout, *pplnsWindow)
+		if err != nil {
+			log.Fatal(err)
+		}
+		miningPool = pool
+		go func() {
+			log.Fatal(miningPool.listen(*poolAddress))
+		}()
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		miner.Shutdown()
+		if validator != nil {
+			if err := validator.close(); err != nil {
+				fmt.Println("cannot write the validation set:", err)
+			}
+		}
+		chainMutex.Lock()
+		if err := utxoDB.Close(); err != nil {
+			fmt.Println("cannot write the unspent set:", err)
+		}
+		blockStore.Close()
+		os.Exit(0)
+	}()
+
 	hub := newHub()
+	go hub.run()
+	go syncer.run()
 
-	createRoutes()
+	createRoutes(hub)
 	// http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 	// 	http.ServeFile(w, r, "blockchain.html")
 	// })
@@ -32,14 +157,6 @@ func main() {
 	// 	}
 	// 	json.NewEncoder(w).Encode(response)
 	// })
-
-	go hub.run()
-
-	http.HandleFunc("/addPeer", blocksHandler)
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, w, r)
-	})
-
 }
 
 // func blocksHandler(w http.ResponseWriter, r *http.Request) {
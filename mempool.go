@@ -0,0 +1,499 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// The mempool holds the transactions waiting for a block, indexed by ID and
+// by the outputs they spend. A transaction may spend outputs of others in
+// the pool, its ancestors, which makes it their descendant; chains are
+// limited in length and size. The pool takes at most maxBytes of
+// serialized transactions: past that the ones paying the lowest fee rate
+// together with their descendants are evicted, and the rate of the
+// cheapest left becomes the least a newcomer must pay. Transactions older
+// than expiry are dropped. Each transaction keeps the fee and size of its
+// package, itself with its descendants, up to date in a heap ordered by
+// package fee rate, so finding the cheapest does not walk the pool, and
+// the fee and size of itself with its ancestors, which blocks select by.
+// A transaction checked valid in a block stays valid in later ones, as
+// locks and coinbase maturity only get easier to meet, so it is only
+// checked again when the chain tip moves back in time or is reorganized.
+
+const (
+	ruleAlreadyInPool = "txn-already-in-mempool"
+	ruleMempoolMinFee = "mempool-min-fee-not-met"
+	ruleMempoolFull   = "mempool-full"
+	ruleTooLongChain  = "too-long-mempool-chain"
+)
+
+// limits on a transaction with its ancestors, and on one with its
+// descendants, counting the transaction itself
+const (
+	maxAncestorCount   = 25
+	maxAncestorSize    = 101000
+	maxDescendantCount = 25
+	maxDescendantSize  = 101000
+)
+
+// outPoint names an output by the ID of its transaction and its index
+type outPoint struct {
+	TxOutID    string
+	TxOutIndex int
+}
+
+// mempoolEntry is a pool transaction with what the pool knows about it
+type mempoolEntry struct {
+	tx    Transaction
+	fee   int
+	size  int
+	added time.Time
+	// order the transaction entered the pool in
+	seq uint64
+	// fee and size of the transaction together with its descendants
+	packageFee  int
+	packageSize int
+	// fee, size and count of the transaction together with its ancestors
+	ancestorFee   int
+	ancestorSize  int
+	ancestorCount int
+	// position in the fee rate heap
+	heapIndex int
+	// the block the transaction was last checked to be valid in
+	validAt chainContext
+}
+
+// uncheckedContext is later than any block, so no pool transaction checked
+// valid in it is known to be valid in the next block
+var uncheckedContext = chainContext{Height: math.MaxInt32, Time: math.MaxInt64}
+
+// validIn reports whether the entry is known to be valid in the block at
+func (entry *mempoolEntry) validIn(at chainContext) bool {
+	return at.Height >= entry.validAt.Height && at.Time >= entry.validAt.Time
+}
+
+// feeRateHeap orders pool entries by the fee rate of their packages, lowest
+// first, and the newest first among those paying the same
+type feeRateHeap []*mempoolEntry
+
+func (h feeRateHeap) Len() int { return len(h) }
+
+func (h feeRateHeap) Less(i, j int) bool {
+	// compare fee/size without rounding
+	a, b := h[i].packageFee*h[j].packageSize, h[j].packageFee*h[i].packageSize
+	return a < b || a == b && h[i].seq > h[j].seq
+}
+
+func (h feeRateHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *feeRateHeap) Push(x interface{}) {
+	entry := x.(*mempoolEntry)
+	entry.heapIndex = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *feeRateHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// Mempool is a bounded set of unconfirmed transactions
+type Mempool struct {
+	txs    map[string]*mempoolEntry
+	spends map[outPoint]string
+	// entries by package fee rate
+	byFeeRate feeRateHeap
+	bytes     int
+	maxBytes  int
+	expiry    time.Duration
+	nextSeq   uint64
+}
+
+const (
+	defaultMaxMempool    = 300000000
+	defaultMempoolExpiry = 14 * 24 * time.Hour
+)
+
+var mempool = newMempool(defaultMaxMempool, defaultMempoolExpiry)
+
+func newMempool(maxBytes int, expiry time.Duration) *Mempool {
+	return &Mempool{
+		txs:      map[string]*mempoolEntry{},
+		spends:   map[outPoint]string{},
+		maxBytes: maxBytes,
+		expiry:   expiry,
+	}
+}
+
+// get returns the pool transaction id, or nil
+func (m *Mempool) get(id string) *Transaction {
+	entry, ok := m.txs[id]
+	if !ok {
+		return nil
+	}
+	return &entry.tx
+}
+
+// transactions returns the pool transactions in the order they entered it
+func (m *Mempool) transactions() []Transaction {
+	entries := make([]*mempoolEntry, 0, len(m.txs))
+	for _, entry := range m.txs {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+
+	result := make([]Transaction, len(entries))
+	for i, entry := range entries {
+		result[i] = entry.tx
+	}
+	return result
+}
+
+// add puts transaction, which pays fee, into the pool. The caller checked
+// that it is valid in the block at and conflicts with nothing in the pool.
+func (m *Mempool) add(transaction Transaction, fee int, at chainContext, now time.Time) {
+	entry := &mempoolEntry{
+		tx:      transaction,
+		fee:     fee,
+		size:    getTransactionSize(transaction),
+		added:   now,
+		seq:     m.nextSeq,
+		validAt: at,
+	}
+	m.nextSeq++
+
+	m.txs[transaction.ID] = entry
+	for _, txIn := range transaction.TxIns {
+		m.spends[outPoint{txIn.TxOutID, txIn.TxOutIndex}] = transaction.ID
+	}
+	m.bytes += entry.size
+
+	heap.Push(&m.byFeeRate, entry)
+	// it may already have descendants when a block that held it is
+	// disconnected
+	m.updatePackages(append(m.ancestors(transaction), transaction.ID))
+	m.updateAncestors(m.descendants([]string{transaction.ID}))
+}
+
+// remove takes the transaction id out of the pool
+func (m *Mempool) remove(id string) {
+	entry, ok := m.txs[id]
+	if !ok {
+		return
+	}
+	ancestors := m.ancestors(entry.tx)
+	descendants := m.descendants([]string{id})
+	for _, txIn := range entry.tx.TxIns {
+		delete(m.spends, outPoint{txIn.TxOutID, txIn.TxOutIndex})
+	}
+	delete(m.txs, id)
+	m.bytes -= entry.size
+
+	heap.Remove(&m.byFeeRate, entry.heapIndex)
+	m.updatePackages(ancestors)
+	m.updateAncestors(descendants)
+}
+
+// updatePackages recomputes the packages of the pool transactions ids and
+// their places in the fee rate heap
+func (m *Mempool) updatePackages(ids []string) {
+	for _, id := range ids {
+		entry, ok := m.txs[id]
+		if !ok {
+			continue
+		}
+		entry.packageFee, entry.packageSize = m.totals(m.descendants([]string{id}))
+		heap.Fix(&m.byFeeRate, entry.heapIndex)
+	}
+}
+
+// updateAncestors recomputes the fee, size and count of the pool
+// transactions ids together with their ancestors
+func (m *Mempool) updateAncestors(ids []string) {
+	for _, id := range ids {
+		entry, ok := m.txs[id]
+		if !ok {
+			continue
+		}
+		ancestors := m.ancestors(entry.tx)
+		fee, size := m.totals(ancestors)
+		entry.ancestorFee = entry.fee + fee
+		entry.ancestorSize = entry.size + size
+		entry.ancestorCount = len(ancestors) + 1
+	}
+}
+
+// uncheckAll has every pool transaction checked again before it goes into
+// a block, as after a reorganization
+func (m *Mempool) uncheckAll() {
+	for _, entry := range m.txs {
+		entry.validAt = uncheckedContext
+	}
+}
+
+// recheck checks again the pool transactions not known to be valid in the
+// block at and returns the IDs of those that cannot go into it, along with
+// their descendants
+func (m *Mempool) recheck(base UtxoView, at chainContext) map[string]bool {
+	view := m.view(base, at)
+	invalid := []string{}
+	for id, entry := range m.txs {
+		if entry.validIn(at) {
+			continue
+		}
+		if validateTransaction(entry.tx, view, at) != nil {
+			invalid = append(invalid, id)
+			continue
+		}
+		entry.validAt = at
+	}
+
+	result := map[string]bool{}
+	for _, id := range m.descendants(invalid) {
+		result[id] = true
+	}
+	return result
+}
+
+// removeWithDescendants takes ids and the transactions spending their
+// outputs out of the pool and returns how many it removed
+func (m *Mempool) removeWithDescendants(ids []string) int {
+	descendants := m.descendants(ids)
+	for _, id := range descendants {
+		m.remove(id)
+	}
+	return len(descendants)
+}
+
+// conflicts returns the IDs of the pool transactions spending an output
+// transaction spends
+func (m *Mempool) conflicts(transaction Transaction) []string {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, txIn := range transaction.TxIns {
+		id, ok := m.spends[outPoint{txIn.TxOutID, txIn.TxOutIndex}]
+		if ok && !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// descendants returns ids and the IDs of every pool transaction spending,
+// directly or through others, an output of one of them
+func (m *Mempool) descendants(ids []string) []string {
+	result := []string{}
+	seen := map[string]bool{}
+	queue := append([]string{}, ids...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		entry, ok := m.txs[id]
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		result = append(result, id)
+
+		for index := range entry.tx.TxOuts {
+			if spender, ok := m.spends[outPoint{id, index}]; ok {
+				queue = append(queue, spender)
+			}
+		}
+	}
+	return result
+}
+
+// ancestors returns the IDs of the pool transactions transaction spends
+// outputs of, directly or through others
+func (m *Mempool) ancestors(transaction Transaction) []string {
+	result := []string{}
+	seen := map[string]bool{}
+	queue := []TxIn{}
+	queue = append(queue, transaction.TxIns...)
+	for len(queue) > 0 {
+		id := queue[0].TxOutID
+		queue = queue[1:]
+		entry, ok := m.txs[id]
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		result = append(result, id)
+		queue = append(queue, entry.tx.TxIns...)
+	}
+	return result
+}
+
+// totals returns the fees and sizes of the pool transactions ids
+func (m *Mempool) totals(ids []string) (int, int) {
+	fee, size := 0, 0
+	for _, id := range ids {
+		if entry, ok := m.txs[id]; ok {
+			fee += entry.fee
+			size += entry.size
+		}
+	}
+	return fee, size
+}
+
+// checkChainLimits checks that transaction, of size bytes, would not make
+// a chain of pool transactions too long or too big
+func (m *Mempool) checkChainLimits(transaction Transaction, size int) error {
+	ancestors := m.ancestors(transaction)
+	if _, ancestorSize := m.totals(ancestors); len(ancestors)+1 > maxAncestorCount || ancestorSize+size > maxAncestorSize {
+		return ruleError(ruleTooLongChain, "transaction %s would make a chain of %d transactions and %d bytes with its ancestors, at most %d and %d bytes are allowed", transaction.ID, len(ancestors)+1, ancestorSize+size, maxAncestorCount, maxAncestorSize)
+	}
+
+	for _, id := range ancestors {
+		descendants := m.descendants([]string{id})
+		if _, descendantSize := m.totals(descendants); len(descendants)+1 > maxDescendantCount || descendantSize+size > maxDescendantSize {
+			return ruleError(ruleTooLongChain, "transaction %s would make a chain of %d transactions and %d bytes with the descendants of %s, at most %d and %d bytes are allowed", transaction.ID, len(descendants)+1, descendantSize+size, id, maxDescendantCount, maxDescendantSize)
+		}
+	}
+	return nil
+}
+
+// expire drops the transactions that entered the pool expiry before now
+// and returns how many it dropped
+func (m *Mempool) expire(now time.Time) int {
+	expired := []string{}
+	for id, entry := range m.txs {
+		if now.Sub(entry.added) > m.expiry {
+			expired = append(expired, id)
+		}
+	}
+	return m.removeWithDescendants(expired)
+}
+
+// trim evicts the transactions paying the lowest fee rate together with
+// their descendants until the pool fits in maxBytes and returns the IDs it
+// evicted
+func (m *Mempool) trim() []string {
+	evicted := []string{}
+	for m.bytes > m.maxBytes {
+		lowest := m.lowestFeeRate()
+		if lowest == nil {
+			break
+		}
+		for _, id := range m.descendants([]string{lowest.tx.ID}) {
+			m.remove(id)
+			evicted = append(evicted, id)
+		}
+	}
+	return evicted
+}
+
+// lowestFeeRate returns the entry paying the lowest fee rate together with
+// its descendants, the newest of those paying the same, or nil for an empty
+// pool. A parent a child pays for is not cheap to keep.
+func (m *Mempool) lowestFeeRate() *mempoolEntry {
+	if len(m.byFeeRate) == 0 {
+		return nil
+	}
+	return m.byFeeRate[0]
+}
+
+// minFeeRate is the fee rate a transaction must beat to enter the pool:
+// that of the cheapest pool transaction with its descendants once there is
+// no room for a standard transaction of any size, 0 before
+func (m *Mempool) minFeeRate() int {
+	if m.bytes+maxStandardTxSize <= m.maxBytes {
+		return 0
+	}
+	lowest := m.lowestFeeRate()
+	if lowest == nil {
+		return 0
+	}
+	return feeRate(lowest.packageFee, lowest.packageSize)
+}
+
+// removeForBlock takes the transactions block confirms out of the pool,
+// along with those spending an output block spends, and what spends theirs
+func (m *Mempool) removeForBlock(block Block) {
+	confirmed := 0
+	conflicted := []string{}
+	for _, tx := range block.Data {
+		if m.get(tx.ID) != nil {
+			m.remove(tx.ID)
+			confirmed++
+		}
+		conflicted = append(conflicted, m.conflicts(tx)...)
+	}
+	removed := m.removeWithDescendants(conflicted)
+
+	if confirmed > 0 || removed > 0 {
+		fmt.Printf("block %s confirmed %d pool transactions and conflicted %d\n", block.Hash, confirmed, removed)
+	}
+}
+
+// mempoolView is base along with the outputs of the pool transactions,
+// which transactions going into the block at may spend. They are looked up
+// in the pool by transaction ID rather than copied into an overlay. Pool
+// outputs already spent in the pool are left in, so conflicts reach the
+// replace-by-fee rules.
+type mempoolView struct {
+	base UtxoView
+	pool *Mempool
+	at   chainContext
+}
+
+// view returns base along with the outputs of the pool transactions
+func (m *Mempool) view(base UtxoView, at chainContext) UtxoView {
+	return &mempoolView{base: base, pool: m, at: at}
+}
+
+func (v *mempoolView) lookup(point outPoint) (UnspentTxOut, bool) {
+	if entry, ok := v.pool.txs[point.TxOutID]; ok && point.TxOutIndex >= 0 && point.TxOutIndex < len(entry.tx.TxOuts) {
+		return poolUnspentTxOut(entry.tx, point.TxOutIndex, v.at), true
+	}
+	return v.base.lookup(point)
+}
+
+func (v *mempoolView) forEach(fn func(UnspentTxOut) bool) {
+	stopped := false
+	v.base.forEach(func(uTxO UnspentTxOut) bool {
+		stopped = !fn(uTxO)
+		return !stopped
+	})
+	if stopped {
+		return
+	}
+	for _, entry := range v.pool.txs {
+		for index := range entry.tx.TxOuts {
+			if !fn(poolUnspentTxOut(entry.tx, index, v.at)) {
+				return
+			}
+		}
+	}
+}
+
+// MempoolStats are the size of the pool and the fee rate it takes
+type MempoolStats struct {
+	Count      int `json:"count"`
+	Bytes      int `json:"bytes"`
+	MaxBytes   int `json:"maxBytes"`
+	MinFeeRate int `json:"minFeeRate"`
+}
+
+func (m *Mempool) stats() MempoolStats {
+	return MempoolStats{
+		Count:      len(m.txs),
+		Bytes:      m.bytes,
+		MaxBytes:   m.maxBytes,
+		MinFeeRate: m.minFeeRate(),
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// checkPackages fails unless every pool entry caches the fee and size of
+// its package and with its ancestors, and the heap has the cheapest package on top
+func checkPackages(t *testing.T, m *Mempool) {
+	t.Helper()
+	if len(m.byFeeRate) != len(m.txs) {
+		t.Fatalf("heap holds %d entries, the pool %d", len(m.byFeeRate), len(m.txs))
+	}
+	for i, entry := range m.byFeeRate {
+		if entry.heapIndex != i || m.txs[entry.tx.ID] != entry {
+			t.Fatalf("heap entry %d is misplaced", i)
+		}
+		fee, size := m.totals(m.descendants([]string{entry.tx.ID}))
+		if entry.packageFee != fee || entry.packageSize != size {
+			t.Fatalf("package of %s is %d, %d bytes, want %d, %d bytes", entry.tx.ID, entry.packageFee, entry.packageSize, fee, size)
+		}
+		ancestors := m.ancestors(entry.tx)
+		fee, size = m.totals(ancestors)
+		if entry.ancestorFee != entry.fee+fee || entry.ancestorSize != entry.size+size || entry.ancestorCount != len(ancestors)+1 {
+			t.Fatalf("ancestors of %s are wrongly cached", entry.tx.ID)
+		}
+		if m.byFeeRate.Less(i, 0) {
+			t.Fatalf("package of %s is cheaper than the top of the heap", entry.tx.ID)
+		}
+	}
+}
+
+func TestMempoolPackages(t *testing.T) {
+	m := newMempool(defaultMaxMempool, time.Hour)
+	now := time.Now()
+	parent := testTransaction(
+		[]TxIn{{TxOutID: "aa", TxOutIndex: 0}},
+		[]TxOut{{Address: "04aa", Amount: 10}, {Address: "04bb", Amount: 10}},
+	)
+	left := testTransaction([]TxIn{{TxOutID: parent.ID, TxOutIndex: 0}}, []TxOut{{Address: "04cc", Amount: 9}})
+	right := testTransaction([]TxIn{{TxOutID: parent.ID, TxOutIndex: 1}}, []TxOut{{Address: "04cc", Amount: 9}})
+	both := testTransaction(
+		[]TxIn{{TxOutID: left.ID, TxOutIndex: 0}, {TxOutID: right.ID, TxOutIndex: 0}},
+		[]TxOut{{Address: "04dd", Amount: 10}},
+	)
+	other := testTransaction([]TxIn{{TxOutID: "bb", TxOutIndex: 0}}, []TxOut{{Address: "04ee", Amount: 1}})
+
+	// the parent comes back after its children, as when the block that
+	// held it is disconnected
+	m.add(left, 1, chainContext{}, now)
+	m.add(right, 1, chainContext{}, now)
+	m.add(both, 8, chainContext{}, now)
+	checkPackages(t, m)
+	m.add(parent, 1, chainContext{}, now)
+	checkPackages(t, m)
+	m.add(other, 2, chainContext{}, now)
+	checkPackages(t, m)
+	if fee := m.txs[parent.ID].packageFee; fee != 11 {
+		t.Fatalf("the package of the parent pays %d, want 11", fee)
+	}
+
+	m.remove(parent.ID)
+	checkPackages(t, m)
+	m.removeWithDescendants([]string{right.ID})
+	checkPackages(t, m)
+	if m.get(both.ID) != nil || m.get(left.ID) == nil {
+		t.Fatal("removed the wrong descendants")
+	}
+
+	// the cheapest package goes first
+	m.maxBytes = m.bytes - 1
+	evicted := m.trim()
+	if len(evicted) != 1 || evicted[0] != left.ID {
+		t.Fatalf("evicted %v, want %s", evicted, left.ID)
+	}
+	checkPackages(t, m)
+}
+
+func TestMempoolSelectPackages(t *testing.T) {
+	m := newMempool(defaultMaxMempool, time.Hour)
+	now := time.Now()
+	parent := testTransaction([]TxIn{{TxOutID: "aa", TxOutIndex: 0}}, []TxOut{{Address: "04aa", Amount: 10}})
+	child := testTransaction([]TxIn{{TxOutID: parent.ID, TxOutIndex: 0}}, []TxOut{{Address: "04bb", Amount: 9}})
+	other := testTransaction([]TxIn{{TxOutID: "bb", TxOutIndex: 0}}, []TxOut{{Address: "04cc", Amount: 1}})
+	m.add(parent, 0, chainContext{}, now)
+	m.add(other, 5, chainContext{}, now)
+	m.add(child, 30, chainContext{}, now)
+	checkPackages(t, m)
+
+	// the child pays for its parent, which goes in first
+	entries := m.selectPackages(utxoViewOf(nil), maxBlockSize, maxBlockTransactions)
+	if len(entries) != 3 || entries[0].Transaction.ID != parent.ID || entries[1].Transaction.ID != child.ID || entries[2].Transaction.ID != other.ID {
+		t.Fatalf("selected %v", entries)
+	}
+	if entries[1].AncestorFee != 30 || entries[1].AncestorSize != entries[0].Size+entries[1].Size {
+		t.Fatalf("the child pays %d for %d bytes with its parent", entries[1].AncestorFee, entries[1].AncestorSize)
+	}
+
+	// a package that does not fit is passed over
+	entries = m.selectPackages(utxoViewOf(nil), maxBlockSize, 1)
+	if len(entries) != 1 || entries[0].Transaction.ID != other.ID {
+		t.Fatalf("selected %v with room for one transaction", entries)
+	}
+
+	// once unchecked, they are checked again and none of them spends a
+	// real output
+	m.uncheckAll()
+	if entries = m.selectPackages(utxoViewOf(nil), maxBlockSize, maxBlockTransactions); len(entries) != 0 {
+		t.Fatalf("selected %d invalid transactions", len(entries))
+	}
+}
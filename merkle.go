@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Merkle tree over the transactions of a block. Leaves are the transaction
+// hashes in block order: sha256(0x00 || the transaction encoded with its
+// signatures), so the root commits to the signatures the IDs leave out.
+// Each level hashes pairs as sha256(0x01 || left || right); the prefixes
+// keep a leaf from passing for a node, since a transaction encoding starts
+// with a 0x01 version byte itself. A node left without a pair moves up a
+// level unchanged, so no two different transaction lists share a root.
+
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+func merkleParent(left, right []byte) []byte {
+	buf := make([]byte, 0, 1+len(left)+len(right))
+	buf = append(buf, merkleNodePrefix)
+	buf = append(buf, left...)
+	buf = append(buf, right...)
+	h := sha256.Sum256(buf)
+	return h[:]
+}
+
+func merkleNextLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 < len(level) {
+			next = append(next, merkleParent(level[i], level[i+1]))
+		} else {
+			next = append(next, level[i])
+		}
+	}
+	return next
+}
+
+// getTransactionHash returns the hex Merkle leaf of transaction, the
+// SHA-256 of the leaf prefix and transaction encoded with its signatures.
+// Unlike the ID it changes when a signature does.
+func getTransactionHash(transaction Transaction) string {
+	b, _ := transaction.MarshalBinary()
+	h := sha256.Sum256(append([]byte{merkleLeafPrefix}, b...))
+	return hex.EncodeToString(h[:])
+}
+
+func merkleLeaves(transactions []Transaction) [][]byte {
+	leaves := make([][]byte, len(transactions))
+	for i, tx := range transactions {
+		leaves[i], _ = hex.DecodeString(getTransactionHash(tx))
+	}
+	return leaves
+}
+
+// calculateMerkleRoot returns the hex Merkle root of the hashes of
+// transactions
+func calculateMerkleRoot(transactions []Transaction) string {
+	level := merkleLeaves(transactions)
+	if len(level) == 0 {
+		return ""
+	}
+
+	for len(level) > 1 {
+		level = merkleNextLevel(level)
+	}
+
+	return hex.EncodeToString(level[0])
+}
+
+// MerkleProof shows that a transaction is a leaf of a Merkle root. TxHash
+// is the leaf; a client holding the transaction checks it hashes to it.
+type MerkleProof struct {
+	TxID      string   `json:"txId"`
+	TxHash    string   `json:"txHash"`
+	Index     int      `json:"index"`
+	LeafCount int      `json:"leafCount"`
+	Hashes    []string `json:"hashes"`
+}
+
+// getMerkleProof builds the proof for the transaction at index
+func getMerkleProof(transactions []Transaction, index int) *MerkleProof {
+	if index < 0 || index >= len(transactions) {
+		return nil
+	}
+
+	proof := &MerkleProof{
+		TxID:      transactions[index].ID,
+		TxHash:    getTransactionHash(transactions[index]),
+		Index:     index,
+		LeafCount: len(transactions),
+		Hashes:    []string{},
+	}
+
+	level := merkleLeaves(transactions)
+	for position := index; len(level) > 1; position /= 2 {
+		sibling := position ^ 1
+		if sibling < len(level) {
+			proof.Hashes = append(proof.Hashes, hex.EncodeToString(level[sibling]))
+		}
+
+		level = merkleNextLevel(level)
+	}
+
+	return proof
+}
+
+// VerifyMerkleProof reports whether proof shows that the transaction hashing
+// to proof.TxHash is included under merkleRoot
+func VerifyMerkleProof(proof MerkleProof, merkleRoot string) bool {
+	if proof.LeafCount <= 0 || proof.Index < 0 || proof.Index >= proof.LeafCount {
+		return false
+	}
+
+	hash, err := hex.DecodeString(proof.TxHash)
+	if err != nil {
+		return false
+	}
+
+	used := 0
+	position := proof.Index
+	for count := proof.LeafCount; count > 1; count = (count + 1) / 2 {
+		if position%2 == 1 || position+1 < count {
+			if used >= len(proof.Hashes) {
+				return false
+			}
+			sibling, err := hex.DecodeString(proof.Hashes[used])
+			if err != nil {
+				return false
+			}
+			used++
+
+			if position%2 == 1 {
+				hash = merkleParent(sibling, hash)
+			} else {
+				hash = merkleParent(hash, sibling)
+			}
+		}
+		position /= 2
+	}
+
+	return used == len(proof.Hashes) && hex.EncodeToString(hash) == merkleRoot
+}
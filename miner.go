@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how many nonces a worker tries between checks for cancellation
+const minerCheckInterval = 1024
+
+// errMiningCancelled is returned when a search ends before a block is found
+var errMiningCancelled = errors.New("block search cancelled")
+
+// Miner searches the nonce space of block templates with several worker
+// goroutines. A search stops as soon as the chain tip moves, the miner is
+// stopped or the node shuts down.
+type Miner struct {
+	workers int
+
+	mutex   sync.Mutex
+	running bool
+	stop    chan struct{}
+	quit    chan struct{}
+
+	// hashes tried in the current search and when it started
+	roundHashes uint64
+	roundStart  atomic.Value
+	searching   int32
+	lastRate    atomic.Value
+}
+
+func newMiner(workers int) *Miner {
+	if workers < 1 {
+		workers = 1
+	}
+
+	m := &Miner{
+		workers: workers,
+		quit:    make(chan struct{}),
+	}
+	m.lastRate.Store(float64(0))
+
+	return m
+}
+
+// miner is the miner of this node
+var miner = newMiner(1)
+
+// Start keeps mining blocks for our wallet in the background until Stop
+func (m *Miner) Start() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.running {
+		return
+	}
+	m.running = true
+	m.stop = make(chan struct{})
+
+	go m.loop(m.stop)
+}
+
+// Stop ends background mining, abandoning the block being searched
+func (m *Miner) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.running {
+		return
+	}
+	m.running = false
+	close(m.stop)
+}
+
+// Shutdown stops every search for good
+func (m *Miner) Shutdown() {
+	m.Stop()
+	close(m.quit)
+}
+
+// Running reports whether the miner mines in the background
+func (m *Miner) Running() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.running
+}
+
+// Hashrate returns the hashes per second of the current search, or of the
+// last one when the miner is idle
+func (m *Miner) Hashrate() float64 {
+	if atomic.LoadInt32(&m.searching) == 0 {
+		return m.lastRate.Load().(float64)
+	}
+
+	elapsed := time.Since(m.roundStart.Load().(time.Time)).Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&m.roundHashes)) / elapsed
+}
+
+func (m *Miner) loop(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-m.quit:
+			return
+		default:
+		}
+
+		chainMutex.Lock()
+		template, err := getBlockTemplate()
+		chainMutex.Unlock()
+
+		if err != nil {
+			fmt.Println("miner stopped, cannot build a block:", err)
+			m.Stop()
+			return
+		}
+
+		if block, err := m.mine(template, stop); err == nil {
+			fmt.Printf("mined block %d %s\n", block.Index, block.Hash)
+		}
+	}
+}
+
+// mineTemplate searches a nonce for template and adds the solved block to
+// the chain. It returns errMiningCancelled if the chain tip moved first, or
+// why the block was rejected.
+func (m *Miner) mineTemplate(template Block) (*Block, error) {
+	return m.mine(template, nil)
+}
+
+func (m *Miner) mine(template Block, stop chan struct{}) (*Block, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tip := subscribeTip()
+	defer unsubscribeTip(tip)
+
+	go func() {
+		for {
+			select {
+			case hash := <-tip:
+				if hash != template.PreviousHash {
+					cancel()
+					return
+				}
+			case <-stop:
+				cancel()
+				return
+			case <-m.quit:
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	block := m.solve(ctx, template)
+	if block == nil {
+		return nil, errMiningCancelled
+	}
+
+	chainMutex.Lock()
+	err := addBlockToChain(*block)
+	chainMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	syncer.announce(*block)
+	return block, nil
+}
+
+// solve splits the nonce space of template between the workers, worker i
+// trying nonces i, i+workers, i+2*workers and so on
+func (m *Miner) solve(ctx context.Context, template Block) *Block {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	atomic.StoreUint64(&m.roundHashes, 0)
+	m.roundStart.Store(time.Now())
+	atomic.StoreInt32(&m.searching, 1)
+	defer func() {
+		m.lastRate.Store(m.Hashrate())
+		atomic.StoreInt32(&m.searching, 0)
+	}()
+
+	found := make(chan *Block, m.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			if block := m.searchNonces(ctx, template, start, m.workers); block != nil {
+				found <- block
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case block := <-found:
+		return block
+	default:
+		return nil
+	}
+}
+
+func (m *Miner) searchNonces(ctx context.Context, template Block, nonce int, step int) *Block {
+	for {
+		for i := 0; i < minerCheckInterval; i++ {
+			hash := calculateHash(template.Index, template.PreviousHash, template.Timestamp, template.MerkleRoot, template.Bits, nonce)
+			if hashMatchesDifficulty(hash, template.Bits) {
+				atomic.AddUint64(&m.roundHashes, uint64(i+1))
+				return GenerageBlock(template.Index, template.PreviousHash, template.Timestamp, template.Data, hash, template.Bits, nonce)
+			}
+			nonce += step
+		}
+		atomic.AddUint64(&m.roundHashes, minerCheckInterval)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Multisig wallets. Funds paid to a multisig address are locked by an m-of-n
+// multisig script. Spending them takes several steps: one co-signer builds
+// the unsigned spend, every co-signer adds their signatures, and once enough
+// of them have signed each input the spend is broadcast.
+
+// MultisigAddress is an m-of-n multisig output: Threshold signatures of
+// PubKeys, in hex, spend it. Script is what outputs paying it are locked by.
+type MultisigAddress struct {
+	Threshold int      `json:"threshold"`
+	PubKeys   []string `json:"pubKeys"`
+	Script    Script   `json:"script"`
+}
+
+// createMultisigAddress returns the address threshold signatures of pubKeys
+// spend. Keys are kept in the order given, signatures must follow it.
+func createMultisigAddress(threshold int, pubKeys []string) (*MultisigAddress, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > maxStandardMultisigKeys {
+		return nil, fmt.Errorf("multisig needs 1 to %d keys, got %d", maxStandardMultisigKeys, len(pubKeys))
+	}
+	if threshold < 1 || threshold > len(pubKeys) {
+		return nil, fmt.Errorf("threshold must be between 1 and %d, got %d", len(pubKeys), threshold)
+	}
+
+	keys := [][]byte{}
+	seen := map[string]bool{}
+	for _, pubKey := range pubKeys {
+		b, err := hex.DecodeString(pubKey)
+		if err != nil {
+			return nil, fmt.Errorf("public key %s is not hex", pubKey)
+		}
+		if _, err := ParsePubKey(b); err != nil {
+			return nil, fmt.Errorf("public key %s: %v", pubKey, err)
+		}
+		if seen[pubKey] {
+			return nil, fmt.Errorf("public key %s is listed twice", pubKey)
+		}
+		seen[pubKey] = true
+		keys = append(keys, b)
+	}
+
+	return &MultisigAddress{
+		Threshold: threshold,
+		PubKeys:   append([]string{}, pubKeys...),
+		Script:    multisigLockingScript(threshold, keys),
+	}, nil
+}
+
+// parseMultisigAddress returns the address locked by script
+func parseMultisigAddress(script Script) (*MultisigAddress, error) {
+	ops, err := parseScript(script)
+	if err != nil || !isMultisig(ops) {
+		return nil, errors.New("not a multisig script")
+	}
+
+	pubKeys := []string{}
+	for _, op := range ops[1 : len(ops)-2] {
+		pubKeys = append(pubKeys, hex.EncodeToString(op.data))
+	}
+	return createMultisigAddress(smallInt(ops[0]), pubKeys)
+}
+
+// MultisigSpend is a transaction spending the outputs of a multisig address
+// while its co-signers sign it. Spent[i] is the output input i spends,
+// which signatures commit to. Signatures[i] maps the public keys that
+// signed input i to their signature, in hex.
+type MultisigSpend struct {
+	Transaction Transaction         `json:"transaction"`
+	Address     MultisigAddress     `json:"address"`
+	Spent       []UnspentTxOut      `json:"spent"`
+	Signatures  []map[string]string `json:"signatures"`
+	Complete    bool                `json:"complete"`
+}
+
+// multisigSpends are the spends we are collecting signatures for, by
+// transaction ID. It is guarded by chainMutex.
+var multisigSpends = map[string]*MultisigSpend{}
+
+// createMultisigSpend builds the unsigned transaction paying receiver from
+// the outputs of address that no pool transaction spends, with change going
+// back to address and fee to the miner
+func createMultisigSpend(address MultisigAddress, receiver TxOut, fee int, unspentTxOuts UtxoView, txPool []Transaction) (*MultisigSpend, error) {
+	if receiver.Amount <= 0 || fee < 0 {
+		return nil, errors.New("amount must be positive and fee not negative")
+	}
+
+	owned := []UnspentTxOut{}
+	unspentTxOuts.forEach(func(uTxO UnspentTxOut) bool {
+		if string(uTxO.Script) == string(address.Script) && !isSpentInPool(uTxO, txPool) {
+			owned = append(owned, uTxO)
+		}
+		return true
+	})
+
+	txOutsForAmount, err := findTxOutsForAmount(receiver.Amount+fee, owned)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := Transaction{TxOuts: []TxOut{receiver}}
+	for _, uTxO := range txOutsForAmount.IncludedUnspentTxOuts {
+		tx.TxIns = append(tx.TxIns, TxIn{TxOutID: uTxO.TxOutID, TxOutIndex: uTxO.TxOutIndex})
+	}
+	if txOutsForAmount.LeftOverAmount > 0 {
+		tx.TxOuts = append(tx.TxOuts, TxOut{Amount: txOutsForAmount.LeftOverAmount, Script: address.Script})
+	}
+	tx.ID = getTransactionID(tx)
+
+	spend := &MultisigSpend{
+		Transaction: tx,
+		Address:     address,
+		Spent:       txOutsForAmount.IncludedUnspentTxOuts,
+		Signatures:  make([]map[string]string, len(tx.TxIns)),
+	}
+	for i := range spend.Signatures {
+		spend.Signatures[i] = map[string]string{}
+	}
+	return spend, nil
+}
+
+// MultisigSignatures are the signatures of one co-signer, one per input of
+// a spend, in hex
+type MultisigSignatures struct {
+	PubKey     string   `json:"pubKey"`
+	Signatures []string `json:"signatures"`
+}
+
+// signMultisigSpend signs every input of spend with privateKey
+func signMultisigSpend(spend MultisigSpend, privateKey string) (*MultisigSignatures, error) {
+	if _, err := ParseRsaPrivateKeyFromPemStr(privateKey); err != nil {
+		return nil, err
+	}
+	if err := spend.checkSpent(); err != nil {
+		return nil, err
+	}
+
+	pubKey := getPublicKey(privateKey)
+	if !spend.Address.hasKey(pubKey) {
+		return nil, errors.New("our key is not one of the keys of the multisig address")
+	}
+
+	signatures := &MultisigSignatures{PubKey: pubKey}
+	spent := utxoViewOf(spend.Spent)
+	for index := range spend.Transaction.TxIns {
+		signature := signTxIn(spend.Transaction, index, privateKey, spent)
+		signatures.Signatures = append(signatures.Signatures, hex.EncodeToString([]byte(signature)))
+	}
+	return signatures, nil
+}
+
+// checkSpent checks that Spent lists the outputs of the address the inputs
+// spend, in order
+func (s *MultisigSpend) checkSpent() error {
+	if len(s.Spent) != len(s.Transaction.TxIns) {
+		return fmt.Errorf("spend has %d inputs but %d spent outputs", len(s.Transaction.TxIns), len(s.Spent))
+	}
+	for index, txIn := range s.Transaction.TxIns {
+		spent := s.Spent[index]
+		if spent.TxOutID != txIn.TxOutID || spent.TxOutIndex != txIn.TxOutIndex {
+			return fmt.Errorf("spent output %d is not the one input %d spends", index, index)
+		}
+		if string(spent.Script) != string(s.Address.Script) {
+			return fmt.Errorf("input %d does not spend the multisig address", index)
+		}
+	}
+	return nil
+}
+
+func (a MultisigAddress) hasKey(pubKey string) bool {
+	for _, key := range a.PubKeys {
+		if key == pubKey {
+			return true
+		}
+	}
+	return false
+}
+
+// addSignatures adds the signatures of a co-signer after checking them
+func (s *MultisigSpend) addSignatures(signed MultisigSignatures) error {
+	pubKey, signatures := signed.PubKey, signed.Signatures
+	if !s.Address.hasKey(pubKey) {
+		return fmt.Errorf("%s is not one of the keys of the multisig address", pubKey)
+	}
+	if len(signatures) != len(s.Transaction.TxIns) {
+		return fmt.Errorf("spend has %d inputs, got %d signatures", len(s.Transaction.TxIns), len(signatures))
+	}
+
+	keyBytes, _ := hex.DecodeString(pubKey)
+	for index, signature := range signatures {
+		b, err := hex.DecodeString(signature)
+		if err != nil {
+			return fmt.Errorf("signature of input %d is not hex", index)
+		}
+		if !verifySignature(b, keyBytes, s.Transaction, index, s.Spent[index]) {
+			return fmt.Errorf("signature of input %d does not match %s", index, pubKey)
+		}
+	}
+
+	for index, signature := range signatures {
+		s.Signatures[index][pubKey] = signature
+	}
+	s.Complete = s.isComplete()
+	return nil
+}
+
+// isComplete reports whether every input has been signed by enough keys
+func (s *MultisigSpend) isComplete() bool {
+	for _, signed := range s.Signatures {
+		if len(signed) < s.Address.Threshold {
+			return false
+		}
+	}
+	return true
+}
+
+// finalize returns the transaction with its unlocking scripts, made of the
+// first Threshold signatures of each input in key order
+func (s *MultisigSpend) finalize() (*Transaction, error) {
+	if !s.isComplete() {
+		return nil, fmt.Errorf("every input needs %d signatures", s.Address.Threshold)
+	}
+
+	tx := s.Transaction
+	tx.TxIns = append([]TxIn{}, s.Transaction.TxIns...)
+	for index := range tx.TxIns {
+		sigs := [][]byte{}
+		for _, pubKey := range s.Address.PubKeys {
+			signature, ok := s.Signatures[index][pubKey]
+			if !ok || len(sigs) == s.Address.Threshold {
+				continue
+			}
+			b, _ := hex.DecodeString(signature)
+			sigs = append(sigs, b)
+		}
+		tx.TxIns[index].Script = signatureUnlockingScript(sigs...)
+	}
+	return &tx, nil
+}
+
+// broadcastMultisigSpend adds the spend with the given ID to the pool once
+// it has all its signatures
+func broadcastMultisigSpend(id string) (*Transaction, error) {
+	spend, ok := multisigSpends[id]
+	if !ok {
+		return nil, errors.New("unknown multisig spend")
+	}
+
+	tx, err := spend.finalize()
+	if err != nil {
+		return nil, err
+	}
+	if err := addToTransactionPool(tx, getUnspentTxOuts()); err != nil {
+		return tx, err
+	}
+
+	delete(multisigSpends, id)
+	return tx, nil
+}
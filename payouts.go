@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// Pool payouts. Every share a pool worker finds is recorded against the
+// address it mines for, weighted by the work of the share target. Each job
+// splits the block reward between those addresses in proportion to their
+// work and writes the split into its coinbase, so a block the pool finds
+// pays the miners directly. Which shares count depends on the scheme:
+//
+//	pplns         the last window shares, whatever block they fell before
+//	proportional  the shares of the round, found since the pool last found
+//	              a block
+//
+// What rounding leaves over, and the whole reward before there are shares,
+// goes to the pool's own address.
+
+const (
+	payoutPPLNS        = "pplns"
+	payoutProportional = "proportional"
+)
+
+// maxPayoutOutputs is how many outputs a pool coinbase has at most. Past
+// that the addresses with the least work are left out of the split.
+const maxPayoutOutputs = 250
+
+// poolShare is a share of the address it pays
+type poolShare struct {
+	address string
+	work    *big.Int
+	seq     uint64
+}
+
+// payoutWeight is the work an address did in the shares that count
+type payoutWeight struct {
+	Address string
+	Work    *big.Int
+}
+
+// payoutLedger records the shares of the pool. The pool guards it with its
+// mutex.
+type payoutLedger struct {
+	scheme string
+	// shares pplns counts
+	window int
+	// shares in the order they were found
+	shares  []poolShare
+	nextSeq uint64
+}
+
+func newPayoutLedger(scheme string, window int) (*payoutLedger, error) {
+	switch scheme {
+	case payoutPPLNS:
+		if window < 1 {
+			return nil, fmt.Errorf("pplns window must be at least 1, got %d", window)
+		}
+	case payoutProportional:
+	default:
+		return nil, fmt.Errorf("unknown payout scheme %q, use %s or %s", scheme, payoutPPLNS, payoutProportional)
+	}
+	return &payoutLedger{scheme: scheme, window: window}, nil
+}
+
+// addShare records a share paying address of work
+func (l *payoutLedger) addShare(address string, work *big.Int) {
+	l.shares = append(l.shares, poolShare{address: address, work: work, seq: l.nextSeq})
+	l.nextSeq++
+	if l.scheme == payoutPPLNS && len(l.shares) > l.window {
+		l.shares = l.shares[len(l.shares)-l.window:]
+	}
+}
+
+// counted is the sequence number of the next share, which the split
+// returned by weights does not count
+func (l *payoutLedger) counted() uint64 {
+	return l.nextSeq
+}
+
+// blockFound ends the round of a block whose coinbase counted the shares
+// before counted. Those paid by the block no longer count for
+// proportional; pplns keeps counting its window.
+func (l *payoutLedger) blockFound(counted uint64) {
+	if l.scheme != payoutProportional {
+		return
+	}
+	kept := []poolShare{}
+	for _, share := range l.shares {
+		if share.seq >= counted {
+			kept = append(kept, share)
+		}
+	}
+	l.shares = kept
+}
+
+// weights returns the work of the addresses with shares that count, the
+// most first, at most maxPayoutOutputs-1 of them to leave an output for the
+// pool
+func (l *payoutLedger) weights() []payoutWeight {
+	work := map[string]*big.Int{}
+	for _, share := range l.shares {
+		if _, ok := work[share.address]; !ok {
+			work[share.address] = big.NewInt(0)
+		}
+		work[share.address].Add(work[share.address], share.work)
+	}
+
+	weights := []payoutWeight{}
+	for address, w := range work {
+		weights = append(weights, payoutWeight{Address: address, Work: w})
+	}
+	sort.Slice(weights, func(i, j int) bool {
+		if c := weights[i].Work.Cmp(weights[j].Work); c != 0 {
+			return c > 0
+		}
+		return weights[i].Address < weights[j].Address
+	})
+	if len(weights) > maxPayoutOutputs-1 {
+		weights = weights[:maxPayoutOutputs-1]
+	}
+	return weights
+}
+
+// splitReward splits amount between weights in proportion to their work,
+// rounding down, and pays what is left to poolAddress
+func splitReward(amount int, weights []payoutWeight, poolAddress string) []TxOut {
+	total := big.NewInt(0)
+	for _, w := range weights {
+		total.Add(total, w.Work)
+	}
+
+	txOuts := []TxOut{}
+	paid := 0
+	if total.Sign() > 0 {
+		for _, w := range weights {
+			share := new(big.Int).Mul(big.NewInt(int64(amount)), w.Work)
+			share.Div(share, total)
+			if share.Sign() == 0 {
+				continue
+			}
+			txOuts = append(txOuts, TxOut{Address: w.Address, Amount: int(share.Int64())})
+			paid += int(share.Int64())
+		}
+	}
+	if left := amount - paid; left > 0 || len(txOuts) == 0 {
+		txOuts = append(txOuts, TxOut{Address: poolAddress, Amount: left})
+	}
+	return txOuts
+}
+
+// errBadPayoutAddress is returned for a worker name not naming the address
+// to pay
+var errBadPayoutAddress = errors.New("worker name must be the public key to pay, optionally followed by a dot and a name")
+
+// payoutAddress returns the address worker mines for. Workers are named
+// after it, like <address> or <address>.<rig>.
+func payoutAddress(worker string) (string, error) {
+	address := worker
+	if dot := strings.IndexByte(worker, '.'); dot >= 0 {
+		address = worker[:dot]
+	}
+	b, err := hex.DecodeString(address)
+	if err != nil {
+		return "", errBadPayoutAddress
+	}
+	key, err := ParsePubKey(b)
+	if err != nil {
+		return "", errBadPayoutAddress
+	}
+	// the form our wallets use
+	return hex.EncodeToString(key.SerializeUncompressed()), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+// Standardness policy. Blocks may hold any transaction the consensus rules
+// allow, but the pool only takes transactions of the usual shapes, so that
+// scripts nobody has reviewed do not spread through the network before a
+// miner chooses to include them.
+
+const (
+	ruleNonStandardTxSize   = "tx-size"
+	ruleNonStandardUnlock   = "scriptsig-size"
+	ruleNonStandardLock     = "scriptpubkey"
+	ruleNonStandardMultisig = "bare-multisig"
+)
+
+const (
+	maxStandardTxSize = 10000
+	// enough for a 3-of-3 multisig or a hash lock with a long preimage
+	maxStandardUnlockingScriptSize = 1650
+	maxStandardMultisigKeys        = 3
+)
+
+// checkStandard checks transaction against the standardness policy
+func checkStandard(transaction Transaction) error {
+	if size := getTransactionSize(transaction); size > maxStandardTxSize {
+		return ruleError(ruleNonStandardTxSize, "transaction %s takes %d bytes, at most %d are standard", transaction.ID, size, maxStandardTxSize)
+	}
+
+	for index, txIn := range transaction.TxIns {
+		if len(txIn.Script) > maxStandardUnlockingScriptSize {
+			return ruleError(ruleNonStandardUnlock, "input %d of transaction %s has a %d byte unlocking script", index, transaction.ID, len(txIn.Script))
+		}
+	}
+
+	for index, txOut := range transaction.TxOuts {
+		if len(txOut.Script) == 0 {
+			continue
+		}
+		switch classifyScript(txOut.Script) {
+		case nonStandardScript:
+			return ruleError(ruleNonStandardLock, "output %d of transaction %s has a non-standard locking script", index, transaction.ID)
+		case multisigScript:
+			if n := multisigKeyCount(txOut.Script); n > maxStandardMultisigKeys {
+				return ruleError(ruleNonStandardMultisig, "output %d of transaction %s is a multisig of %d keys, at most %d are standard", index, transaction.ID, n, maxStandardMultisigKeys)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Mining pool. Miners connect over TCP and speak a Stratum-like JSON-RPC,
+// one JSON object per line. The pool hands out jobs built from the block
+// template, their coinbase split between the addresses workers mine for
+// (see payouts.go), and sends a new job whenever the tip changes. The 64-bit header nonce is split between the pool and the
+// worker: each connection gets its own upper 32 bits, its extra-nonce, and
+// searches the lower 32 bits and the timestamp. Solutions meeting the
+// easier share target are counted for the worker that found them and the
+// address it mines for; those meeting the block target are added to the
+// chain.
+//
+// Calls from the worker:
+//
+//	mining.subscribe                             -> [extraNonce, nonceSize]
+//	mining.authorize [worker, password]          -> true
+//
+// worker is the address to pay, optionally followed by a dot and a name.
+//	mining.submit [worker, jobID, time, nonce]   -> true
+//
+// nonce is the lower 32 bits as 8 hex digits. Notifications from the pool:
+//
+//	mining.set_target [target]
+//	mining.notify [jobID, previousHash, index, merkleRoot, bits, time,
+//	               minTime, cleanJobs]
+
+// Stratum error codes
+const (
+	poolErrOther          = 20
+	poolErrJobNotFound    = 21
+	poolErrDuplicateShare = 22
+	poolErrLowDifficulty  = 23
+	poolErrUnauthorized   = 24
+	poolErrNotSubscribed  = 25
+)
+
+const (
+	// how often a job picks up new pool transactions
+	poolJobRefreshInterval = 30 * time.Second
+	// jobs of the current tip shares are still taken for
+	poolKeptJobs = 4
+	// longest line a worker may send
+	poolMaxLineSize = 16 << 10
+)
+
+// miningPool is the pool of this node, nil when it does not run one
+var miningPool *MiningPool
+
+// poolRequest is a call from a worker
+type poolRequest struct {
+	ID     *int64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// poolMessage is a response or, without an ID, a notification
+type poolMessage struct {
+	ID     *int64        `json:"id"`
+	Result interface{}   `json:"result,omitempty"`
+	Error  []interface{} `json:"error,omitempty"`
+	Method string        `json:"method,omitempty"`
+	Params []interface{} `json:"params,omitempty"`
+}
+
+// poolError is an error a call answers with
+type poolError struct {
+	Code    int
+	Message string
+}
+
+func (e *poolError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+// poolJob is a block template workers search
+type poolJob struct {
+	id          string
+	template    Block
+	minTime     int64
+	shareTarget *big.Int
+	// work a share stands for
+	shareWork *big.Int
+	// the coinbase pays the shares recorded before this one
+	counted uint64
+	// nonces and times of the shares found, to turn duplicates away
+	shares map[string]bool
+}
+
+// PoolWorkerStats are the shares a worker submitted
+type PoolWorkerStats struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	Accepted  int    `json:"accepted"`
+	Rejected  int    `json:"rejected"`
+	Blocks    int    `json:"blocks"`
+	LastShare int64  `json:"lastShare"`
+}
+
+// MiningPool hands out jobs to the workers connected to it
+type MiningPool struct {
+	// a share is a hash not exceeding shareFactor times the block target
+	shareFactor int64
+
+	mutex          sync.Mutex
+	jobs           []*poolJob
+	nextJob        uint64
+	nextExtraNonce uint32
+	sessions       map[*poolSession]bool
+	workers        map[string]*PoolWorkerStats
+	payouts        *payoutLedger
+}
+
+// poolSession is the connection of one miner, which may run several
+// workers
+type poolSession struct {
+	pool       *MiningPool
+	conn       net.Conn
+	writeMutex sync.Mutex
+
+	extraNonce uint32
+	subscribed bool
+	authorized map[string]bool
+}
+
+// newMiningPool returns a pool paying its workers by scheme, pplns counting
+// the last window shares
+func newMiningPool(shareFactor int64, scheme string, window int) (*MiningPool, error) {
+	if shareFactor < 1 {
+		shareFactor = 1
+	}
+	payouts, err := newPayoutLedger(scheme, window)
+	if err != nil {
+		return nil, err
+	}
+	return &MiningPool{
+		shareFactor:    shareFactor,
+		nextExtraNonce: 1,
+		sessions:       map[*poolSession]bool{},
+		workers:        map[string]*PoolWorkerStats{},
+		payouts:        payouts,
+	}, nil
+}
+
+// listen serves the workers connecting to address
+func (p *MiningPool) listen(address string) error {
+	if err := p.newJob(true); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	fmt.Println("mining pool listening on", listener.Addr())
+
+	go p.watchTip()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serve(conn)
+	}
+}
+
+// watchTip sends a new job whenever the tip changes, and a refreshed one
+// every poolJobRefreshInterval
+func (p *MiningPool) watchTip() {
+	tip := subscribeTip()
+	defer unsubscribeTip(tip)
+
+	ticker := time.NewTicker(poolJobRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-tip:
+			err = p.newJob(true)
+		case <-ticker.C:
+			err = p.newJob(false)
+		}
+		if err != nil {
+			fmt.Println("mining pool cannot build a job:", err)
+		}
+	}
+}
+
+// newJob builds a job from the block template, its coinbase paying the
+// shares recorded so far, and sends it to every worker. With clean, the jobs before it build on an old tip and no longer
+// take shares.
+func (p *MiningPool) newJob(clean bool) error {
+	publicKey, err := GetPublicFromWallet()
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	weights := p.payouts.weights()
+	counted := p.payouts.counted()
+	p.mutex.Unlock()
+
+	chainMutex.Lock()
+	template := createPayoutBlockTemplate(func(amount int) []TxOut {
+		return splitReward(amount, weights, publicKey)
+	})
+	chainMutex.Unlock()
+
+	shareTarget := new(big.Int).Mul(compactToBig(template.Bits), big.NewInt(p.shareFactor))
+	if shareTarget.Cmp(powLimit) > 0 {
+		shareTarget.Set(powLimit)
+	}
+
+	p.mutex.Lock()
+	job := &poolJob{
+		id:          strconv.FormatUint(p.nextJob, 16),
+		template:    template.block(),
+		minTime:     template.MinTimestamp,
+		shareTarget: shareTarget,
+		shareWork:   targetWork(shareTarget),
+		counted:     counted,
+		shares:      map[string]bool{},
+	}
+	p.nextJob++
+	if clean {
+		p.jobs = nil
+	}
+	p.jobs = append(p.jobs, job)
+	if len(p.jobs) > poolKeptJobs {
+		p.jobs = p.jobs[len(p.jobs)-poolKeptJobs:]
+	}
+	sessions := p.subscribedSessions()
+	p.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.sendJob(job, clean)
+	}
+	return nil
+}
+
+// subscribedSessions returns the sessions that take jobs. The caller holds
+// p.mutex.
+func (p *MiningPool) subscribedSessions() []*poolSession {
+	sessions := []*poolSession{}
+	for session := range p.sessions {
+		if session.subscribed {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// latestJob returns the job new workers start on
+func (p *MiningPool) latestJob() *poolJob {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.jobs[len(p.jobs)-1]
+}
+
+// serve answers the calls of the miner on conn until it disconnects
+func (p *MiningPool) serve(conn net.Conn) {
+	session := &poolSession{
+		pool:       p,
+		conn:       conn,
+		authorized: map[string]bool{},
+	}
+
+	p.mutex.Lock()
+	session.extraNonce = p.nextExtraNonce
+	p.nextExtraNonce++
+	p.sessions[session] = true
+	p.mutex.Unlock()
+
+	defer func() {
+		p.mutex.Lock()
+		delete(p.sessions, session)
+		p.mutex.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), poolMaxLineSize)
+	for scanner.Scan() {
+		var request poolRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			fmt.Println("mining pool: bad request from", conn.RemoteAddr(), err)
+			return
+		}
+
+		result, err := session.handle(request)
+		response := poolMessage{ID: request.ID, Result: result}
+		if err != nil {
+			poolErr, ok := err.(*poolError)
+			if !ok {
+				poolErr = &poolError{poolErrOther, err.Error()}
+			}
+			response.Result = nil
+			response.Error = []interface{}{poolErr.Code, poolErr.Message, nil}
+		}
+		if err := session.send(response); err != nil {
+			return
+		}
+
+		if request.Method == "mining.subscribe" && err == nil {
+			session.sendTarget(p.latestJob())
+			session.sendJob(p.latestJob(), true)
+		}
+	}
+}
+
+// handle answers request
+func (s *poolSession) handle(request poolRequest) (interface{}, error) {
+	switch request.Method {
+	case "mining.subscribe":
+		s.pool.mutex.Lock()
+		s.subscribed = true
+		s.pool.mutex.Unlock()
+		return []interface{}{fmt.Sprintf("%08x", s.extraNonce), 4}, nil
+
+	case "mining.authorize":
+		var params []string
+		if err := json.Unmarshal(request.Params, &params); err != nil || len(params) == 0 || params[0] == "" {
+			return nil, &poolError{poolErrOther, "authorize takes a worker name"}
+		}
+		address, err := payoutAddress(params[0])
+		if err != nil {
+			return nil, &poolError{poolErrUnauthorized, err.Error()}
+		}
+		s.pool.mutex.Lock()
+		s.authorized[params[0]] = true
+		if _, ok := s.pool.workers[params[0]]; !ok {
+			s.pool.workers[params[0]] = &PoolWorkerStats{Name: params[0], Address: address}
+		}
+		s.pool.mutex.Unlock()
+		return true, nil
+
+	case "mining.submit":
+		var params []json.RawMessage
+		if err := json.Unmarshal(request.Params, &params); err != nil || len(params) != 4 {
+			return nil, &poolError{poolErrOther, "submit takes a worker, job, time and nonce"}
+		}
+		var worker, jobID, nonce string
+		var timestamp int64
+		if json.Unmarshal(params[0], &worker) != nil || json.Unmarshal(params[1], &jobID) != nil ||
+			json.Unmarshal(params[2], &timestamp) != nil || json.Unmarshal(params[3], &nonce) != nil {
+			return nil, &poolError{poolErrOther, "submit takes a worker, job, time and nonce"}
+		}
+		low, err := strconv.ParseUint(nonce, 16, 32)
+		if err != nil {
+			return nil, &poolError{poolErrOther, "nonce must be 8 hex digits"}
+		}
+		return s.submit(worker, jobID, timestamp, uint32(low))
+	}
+	return nil, &poolError{poolErrOther, fmt.Sprintf("unknown method %q", request.Method)}
+}
+
+// submit checks a share of worker and adds it to the chain if it solves
+// the block
+func (s *poolSession) submit(worker string, jobID string, timestamp int64, low uint32) (interface{}, error) {
+	p := s.pool
+	p.mutex.Lock()
+	if !s.subscribed {
+		p.mutex.Unlock()
+		return nil, &poolError{poolErrNotSubscribed, "not subscribed"}
+	}
+	if !s.authorized[worker] {
+		p.mutex.Unlock()
+		return nil, &poolError{poolErrUnauthorized, "unauthorized worker"}
+	}
+	stats := p.workers[worker]
+
+	var job *poolJob
+	for _, j := range p.jobs {
+		if j.id == jobID {
+			job = j
+		}
+	}
+	if job == nil {
+		stats.Rejected++
+		p.mutex.Unlock()
+		return nil, &poolError{poolErrJobNotFound, "job not found"}
+	}
+
+	template := job.template
+	nonce := int(uint64(s.extraNonce)<<32 | uint64(low))
+	key := fmt.Sprintf("%d:%d", nonce, timestamp)
+	if job.shares[key] {
+		stats.Rejected++
+		p.mutex.Unlock()
+		return nil, &poolError{poolErrDuplicateShare, "duplicate share"}
+	}
+	if timestamp < job.minTime || timestamp >= getCurrentTimestamp()+maxFutureBlockTime {
+		stats.Rejected++
+		p.mutex.Unlock()
+		return nil, &poolError{poolErrOther, "time out of range"}
+	}
+
+	hash := calculateHash(template.Index, template.PreviousHash, timestamp, template.MerkleRoot, template.Bits, nonce)
+	hashNum, _ := new(big.Int).SetString(hash, 16)
+	if hashNum.Cmp(job.shareTarget) > 0 {
+		stats.Rejected++
+		p.mutex.Unlock()
+		return nil, &poolError{poolErrLowDifficulty, "low difficulty share"}
+	}
+
+	job.shares[key] = true
+	p.payouts.addShare(stats.Address, job.shareWork)
+	stats.Accepted++
+	stats.LastShare = getCurrentTimestamp()
+	p.mutex.Unlock()
+
+	if !hashMatchesDifficulty(hash, template.Bits) {
+		return true, nil
+	}
+
+	block := GenerageBlock(template.Index, template.PreviousHash, timestamp, template.Data, hash, template.Bits, nonce)
+	chainMutex.Lock()
+	err := addBlockToChain(*block)
+	chainMutex.Unlock()
+	if err != nil {
+		fmt.Printf("mining pool: block %s of worker %s rejected: %v\n", block.Hash, worker, err)
+		return true, nil
+	}
+
+	p.mutex.Lock()
+	stats.Blocks++
+	p.payouts.blockFound(job.counted)
+	p.mutex.Unlock()
+	fmt.Printf("mining pool: worker %s found block %d %s\n", worker, block.Index, block.Hash)
+	syncer.announce(*block)
+	return true, nil
+}
+
+// send writes message to the miner
+func (s *poolSession) send(message poolMessage) error {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	_, err = s.conn.Write(append(line, '\n'))
+	return err
+}
+
+func (s *poolSession) sendTarget(job *poolJob) {
+	s.send(poolMessage{
+		Method: "mining.set_target",
+		Params: []interface{}{fmt.Sprintf("%064x", job.shareTarget)},
+	})
+}
+
+func (s *poolSession) sendJob(job *poolJob, clean bool) {
+	template := job.template
+	s.send(poolMessage{
+		Method: "mining.notify",
+		Params: []interface{}{job.id, template.PreviousHash, template.Index, template.MerkleRoot, fmt.Sprintf("%08x", template.Bits), template.Timestamp, job.minTime, clean},
+	})
+}
+
+// PoolStats are the workers of the pool and their shares, and what the
+// coinbase of the latest job pays
+type PoolStats struct {
+	Sessions     int               `json:"sessions"`
+	ShareTarget  string            `json:"shareTarget"`
+	PayoutScheme string            `json:"payoutScheme"`
+	Payouts      []TxOut           `json:"payouts"`
+	Workers      []PoolWorkerStats `json:"workers"`
+}
+
+func (p *MiningPool) stats() PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stats := PoolStats{
+		Sessions:     len(p.sessions),
+		PayoutScheme: p.payouts.scheme,
+		Payouts:      []TxOut{},
+		Workers:      []PoolWorkerStats{},
+	}
+	if len(p.jobs) > 0 {
+		job := p.jobs[len(p.jobs)-1]
+		stats.ShareTarget = fmt.Sprintf("%064x", job.shareTarget)
+		stats.Payouts = job.template.Data[0].TxOuts
+	}
+	for _, worker := range p.workers {
+		stats.Workers = append(stats.Workers, *worker)
+	}
+	return stats
+}
+
+// errPoolNotRunning is returned when the node runs no mining pool
+var errPoolNotRunning = errors.New("the node runs no mining pool")
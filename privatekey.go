@@ -47,3 +47,13 @@ func (p *PrivateKey) GetSerialize() string {
 
 	return string(dst[:n])
 }
+
+// EncodePEM encodes p the way ParseRsaPrivateKeyFromPemStr reads it
+func (p *PrivateKey) EncodePEM() (string, error) {
+	der, err := x509.MarshalECPrivateKey((*ecdsa.PrivateKey)(p))
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})), nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"errors"
 	"math/big"
 )
@@ -25,12 +26,16 @@ func ParsePubKey(pubKeyStr []byte) (key *PublicKey, err error) {
 	if len(pubKeyStr) == 0 {
 		return nil, errors.New("pubkey string is empty")
 	}
+	if len(pubKeyStr) != PubKeyBytesLenUncompressed || pubKeyStr[0] != pubkeyUncompressed {
+		return nil, errors.New("pubkey is not an uncompressed key")
+	}
 
-	format := pubKeyStr[0]
-	format &= ^byte(0x1)
-
+	pubkey.Curve = elliptic.P256()
 	pubkey.X = new(big.Int).SetBytes(pubKeyStr[1:33])
 	pubkey.Y = new(big.Int).SetBytes(pubKeyStr[33:])
+	if !pubkey.Curve.IsOnCurve(pubkey.X, pubkey.Y) {
+		return nil, errors.New("pubkey is not on the curve")
+	}
 
 	return &pubkey, nil
 }
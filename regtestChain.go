@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The regtest snapshot chain. Regtest chains are private, so the snapshot
+// regtest pins is of a chain anyone can build with -genregtest: block i
+// pays the subsidy to the genesis address, is timestamped i block
+// intervals after genesis and takes the first nonce meeting its target.
+// SERIALIZATION.md has how to write the snapshot and start from it.
+
+// nextRegtestBlock returns the block of the regtest snapshot chain after
+// chain
+func nextRegtestBlock(chain []Block) Block {
+	prev := chain[len(chain)-1]
+	data := []Transaction{GetCoinBaseTransaction(genesisTransaction[0].TxOuts[0].Address, prev.Index+1, 0)}
+	block := *GenerageBlock(prev.Index+1, prev.Hash, prev.Timestamp+chainParams.BlockGenerationInterval, data, "", getDifficulty(chain), 0)
+	for block.Hash = calculateHashForBlock(block); !hashMatchesDifficulty(block.Hash, block.Bits); block.Hash = calculateHashForBlock(block) {
+		block.Nonce++
+	}
+	return block
+}
+
+// genRegtestChain extends the current chain, which must be a start of the
+// regtest snapshot chain, to height of it
+func genRegtestChain(height int) error {
+	if chainParams != &regTestParams {
+		return errors.New("the snapshot chain is only generated on regtest")
+	}
+
+	chain := []Block{blockchain[0]}
+	for len(chain) <= height {
+		block := nextRegtestBlock(chain)
+		chain = append(chain, block)
+		if block.Index < len(blockchain) {
+			if blockchain[block.Index].Hash != block.Hash {
+				return fmt.Errorf("block %d is not that of the regtest snapshot chain", block.Index)
+			}
+			continue
+		}
+		if err := addBlockToChain(block); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("generated the regtest snapshot chain up to block %d\n", height)
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BlockUndo holds what connecting a block took out of the unspent set, so
+// the block can be disconnected again
+type BlockUndo struct {
+	SpentTxOuts []UnspentTxOut
+}
+
+// blockRejectedError is returned when a block fails to connect
+type blockRejectedError struct {
+	Hash   string
+	Reason *RuleError
+}
+
+func (e *blockRejectedError) Error() string {
+	return e.Reason.Error()
+}
+
+func (e *blockRejectedError) Unwrap() error {
+	return e.Reason
+}
+
+// connectBlock applies the transactions of block, built on parent, to
+// aUnspentTxOuts and returns the changes to the unspent set along with the
+// undo data of the block. A block with invalid transactions is rejected
+// with a *RuleError.
+func connectBlock(block Block, parent Block, aUnspentTxOuts UtxoView) (*utxoOverlay, *BlockUndo, error) {
+	newUnspentTxOuts, err := ProcessTransactions(block.Data, aUnspentTxOuts, blockContext(block, parent))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	undo := &BlockUndo{SpentTxOuts: []UnspentTxOut{}}
+	for _, tx := range block.Data[1:] {
+		for _, txIn := range tx.TxIns {
+			if spent := findUnspentTxOut(txIn.TxOutID, txIn.TxOutIndex, aUnspentTxOuts); spent != nil {
+				undo.SpentTxOuts = append(undo.SpentTxOuts, *spent)
+			}
+		}
+	}
+
+	return newUnspentTxOuts, undo, nil
+}
+
+// rejectBlock wraps why block failed to connect. Errors that are not about
+// consensus rules are passed through, since they do not make block invalid.
+func rejectBlock(block Block, err error) error {
+	if ruleErr := asRuleError(err); ruleErr != nil {
+		return &blockRejectedError{Hash: block.Hash, Reason: ruleErr}
+	}
+	return err
+}
+
+// disconnectBlock reverts connectBlock: the outputs created by block are
+// removed and the outputs it spent are restored
+func disconnectBlock(block Block, undo BlockUndo, aUnspentTxOuts UtxoView) *utxoOverlay {
+	view := newUtxoOverlay(aUnspentTxOuts)
+	for _, tx := range block.Data {
+		for index := range tx.TxOuts {
+			view.spend(outPoint{tx.ID, index})
+		}
+	}
+	for _, uTxO := range undo.SpentTxOuts {
+		view.add(uTxO)
+	}
+	return view
+}
+
+// reorganizeChain makes newBlocks the current chain. Blocks of the current
+// chain above the fork point are disconnected and the new branch is
+// connected on top of it. Nothing is changed unless every block of the new
+// branch connects. Transactions of disconnected blocks that are still valid
+// go back to the transaction pool.
+func reorganizeChain(newBlocks []Block) error {
+	if len(newBlocks) == 0 || newBlocks[0].Hash != blockchain[0].Hash {
+		return errors.New("new chain does not share our genesis block")
+	}
+
+	forkIndex := 0
+	for forkIndex+1 < len(newBlocks) && forkIndex+1 < len(blockchain) &&
+		newBlocks[forkIndex+1].Hash == blockchain[forkIndex+1].Hash {
+		forkIndex++
+	}
+
+	// the changes are made to the unspent set once every block connects
+	view := newUtxoOverlay(utxoDB)
+	disconnected := blockchain[forkIndex+1:]
+	oldUndos := make([]BlockUndo, len(disconnected))
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		block := disconnected[i]
+		undo, ok := utxoDB.getUndo(block.Hash)
+		if !ok {
+			if err := utxoDB.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("no undo data for block %d", block.Index)
+		}
+		disconnectBlock(block, undo, view).writeTo(view)
+		oldUndos[i] = undo
+	}
+
+	connected := newBlocks[forkIndex+1:]
+	newUndos := make([]*BlockUndo, len(connected))
+	for i, block := range connected {
+		if err := validateNewBlock(block, newBlocks[:forkIndex+i+1]); err != nil {
+			return rejectBlock(block, err)
+		}
+
+		changes, undo, err := connectBlock(block, newBlocks[forkIndex+i], view)
+		if err != nil {
+			if dbErr := utxoDB.Err(); dbErr != nil {
+				return dbErr
+			}
+			return rejectBlock(block, err)
+		}
+		changes.writeTo(view)
+		newUndos[i] = undo
+	}
+
+	if blockStore != nil {
+		if err := blockStore.ReplaceBlocks(newBlocks); err != nil {
+			return err
+		}
+	}
+
+	view.writeTo(utxoDB)
+	for _, block := range disconnected {
+		utxoDB.dropUndo(block.Hash)
+	}
+	for i, block := range connected {
+		utxoDB.putUndo(block.Hash, *newUndos[i])
+	}
+	tip := newBlocks[len(newBlocks)-1]
+	utxoDB.setTip(tip.Hash, tip.Index)
+	blockchain = newBlocks
+	if err := utxoDB.flushIfFull(); err != nil {
+		fmt.Println("cannot write the unspent set:", err)
+	}
+	if addrIndex != nil {
+		for i := len(disconnected) - 1; i >= 0; i-- {
+			addrIndex.disconnect(disconnected[i], oldUndos[i])
+		}
+		for i, block := range connected {
+			addrIndex.connect(block, *newUndos[i])
+		}
+	}
+
+	fmt.Printf("reorganized chain at block %d: %d blocks disconnected, %d connected\n", forkIndex, len(disconnected), len(connected))
+
+	for _, block := range connected {
+		mempool.removeForBlock(block)
+	}
+	// outputs pool transactions spend may have moved to other blocks
+	mempool.uncheckAll()
+	for _, block := range disconnected {
+		for _, tx := range block.Data[1:] {
+			tx := tx
+			addToTransactionPool(&tx, getUnspentTxOuts())
+		}
+	}
+	updateTransactionPool(utxoDB)
+
+	return nil
+}
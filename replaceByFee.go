@@ -0,0 +1,74 @@
+package main
+
+// Replace-by-fee. A transaction spending an output a pool transaction
+// already spends is normally turned away. If the pool transaction opted in
+// by setting replaceableFlag on the RelativeLock of one of its inputs, the
+// newcomer replaces it, along with every pool transaction spending its
+// outputs, when it pays more in total and per byte than each of them.
+
+const (
+	ruleReplacementFee            = "insufficient-fee"
+	ruleTooManyReplacements       = "too-many-replacements"
+	ruleReplacementSpendsConflict = "bad-txns-spends-conflicting-tx"
+)
+
+// A RelativeLock with replaceableFlag set lets its transaction be replaced
+// in the pool. The flag sits outside the bits relative locks count with.
+const replaceableFlag = 1 << 31
+
+// maxReplacementEvictions is how many pool transactions one replacement may
+// evict, so a single transaction cannot make the pool redo a lot of work
+const maxReplacementEvictions = 100
+
+// signalsReplacement reports whether transaction opted in to being replaced
+func signalsReplacement(transaction Transaction) bool {
+	for _, txIn := range transaction.TxIns {
+		if txIn.RelativeLock&replaceableFlag != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReplacement checks that transaction, which pays fee, may replace the
+// pool transactions conflicts and returns the IDs of every transaction it
+// evicts
+func checkReplacement(transaction Transaction, fee int, conflicts []string) ([]string, error) {
+	for _, id := range conflicts {
+		if !signalsReplacement(*mempool.get(id)) {
+			return nil, ruleError(ruleMempoolConflict, "transaction %s spends an output pool transaction %s spends, which is not replaceable", transaction.ID, id)
+		}
+	}
+
+	evicted := mempool.descendants(conflicts)
+	if len(evicted) > maxReplacementEvictions {
+		return nil, ruleError(ruleTooManyReplacements, "transaction %s would evict %d pool transactions, at most %d are allowed", transaction.ID, len(evicted), maxReplacementEvictions)
+	}
+
+	// its own inputs would be gone
+	evictedSet := map[string]bool{}
+	for _, id := range evicted {
+		evictedSet[id] = true
+	}
+	for index, txIn := range transaction.TxIns {
+		if evictedSet[txIn.TxOutID] {
+			return nil, ruleError(ruleReplacementSpendsConflict, "input %d of transaction %s spends pool transaction %s, which it replaces", index, transaction.ID, txIn.TxOutID)
+		}
+	}
+
+	size := getTransactionSize(transaction)
+	evictedFees := 0
+	for _, id := range evicted {
+		entry := mempool.txs[id]
+		// compare fee/size without rounding
+		if fee*entry.size <= entry.fee*size {
+			return nil, ruleError(ruleReplacementFee, "transaction %s pays %d per 1000 bytes, no more than the %d of %s it replaces", transaction.ID, feeRate(fee, size), feeRate(entry.fee, entry.size), id)
+		}
+		evictedFees += entry.fee
+	}
+	if fee <= evictedFees {
+		return nil, ruleError(ruleReplacementFee, "transaction %s pays a fee of %d, no more than the %d of the transactions it replaces", transaction.ID, fee, evictedFees)
+	}
+
+	return evicted, nil
+}
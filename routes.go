@@ -1,26 +1,62 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 )
 
 type Handler = func(w http.ResponseWriter, r *http.Request)
 
-func createRoutes() {
+func createRoutes(hub *Hub) {
 	r := mux.NewRouter()
-	hub := newHub()
 
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "blockchain.html")
 	}).Methods("GET")
 	r.HandleFunc("/blocks", blocksHandler).Methods("GET")
 	r.HandleFunc("/blocks/:hash", blocksHandler).Methods("GET")
+	r.HandleFunc("/transactions/{id}/proof", merkleProofHandler).Methods("GET")
+
+	r.HandleFunc("/rejections", rejectionsHandler).Methods("GET")
+	r.HandleFunc("/sendTransaction", sendTransactionHandler).Methods("POST")
+	r.HandleFunc("/createTransaction", createTransactionHandler).Methods("POST")
+	r.HandleFunc("/transactions", submitTransactionHandler).Methods("POST")
+	r.HandleFunc("/transactions/{id}/bumpFee", bumpFeeHandler).Methods("POST")
+	r.HandleFunc("/signTransaction", signTransactionHandler).Methods("POST")
+	r.HandleFunc("/lockScript", lockScriptHandler).Methods("POST")
+	r.HandleFunc("/transactionPool", transactionPoolHandler).Methods("GET")
+	r.HandleFunc("/mempool", mempoolStatsHandler).Methods("GET")
+
+	r.HandleFunc("/address", addressHandler).Methods("GET")
+	r.HandleFunc("/addresses/{address}/balance", addressBalanceHandler).Methods("GET")
+	r.HandleFunc("/addresses/{address}/utxos", addressUnspentTxOutsHandler).Methods("GET")
+	r.HandleFunc("/addresses/{address}/history", addressHistoryHandler).Methods("GET")
+	r.HandleFunc("/multisig/address", multisigAddressHandler).Methods("POST")
+	r.HandleFunc("/multisig/sign", multisigSignHandler).Methods("POST")
+	r.HandleFunc("/multisig/spends", createMultisigSpendHandler).Methods("POST")
+	r.HandleFunc("/multisig/spends/{id}", multisigSpendHandler).Methods("GET")
+	r.HandleFunc("/multisig/spends/{id}/signatures", addMultisigSignaturesHandler).Methods("POST")
+	r.HandleFunc("/multisig/spends/{id}/sign", signMultisigSpendHandler).Methods("POST")
+	r.HandleFunc("/multisig/spends/{id}/broadcast", broadcastMultisigSpendHandler).Methods("POST")
 
 	r.HandleFunc("/mineBlock", mineBlock).Methods("POST")
+	r.HandleFunc("/blockTemplate", blockTemplateHandler).Methods("GET")
+	r.HandleFunc("/submitBlock", submitBlockHandler).Methods("POST")
+	r.HandleFunc("/pool", poolStatsHandler).Methods("GET")
+	r.HandleFunc("/miner", minerStatusHandler).Methods("GET")
+	r.HandleFunc("/miner/start", startMinerHandler).Methods("POST")
+	r.HandleFunc("/miner/stop", stopMinerHandler).Methods("POST")
 	r.HandleFunc("/peers", getPeers(hub)).Methods("POST")
+	r.HandleFunc("/addPeer", addPeerHandler(hub)).Methods("POST")
+	r.HandleFunc("/sync", syncStatusHandler).Methods("GET")
+	r.HandleFunc("/snapshot", snapshotStatusHandler).Methods("GET")
+	r.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	})
 
 	http.Handle("/", r)
 	http.ListenAndServe(":8080", r)
@@ -40,10 +76,45 @@ func getPeers(hub *Hub) Handler {
 	}
 }
 
+func addPeerHandler(hub *Hub) Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Peer string `json:"peer"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := connectToPeer(hub, body.Peer); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func syncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(syncer.status())
+}
+
+func snapshotStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if validator == nil {
+		json.NewEncoder(w).Encode(SnapshotStatus{State: "none"})
+		return
+	}
+	json.NewEncoder(w).Encode(validator.status())
+}
+
 func blocksHandler(w http.ResponseWriter, r *http.Request) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
 	json.NewEncoder(w).Encode(GetBlockchain())
 }
 func getBlockByHashHandler(w http.ResponseWriter, r *http.Request) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
 	vars := mux.Vars(r)
 	var resBlock *Block
 	for _, block := range GetBlockchain() {
@@ -55,6 +126,430 @@ func getBlockByHashHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resBlock)
 }
 
+// merkleProofHandler returns the Merkle proof of a transaction of the
+// current chain along with the transaction and the header of the block that
+// includes it
+func merkleProofHandler(w http.ResponseWriter, r *http.Request) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	txID := mux.Vars(r)["id"]
+	for _, block := range GetBlockchain() {
+		for index, tx := range block.Data {
+			if tx.ID == txID {
+				json.NewEncoder(w).Encode(struct {
+					Header      BlockHeader  `json:"header"`
+					Transaction Transaction  `json:"transaction"`
+					Proof       *MerkleProof `json:"proof"`
+				}{block.Header(), tx, getMerkleProof(block.Data, index)})
+				return
+			}
+		}
+	}
+	http.Error(w, "transaction not found", http.StatusNotFound)
+}
+
+// writeError answers with err. Broken consensus rules are sent as JSON so
+// clients can tell which rule it was.
+func writeError(w http.ResponseWriter, err error, status int) {
+	if ruleErr := asRuleError(err); ruleErr != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(ruleErr)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// rejectionsHandler lists the blocks and transactions we rejected lately
+func rejectionsHandler(w http.ResponseWriter, r *http.Request) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	json.NewEncoder(w).Encode(recentRejections)
+}
+
+// transactionPoolHandler lists the pool transactions in the order blocks
+// take them, highest fee rate first
+func transactionPoolHandler(w http.ResponseWriter, r *http.Request) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	json.NewEncoder(w).Encode(getPoolEntries(getUnspentTxOuts()))
+}
+
+// mempoolStatsHandler returns how full the pool is and the least fee rate
+// it takes
+func mempoolStatsHandler(w http.ResponseWriter, r *http.Request) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	json.NewEncoder(w).Encode(mempool.stats())
+}
+
+// transactionRequest is what the wallet is asked to pay
+type transactionRequest struct {
+	Address string `json:"address"`
+	Script  Script `json:"script"`
+	Amount  int    `json:"amount"`
+	Fee     int    `json:"fee"`
+	FeeRate int    `json:"feeRate"`
+	TxLocks
+}
+
+func (body transactionRequest) receiver() TxOut {
+	return TxOut{Address: body.Address, Amount: body.Amount, Script: body.Script}
+}
+
+func sendTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	var body transactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := sendTransaction(body.receiver(), body.Fee, body.FeeRate, body.TxLocks)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(tx)
+}
+
+// createTransactionHandler returns a signed transaction of our wallet
+// without sending it
+func createTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	var body transactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	tx, err := buildTransaction(body.receiver(), body.Fee, body.FeeRate, body.TxLocks)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(tx)
+}
+
+// submitTransactionHandler adds a signed transaction to the pool
+func submitTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	var tx Transaction
+	if err := json.NewDecoder(r.Body).Decode(&tx); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := submitTransaction(tx); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(tx)
+}
+
+// bumpFeeHandler replaces a replaceable pool transaction of our wallet with
+// one paying feeRate
+func bumpFeeHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		FeeRate int `json:"feeRate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := bumpTransactionFee(mux.Vars(r)["id"], body.FeeRate)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(tx)
+}
+
+// signTransactionHandler signs the inputs of a transaction our wallet can
+// spend. HashType defaults to signing the whole transaction.
+func signTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Transaction Transaction `json:"transaction"`
+		HashType    byte        `json:"hashType"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.HashType == 0 {
+		body.HashType = sigHashAll
+	}
+
+	tx, err := signTransaction(body.Transaction, body.HashType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(tx)
+}
+
+// lockScriptHandler returns the script locking an output to pubKey until
+// lockTime, or until the output is relativeLock old
+func lockScriptHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		PubKey string `json:"pubKey"`
+		TxLocks
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pubKey, err := hex.DecodeString(body.PubKey)
+	if err == nil {
+		_, err = ParsePubKey(pubKey)
+	}
+	if err != nil {
+		http.Error(w, "bad public key", http.StatusBadRequest)
+		return
+	}
+
+	var script Script
+	switch {
+	case body.LockTime > 0 && body.RelativeLock == 0:
+		script = timeLockLockingScript(body.LockTime, pubKeyHash(pubKey))
+	case body.RelativeLock != 0 && body.LockTime == 0:
+		script = relativeLockLockingScript(body.RelativeLock, pubKeyHash(pubKey))
+	default:
+		http.Error(w, "give either a lock time or a relative lock", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Script Script `json:"script"`
+	}{script})
+}
+
+// addressHandler returns the address of our wallet, the public key
+// co-signers list in multisig addresses
+func addressHandler(w http.ResponseWriter, r *http.Request) {
+	address, err := GetPublicFromWallet()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Address string `json:"address"`
+	}{address})
+}
+
+// addressBalanceHandler returns the balance of an address in the chain and
+// what pool transactions change it by
+func addressBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	if addrIndex == nil {
+		http.Error(w, errAddrIndexOff.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(getAddressBalance(mux.Vars(r)["address"]))
+}
+
+// addressUnspentTxOutsHandler lists the unspent outputs of an address,
+// those of pool transactions included
+func addressUnspentTxOutsHandler(w http.ResponseWriter, r *http.Request) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	if addrIndex == nil {
+		http.Error(w, errAddrIndexOff.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(getAddressUnspentTxOuts(mux.Vars(r)["address"]))
+}
+
+// addressHistoryHandler lists the transactions of an address, newest and
+// pool transactions first. The skip and limit query parameters page
+// through them.
+func addressHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	skip, limit := 0, defaultHistoryLimit
+	var err error
+	if value := r.URL.Query().Get("skip"); value != "" {
+		if skip, err = strconv.Atoi(value); err != nil || skip < 0 {
+			http.Error(w, "bad skip", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxHistoryLimit {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	if addrIndex == nil {
+		http.Error(w, errAddrIndexOff.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(getAddressHistory(mux.Vars(r)["address"], skip, limit))
+}
+
+// multisigAddressHandler creates the address threshold signatures of
+// pubKeys spend
+func multisigAddressHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Threshold int      `json:"threshold"`
+		PubKeys   []string `json:"pubKeys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	address, err := createMultisigAddress(body.Threshold, body.PubKeys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(address)
+}
+
+// createMultisigSpendHandler builds an unsigned spend of the multisig
+// address locked by script and keeps it to collect signatures
+func createMultisigSpendHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Script   Script `json:"script"`
+		Receiver TxOut  `json:"receiver"`
+		Fee      int    `json:"fee"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	address, err := parseMultisigAddress(body.Script)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	spend, err := createMultisigSpend(*address, body.Receiver, body.Fee, getUnspentTxOuts(), getTransactionPool())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	multisigSpends[spend.Transaction.ID] = spend
+	json.NewEncoder(w).Encode(spend)
+}
+
+func multisigSpendHandler(w http.ResponseWriter, r *http.Request) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	spend, ok := multisigSpends[mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, "unknown multisig spend", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(spend)
+}
+
+// multisigSignHandler signs a spend sent by the co-signer collecting the
+// signatures with our wallet, so the spend need not be kept on this node
+func multisigSignHandler(w http.ResponseWriter, r *http.Request) {
+	var spend MultisigSpend
+	if err := json.NewDecoder(r.Body).Decode(&spend); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if getTransactionID(spend.Transaction) != spend.Transaction.ID {
+		http.Error(w, "transaction ID does not match the transaction", http.StatusBadRequest)
+		return
+	}
+
+	wallet, err := GetPrivateFromWallet()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	signatures, err := signMultisigSpend(spend, wallet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(signatures)
+}
+
+func addMultisigSignaturesHandler(w http.ResponseWriter, r *http.Request) {
+	var body MultisigSignatures
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	spend, ok := multisigSpends[mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, "unknown multisig spend", http.StatusNotFound)
+		return
+	}
+	if err := spend.addSignatures(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(spend)
+}
+
+// signMultisigSpendHandler adds the signatures of our wallet to a spend
+// kept on this node
+func signMultisigSpendHandler(w http.ResponseWriter, r *http.Request) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	spend, ok := multisigSpends[mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, "unknown multisig spend", http.StatusNotFound)
+		return
+	}
+
+	wallet, err := GetPrivateFromWallet()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	signatures, err := signMultisigSpend(*spend, wallet)
+	if err == nil {
+		err = spend.addSignatures(*signatures)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(spend)
+}
+
+// broadcastMultisigSpendHandler sends a spend with enough signatures to the
+// pool
+func broadcastMultisigSpendHandler(w http.ResponseWriter, r *http.Request) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	tx, err := broadcastMultisigSpend(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err, http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(tx)
+}
+
 func mineBlock(w http.ResponseWriter, r *http.Request) {
 	// body, err := ioutil.ReadAll(r.Body)
 	// if err != nil {
@@ -62,5 +557,83 @@ func mineBlock(w http.ResponseWriter, r *http.Request) {
 	// 		http.StatusInternalServerError)
 	// }
 	// results := string(body)
-	json.NewEncoder(w).Encode(GenerateNextBlock())
+	block, err := GenerateNextBlock()
+	if err == errMiningCancelled {
+		writeError(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(block)
+}
+
+// blockTemplateHandler returns the template of the next block for a miner
+// outside the node. The coinbase pays the address query parameter, our
+// wallet by default.
+func blockTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		var err error
+		if address, err = GetPublicFromWallet(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	pubKey, err := hex.DecodeString(address)
+	if err == nil {
+		_, err = ParsePubKey(pubKey)
+	}
+	if err != nil {
+		http.Error(w, "bad address", http.StatusBadRequest)
+		return
+	}
+
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	json.NewEncoder(w).Encode(createBlockTemplate(address))
+}
+
+// submitBlockHandler adds a block a miner outside the node solved
+func submitBlockHandler(w http.ResponseWriter, r *http.Request) {
+	var block Block
+	if err := json.NewDecoder(r.Body).Decode(&block); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := submitBlock(block); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(block.Header())
+}
+
+// poolStatsHandler lists the workers of our mining pool and their shares
+func poolStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if miningPool == nil {
+		http.Error(w, errPoolNotRunning.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(miningPool.stats())
+}
+
+func minerStatusHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(struct {
+		Running  bool    `json:"running"`
+		Workers  int     `json:"workers"`
+		Hashrate float64 `json:"hashrate"`
+	}{miner.Running(), miner.workers, miner.Hashrate()})
+}
+
+func startMinerHandler(w http.ResponseWriter, r *http.Request) {
+	miner.Start()
+	minerStatusHandler(w, r)
+}
+
+func stopMinerHandler(w http.ResponseWriter, r *http.Request) {
+	miner.Stop()
+	minerStatusHandler(w, r)
 }
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A small stack language deciding who may spend an output, modelled on
+// Bitcoin script. An input is valid when its unlocking script, which may
+// only push data, followed by the locking script of the output it spends
+// leaves a true value on top of the stack.
+
+// Script is an encoded script
+type Script []byte
+
+const (
+	OP_0         = 0x00
+	OP_PUSHDATA1 = 0x4c
+	OP_PUSHDATA2 = 0x4d
+	OP_1         = 0x51
+	OP_16        = 0x60
+
+	OP_NOP    = 0x61
+	OP_IF     = 0x63
+	OP_NOTIF  = 0x64
+	OP_ELSE   = 0x67
+	OP_ENDIF  = 0x68
+	OP_VERIFY = 0x69
+	OP_RETURN = 0x6a
+
+	OP_DROP = 0x75
+	OP_DUP  = 0x76
+	OP_SWAP = 0x7c
+	OP_SIZE = 0x82
+
+	OP_EQUAL       = 0x87
+	OP_EQUALVERIFY = 0x88
+
+	OP_SHA256              = 0xa8
+	OP_CHECKSIG            = 0xac
+	OP_CHECKSIGVERIFY      = 0xad
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+)
+
+var opcodeNames = map[byte]string{
+	OP_0:                   "OP_0",
+	OP_NOP:                 "OP_NOP",
+	OP_IF:                  "OP_IF",
+	OP_NOTIF:               "OP_NOTIF",
+	OP_ELSE:                "OP_ELSE",
+	OP_ENDIF:               "OP_ENDIF",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_SWAP:                "OP_SWAP",
+	OP_SIZE:                "OP_SIZE",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_SHA256:              "OP_SHA256",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+// resource limits of a script run
+const (
+	maxScriptSize         = 10000
+	maxScriptElementSize  = 520
+	maxStackSize          = 1000
+	maxOpsPerScript       = 201
+	maxPubKeysPerMultisig = 20
+	// lock values below this are block heights, the others timestamps
+	lockTimeThreshold = 500000000
+)
+
+// scriptOp is an opcode of a script along with the data it pushes
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+// parseScript splits script into its operations
+func parseScript(script Script) ([]scriptOp, error) {
+	ops := []scriptOp{}
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+
+		n := 0
+		switch {
+		case opcode > OP_0 && opcode < OP_PUSHDATA1:
+			n = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, errors.New("script ends inside a push length")
+			}
+			n = int(script[i])
+			i++
+		case opcode == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, errors.New("script ends inside a push length")
+			}
+			n = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		}
+		if i+n > len(script) {
+			return nil, errors.New("script ends inside pushed data")
+		}
+
+		ops = append(ops, scriptOp{opcode: opcode, data: script[i : i+n]})
+		i += n
+	}
+	return ops, nil
+}
+
+func (op scriptOp) isPush() bool {
+	return op.opcode <= OP_PUSHDATA2 || (op.opcode >= OP_1 && op.opcode <= OP_16)
+}
+
+// isPushOnly reports whether script does nothing but push data
+func (script Script) isPushOnly() bool {
+	ops, err := parseScript(script)
+	if err != nil {
+		return false
+	}
+	for _, op := range ops {
+		if !op.isPush() {
+			return false
+		}
+	}
+	return true
+}
+
+// String disassembles script, showing pushed data in hex
+func (script Script) String() string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return "[invalid script " + hex.EncodeToString(script) + "]"
+	}
+
+	words := make([]string, len(ops))
+	for i, op := range ops {
+		switch {
+		case op.opcode >= OP_1 && op.opcode <= OP_16:
+			words[i] = fmt.Sprintf("OP_%d", op.opcode-OP_1+1)
+		case op.opcode > OP_0 && op.opcode <= OP_PUSHDATA2:
+			words[i] = hex.EncodeToString(op.data)
+		case opcodeNames[op.opcode] != "":
+			words[i] = opcodeNames[op.opcode]
+		default:
+			words[i] = fmt.Sprintf("OP_UNKNOWN%d", op.opcode)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// MarshalJSON encodes script as hex
+func (script Script) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(script))
+}
+
+// UnmarshalJSON decodes a hex script
+func (script *Script) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*script = b
+	return nil
+}
+
+// scriptBuilder assembles a script
+type scriptBuilder struct {
+	script Script
+}
+
+func (b *scriptBuilder) addOp(opcode byte) *scriptBuilder {
+	b.script = append(b.script, opcode)
+	return b
+}
+
+// addData pushes data with the shortest push operation
+func (b *scriptBuilder) addData(data []byte) *scriptBuilder {
+	switch n := len(data); {
+	case n == 0:
+		b.script = append(b.script, OP_0)
+	case n < OP_PUSHDATA1:
+		b.script = append(b.script, byte(n))
+	case n <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(n))
+	default:
+		b.script = append(b.script, OP_PUSHDATA2, byte(n), byte(n>>8))
+	}
+	b.script = append(b.script, data...)
+	return b
+}
+
+// addInt pushes n, with OP_1 to OP_16 for small numbers
+func (b *scriptBuilder) addInt(n int64) *scriptBuilder {
+	if n >= 1 && n <= 16 {
+		return b.addOp(byte(OP_1 + n - 1))
+	}
+	return b.addData(encodeScriptNum(n))
+}
+
+// encodeScriptNum encodes n little endian with the sign in the top bit of
+// the last byte
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+	b := []byte{}
+	for n > 0 {
+		b = append(b, byte(n))
+		n >>= 8
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		b = append(b, 0)
+	}
+	if negative {
+		b[len(b)-1] |= 0x80
+	}
+	return b
+}
+
+// decodeScriptNum decodes a number of at most maxSize bytes
+func decodeScriptNum(b []byte, maxSize int) (int64, error) {
+	if len(b) > maxSize {
+		return 0, fmt.Errorf("number takes %d bytes, at most %d allowed", len(b), maxSize)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	n := int64(0)
+	for i, v := range b {
+		n |= int64(v) << (8 * uint(i))
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		n &= ^(int64(0x80) << (8 * uint(len(b)-1)))
+		n = -n
+	}
+	return n, nil
+}
+
+func isTrue(v []byte) bool {
+	for i, b := range v {
+		if b != 0 {
+			// negative zero is false
+			return !(i == len(v)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+// scriptContext is what a script can see of the spending transaction
+type scriptContext struct {
+	tx         Transaction
+	inputIndex int
+	spent      UnspentTxOut
+	// the block the transaction goes into
+	at chainContext
+}
+
+// scriptEngine runs scripts on one stack
+type scriptEngine struct {
+	context scriptContext
+	stack   [][]byte
+	ops     int
+}
+
+func (e *scriptEngine) push(v []byte) error {
+	if len(v) > maxScriptElementSize {
+		return fmt.Errorf("pushed %d bytes, at most %d allowed", len(v), maxScriptElementSize)
+	}
+	if len(e.stack) >= maxStackSize {
+		return errors.New("stack overflow")
+	}
+	e.stack = append(e.stack, v)
+	return nil
+}
+
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	v := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return v, nil
+}
+
+func (e *scriptEngine) popInt(maxSize int) (int64, error) {
+	v, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(v, maxSize)
+}
+
+func boolBytes(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+// run executes script on the current stack
+func (e *scriptEngine) run(script Script) error {
+	if len(script) > maxScriptSize {
+		return fmt.Errorf("script takes %d bytes, at most %d allowed", len(script), maxScriptSize)
+	}
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	// whether each enclosing IF branch runs
+	branches := []bool{}
+	executing := func() bool {
+		for _, b := range branches {
+			if !b {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, op := range ops {
+		if !op.isPush() {
+			e.ops++
+			if e.ops > maxOpsPerScript {
+				return fmt.Errorf("more than %d operations", maxOpsPerScript)
+			}
+		}
+
+		switch op.opcode {
+		case OP_IF, OP_NOTIF:
+			run := false
+			if executing() {
+				v, err := e.pop()
+				if err != nil {
+					return err
+				}
+				run = isTrue(v) == (op.opcode == OP_IF)
+			}
+			branches = append(branches, run)
+			continue
+		case OP_ELSE:
+			if len(branches) == 0 {
+				return errors.New("OP_ELSE without OP_IF")
+			}
+			branches[len(branches)-1] = !branches[len(branches)-1]
+			continue
+		case OP_ENDIF:
+			if len(branches) == 0 {
+				return errors.New("OP_ENDIF without OP_IF")
+			}
+			branches = branches[:len(branches)-1]
+			continue
+		}
+
+		if !executing() {
+			continue
+		}
+		if err := e.step(op); err != nil {
+			return err
+		}
+	}
+
+	if len(branches) != 0 {
+		return errors.New("OP_IF without OP_ENDIF")
+	}
+	return nil
+}
+
+// step executes one operation outside of flow control
+func (e *scriptEngine) step(op scriptOp) error {
+	switch {
+	case op.opcode >= OP_1 && op.opcode <= OP_16:
+		return e.push([]byte{op.opcode - OP_1 + 1})
+	case op.isPush():
+		return e.push(append([]byte{}, op.data...))
+	}
+
+	switch op.opcode {
+	case OP_NOP:
+		return nil
+
+	case OP_VERIFY:
+		v, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if !isTrue(v) {
+			return errors.New("OP_VERIFY failed")
+		}
+		return nil
+
+	case OP_RETURN:
+		return errors.New("OP_RETURN")
+
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+
+	case OP_DUP:
+		if len(e.stack) == 0 {
+			return errors.New("stack underflow")
+		}
+		return e.push(e.stack[len(e.stack)-1])
+
+	case OP_SWAP:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.stack = append(e.stack, a, b)
+		return nil
+
+	case OP_SIZE:
+		if len(e.stack) == 0 {
+			return errors.New("stack underflow")
+		}
+		return e.push(encodeScriptNum(int64(len(e.stack[len(e.stack)-1]))))
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if op.opcode == OP_EQUALVERIFY {
+			if !bytes.Equal(a, b) {
+				return errors.New("OP_EQUALVERIFY failed")
+			}
+			return nil
+		}
+		return e.push(boolBytes(bytes.Equal(a, b)))
+
+	case OP_SHA256:
+		v, err := e.pop()
+		if err != nil {
+			return err
+		}
+		h := sha256.Sum256(v)
+		return e.push(h[:])
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := e.pop()
+		if err != nil {
+			return err
+		}
+		ok := e.checkSignature(sig, pubKey)
+		if op.opcode == OP_CHECKSIGVERIFY {
+			if !ok {
+				return errors.New("OP_CHECKSIGVERIFY failed")
+			}
+			return nil
+		}
+		return e.push(boolBytes(ok))
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := e.checkMultisig()
+		if err != nil {
+			return err
+		}
+		if op.opcode == OP_CHECKMULTISIGVERIFY {
+			if !ok {
+				return errors.New("OP_CHECKMULTISIGVERIFY failed")
+			}
+			return nil
+		}
+		return e.push(boolBytes(ok))
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		if len(e.stack) == 0 {
+			return errors.New("stack underflow")
+		}
+		lockTime, err := decodeScriptNum(e.stack[len(e.stack)-1], 5)
+		if err != nil {
+			return err
+		}
+		return checkLockTime(lockTime, e.context.at)
+
+	case OP_CHECKSEQUENCEVERIFY:
+		if len(e.stack) == 0 {
+			return errors.New("stack underflow")
+		}
+		required, err := decodeScriptNum(e.stack[len(e.stack)-1], 5)
+		if err != nil {
+			return err
+		}
+		if required < 0 || required > 0xffffffff {
+			return fmt.Errorf("bad relative lock %d", required)
+		}
+		// the transaction rules hold the input to its relative lock
+		return checkRelativeLockCovers(e.context.tx.TxIns[e.context.inputIndex].RelativeLock, uint32(required))
+	}
+
+	return fmt.Errorf("unknown opcode %d", op.opcode)
+}
+
+// checkLockTime fails unless the block at has reached lockTime, a height
+// or a timestamp
+func checkLockTime(lockTime int64, at chainContext) error {
+	if lockTime < 0 {
+		return errors.New("negative lock time")
+	}
+	if lockTime < lockTimeThreshold {
+		if int64(at.Height) < lockTime {
+			return fmt.Errorf("locked until block %d", lockTime)
+		}
+		return nil
+	}
+	if at.Time < lockTime {
+		return fmt.Errorf("locked until time %d", lockTime)
+	}
+	return nil
+}
+
+func (e *scriptEngine) checkSignature(sig []byte, pubKey []byte) bool {
+	return verifySignature(sig, pubKey, e.context.tx, e.context.inputIndex, e.context.spent)
+}
+
+// checkMultisig pops n keys and m signatures, pushed as OP_m <sig>... then
+// OP_n <key>... by the scripts, and checks that every signature matches one
+// of the keys, in key order
+func (e *scriptEngine) checkMultisig() (bool, error) {
+	n, err := e.popInt(4)
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > maxPubKeysPerMultisig {
+		return false, fmt.Errorf("multisig with %d keys", n)
+	}
+	e.ops += int(n)
+	if e.ops > maxOpsPerScript {
+		return false, fmt.Errorf("more than %d operations", maxOpsPerScript)
+	}
+
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := e.popInt(4)
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, fmt.Errorf("multisig needing %d of %d signatures", m, n)
+	}
+
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if sigs[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	key := 0
+	for _, sig := range sigs {
+		for key < len(pubKeys) && !e.checkSignature(sig, pubKeys[key]) {
+			key++
+		}
+		if key == len(pubKeys) {
+			return false, nil
+		}
+		key++
+	}
+	return true, nil
+}
+
+// verifyScript runs unlocking and then locking on one stack and checks
+// that they leave a true value on top
+func verifyScript(unlocking Script, locking Script, context scriptContext) error {
+	if !unlocking.isPushOnly() {
+		return errors.New("unlocking script does more than push data")
+	}
+
+	e := &scriptEngine{context: context}
+	if err := e.run(unlocking); err != nil {
+		return err
+	}
+	if err := e.run(locking); err != nil {
+		return err
+	}
+
+	if len(e.stack) == 0 || !isTrue(e.stack[len(e.stack)-1]) {
+		return errors.New("script evaluated to false")
+	}
+	return nil
+}
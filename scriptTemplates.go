@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Standard locking scripts and the unlocking scripts that spend them.
+// Outputs paying a plain Address are locked by an implicit pay-to-pubkey
+// script and spent by an implicit push of the input Signature.
+
+// classes of locking scripts
+const (
+	nonStandardScript     = "nonstandard"
+	payToPubKeyScript     = "pubkey"
+	payToPubKeyHashScript = "pubkeyhash"
+	multisigScript        = "multisig"
+	hashLockScript        = "hashlock"
+	timeLockScript        = "timelock"
+	relativeLockScript    = "relativelock"
+)
+
+// pubKeyHash is what pay-to-pubkey-hash scripts lock to
+func pubKeyHash(pubKey []byte) []byte {
+	h := sha256.Sum256(pubKey)
+	return h[:]
+}
+
+// payToPubKeyLockingScript can be spent by a signature of pubKey
+func payToPubKeyLockingScript(pubKey []byte) Script {
+	b := &scriptBuilder{}
+	return b.addData(pubKey).addOp(OP_CHECKSIG).script
+}
+
+// payToPubKeyHashLockingScript can be spent by a signature and the public
+// key hashing to hash
+func payToPubKeyHashLockingScript(hash []byte) Script {
+	b := &scriptBuilder{}
+	return b.addOp(OP_DUP).addOp(OP_SHA256).addData(hash).addOp(OP_EQUALVERIFY).addOp(OP_CHECKSIG).script
+}
+
+// multisigLockingScript can be spent by m signatures of pubKeys
+func multisigLockingScript(m int, pubKeys [][]byte) Script {
+	b := &scriptBuilder{}
+	b.addInt(int64(m))
+	for _, pubKey := range pubKeys {
+		b.addData(pubKey)
+	}
+	return b.addInt(int64(len(pubKeys))).addOp(OP_CHECKMULTISIG).script
+}
+
+// hashLockLockingScript can be spent by the owner of the key hashing to
+// keyHash once they reveal the preimage of hash
+func hashLockLockingScript(hash []byte, keyHash []byte) Script {
+	b := &scriptBuilder{}
+	b.addOp(OP_SHA256).addData(hash).addOp(OP_EQUALVERIFY)
+	b.script = append(b.script, payToPubKeyHashLockingScript(keyHash)...)
+	return b.script
+}
+
+// timeLockLockingScript can be spent by the owner of the key hashing to
+// keyHash from the block height or timestamp lockTime on
+func timeLockLockingScript(lockTime int64, keyHash []byte) Script {
+	b := &scriptBuilder{}
+	b.addInt(lockTime).addOp(OP_CHECKLOCKTIMEVERIFY).addOp(OP_DROP)
+	b.script = append(b.script, payToPubKeyHashLockingScript(keyHash)...)
+	return b.script
+}
+
+// relativeLockLockingScript can be spent by the owner of the key hashing to
+// keyHash once the output has been confirmed for the relative lock lock
+func relativeLockLockingScript(lock uint32, keyHash []byte) Script {
+	b := &scriptBuilder{}
+	b.addInt(int64(lock)).addOp(OP_CHECKSEQUENCEVERIFY).addOp(OP_DROP)
+	b.script = append(b.script, payToPubKeyHashLockingScript(keyHash)...)
+	return b.script
+}
+
+// signatureUnlockingScript spends a pay-to-pubkey or multisig output
+func signatureUnlockingScript(sigs ...[]byte) Script {
+	b := &scriptBuilder{}
+	for _, sig := range sigs {
+		b.addData(sig)
+	}
+	return b.script
+}
+
+// pubKeyHashUnlockingScript spends a pay-to-pubkey-hash, time lock or
+// relative lock output
+func pubKeyHashUnlockingScript(sig []byte, pubKey []byte) Script {
+	b := &scriptBuilder{}
+	return b.addData(sig).addData(pubKey).script
+}
+
+// hashLockUnlockingScript spends a hash lock output
+func hashLockUnlockingScript(sig []byte, pubKey []byte, preimage []byte) Script {
+	b := &scriptBuilder{}
+	return b.addData(sig).addData(pubKey).addData(preimage).script
+}
+
+// lockingScript is the script locking uTxO
+func lockingScript(uTxO UnspentTxOut) Script {
+	if len(uTxO.Script) > 0 {
+		return uTxO.Script
+	}
+
+	pubKey, err := hex.DecodeString(uTxO.Address)
+	if err != nil {
+		return Script{OP_RETURN}
+	}
+	return payToPubKeyLockingScript(pubKey)
+}
+
+// unlockingScript is the script unlocking the output txIn spends
+func unlockingScript(txIn TxIn) Script {
+	if len(txIn.Script) > 0 {
+		return txIn.Script
+	}
+	return signatureUnlockingScript([]byte(txIn.Signature))
+}
+
+func isSmallInt(op scriptOp) bool {
+	return op.opcode >= OP_1 && op.opcode <= OP_16
+}
+
+func smallInt(op scriptOp) int {
+	return int(op.opcode-OP_1) + 1
+}
+
+func isPubKeyPush(op scriptOp) bool {
+	return op.isPush() && len(op.data) == PubKeyBytesLenUncompressed
+}
+
+func isHashPush(op scriptOp) bool {
+	return op.isPush() && len(op.data) == sha256.Size
+}
+
+// matchPayToPubKeyHash reports whether ops are a pay-to-pubkey-hash script
+func matchPayToPubKeyHash(ops []scriptOp) bool {
+	return len(ops) == 5 && ops[0].opcode == OP_DUP && ops[1].opcode == OP_SHA256 &&
+		isHashPush(ops[2]) && ops[3].opcode == OP_EQUALVERIFY && ops[4].opcode == OP_CHECKSIG
+}
+
+// classifyScript returns the class of locking script
+func classifyScript(script Script) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nonStandardScript
+	}
+
+	switch {
+	case len(ops) == 2 && isPubKeyPush(ops[0]) && ops[1].opcode == OP_CHECKSIG:
+		return payToPubKeyScript
+	case matchPayToPubKeyHash(ops):
+		return payToPubKeyHashScript
+	case len(ops) == 8 && ops[0].opcode == OP_SHA256 && isHashPush(ops[1]) &&
+		ops[2].opcode == OP_EQUALVERIFY && matchPayToPubKeyHash(ops[3:]):
+		return hashLockScript
+	case len(ops) == 8 && ops[0].isPush() && len(ops[0].data) <= 5 &&
+		ops[1].opcode == OP_CHECKLOCKTIMEVERIFY && ops[2].opcode == OP_DROP && matchPayToPubKeyHash(ops[3:]):
+		return timeLockScript
+	case len(ops) == 8 && ops[0].isPush() && len(ops[0].data) <= 5 &&
+		ops[1].opcode == OP_CHECKSEQUENCEVERIFY && ops[2].opcode == OP_DROP && matchPayToPubKeyHash(ops[3:]):
+		return relativeLockScript
+	case isMultisig(ops):
+		return multisigScript
+	}
+	return nonStandardScript
+}
+
+func isMultisig(ops []scriptOp) bool {
+	if len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return false
+	}
+	if !isSmallInt(ops[0]) || !isSmallInt(ops[len(ops)-2]) {
+		return false
+	}
+
+	m, n := smallInt(ops[0]), smallInt(ops[len(ops)-2])
+	keys := ops[1 : len(ops)-2]
+	if len(keys) != n || m > n {
+		return false
+	}
+	for _, key := range keys {
+		if !isPubKeyPush(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// scriptInt is the number op pushes
+func scriptInt(op scriptOp) int64 {
+	if isSmallInt(op) {
+		return int64(smallInt(op))
+	}
+	n, _ := decodeScriptNum(op.data, 5)
+	return n
+}
+
+// lockedKeyHash returns the key hash and lock value of a time lock or
+// relative lock script
+func lockedKeyHash(script Script) ([]byte, int64) {
+	ops, _ := parseScript(script)
+	return ops[5].data, scriptInt(ops[0])
+}
+
+// multisigKeyCount returns the number of keys of a multisig script
+func multisigKeyCount(script Script) int {
+	ops, _ := parseScript(script)
+	return smallInt(ops[len(ops)-2])
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// serializationVersion is written in front of every encoded block and
+// transaction. Transactions with scripts are written as scriptTxVersion,
+// which adds a script to every input and output, and transactions with
+// time locks as lockTimeTxVersion, which adds the locks on top. See
+// SERIALIZATION.md for the format.
+const (
+	serializationVersion = 1
+	scriptTxVersion      = 2
+	lockTimeTxVersion    = 3
+	latestTxVersion      = lockTimeTxVersion
+)
+
+var errShortBuffer = errors.New("serialization: unexpected end of data")
+
+// encoder appends the primitive types of the encoding to a buffer
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) int64(v int64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, uint64(v))
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) string(v string) {
+	e.bytes([]byte(v))
+}
+
+// decoder reads the primitive types of the encoding. The first error sticks
+// and every later read returns a zero value.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errShortBuffer
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) int64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	return append([]byte{}, d.next(int(n))...)
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// count reads a list length. Every list item takes at least minItemSize
+// bytes, which bounds the allocation a malformed length can cause.
+func (d *decoder) count(minItemSize int) int {
+	n := int(d.uint32())
+	if d.err == nil && n > len(d.buf)/minItemSize {
+		d.err = errShortBuffer
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) version() {
+	if v := d.uint32(); d.err == nil && v != serializationVersion {
+		d.err = fmt.Errorf("serialization: unsupported version %d", v)
+	}
+}
+
+// txVersion reads the version of a transaction
+func (d *decoder) txVersion() uint32 {
+	v := d.uint32()
+	if d.err == nil && (v < serializationVersion || v > latestTxVersion) {
+		d.err = fmt.Errorf("serialization: unsupported transaction version %d", v)
+	}
+	return v
+}
+
+// transactionVersion is the version tx is encoded as. Unlocking scripts are
+// left out of the ID preimage, so there only locking scripts count, and
+// signing a transaction does not change its ID.
+func transactionVersion(tx Transaction, withSignatures bool) uint32 {
+	if tx.LockTime != 0 {
+		return lockTimeTxVersion
+	}
+	for _, txIn := range tx.TxIns {
+		if txIn.RelativeLock != 0 {
+			return lockTimeTxVersion
+		}
+	}
+
+	for _, txIn := range tx.TxIns {
+		if withSignatures && len(txIn.Script) > 0 {
+			return scriptTxVersion
+		}
+	}
+	for _, txOut := range tx.TxOuts {
+		if len(txOut.Script) > 0 {
+			return scriptTxVersion
+		}
+	}
+	return serializationVersion
+}
+
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = fmt.Errorf("serialization: %d trailing bytes", len(d.buf))
+	}
+	return d.err
+}
+
+// txIn encodes txIn as part of a transaction of version. Without signatures
+// the unlocking script is left empty as well, since it holds signatures.
+func (e *encoder) txIn(txIn TxIn, withSignature bool, version uint32) {
+	e.string(txIn.TxOutID)
+	e.int64(int64(txIn.TxOutIndex))
+	if withSignature {
+		e.string(txIn.Signature)
+	} else {
+		e.string("")
+	}
+	if version >= scriptTxVersion {
+		if withSignature {
+			e.bytes(txIn.Script)
+		} else {
+			e.bytes(nil)
+		}
+	}
+	if version >= lockTimeTxVersion {
+		e.uint32(txIn.RelativeLock)
+	}
+}
+
+func (d *decoder) txIn(version uint32) TxIn {
+	txIn := TxIn{
+		TxOutID:    d.string(),
+		TxOutIndex: int(d.int64()),
+		Signature:  d.string(),
+	}
+	if version >= scriptTxVersion {
+		txIn.Script = d.script()
+	}
+	if version >= lockTimeTxVersion {
+		txIn.RelativeLock = d.uint32()
+	}
+	return txIn
+}
+
+func (e *encoder) txOut(txOut TxOut, version uint32) {
+	e.string(txOut.Address)
+	e.int64(int64(txOut.Amount))
+	if version >= scriptTxVersion {
+		e.bytes(txOut.Script)
+	}
+}
+
+func (d *decoder) txOut(version uint32) TxOut {
+	txOut := TxOut{
+		Address: d.string(),
+		Amount:  int(d.int64()),
+	}
+	if version >= scriptTxVersion {
+		txOut.Script = d.script()
+	}
+	return txOut
+}
+
+// script reads a script, leaving it nil when empty
+func (d *decoder) script() Script {
+	if b := d.bytes(); len(b) > 0 {
+		return b
+	}
+	return nil
+}
+
+const (
+	minTxInSize  = 4 + 8 + 4
+	minTxOutSize = 4 + 8
+	minTxSize    = 4 + 4 + 4
+)
+
+func (e *encoder) transaction(tx Transaction, withSignatures bool) {
+	version := transactionVersion(tx, withSignatures)
+	e.uint32(version)
+	e.uint32(uint32(len(tx.TxIns)))
+	for _, txIn := range tx.TxIns {
+		e.txIn(txIn, withSignatures, version)
+	}
+	e.uint32(uint32(len(tx.TxOuts)))
+	for _, txOut := range tx.TxOuts {
+		e.txOut(txOut, version)
+	}
+	if version >= lockTimeTxVersion {
+		e.int64(tx.LockTime)
+	}
+}
+
+// transaction decodes a transaction and derives its ID
+func (d *decoder) transaction() Transaction {
+	tx := Transaction{}
+	version := d.txVersion()
+	tx.TxIns = make([]TxIn, d.count(minTxInSize))
+	for i := range tx.TxIns {
+		tx.TxIns[i] = d.txIn(version)
+	}
+	tx.TxOuts = make([]TxOut, d.count(minTxOutSize))
+	for i := range tx.TxOuts {
+		tx.TxOuts[i] = d.txOut(version)
+	}
+	if version >= lockTimeTxVersion {
+		tx.LockTime = d.int64()
+	}
+	if d.err == nil {
+		tx.ID = getTransactionID(tx)
+	}
+	return tx
+}
+
+func (e *encoder) blockHeader(header BlockHeader) {
+	e.uint32(serializationVersion)
+	e.int64(int64(header.Index))
+	e.string(header.PreviousHash)
+	e.int64(header.Timestamp)
+	e.string(header.MerkleRoot)
+	e.uint32(header.Bits)
+	e.int64(int64(header.Nonce))
+}
+
+// blockHeader decodes a block header and derives its hash
+func (d *decoder) blockHeader() BlockHeader {
+	header := BlockHeader{}
+	d.version()
+	header.Index = int(d.int64())
+	header.PreviousHash = d.string()
+	header.Timestamp = d.int64()
+	header.MerkleRoot = d.string()
+	header.Bits = d.uint32()
+	header.Nonce = int(d.int64())
+	if d.err == nil {
+		header.Hash = calculateHash(header.Index, header.PreviousHash, header.Timestamp, header.MerkleRoot, header.Bits, header.Nonce)
+	}
+	return header
+}
+
+func (e *encoder) block(block Block) {
+	e.blockHeader(block.Header())
+	e.uint32(uint32(len(block.Data)))
+	for _, tx := range block.Data {
+		e.transaction(tx, true)
+	}
+}
+
+// block decodes a block and derives its hash
+func (d *decoder) block() Block {
+	header := d.blockHeader()
+	block := Block{
+		Index:        header.Index,
+		PreviousHash: header.PreviousHash,
+		Timestamp:    header.Timestamp,
+		MerkleRoot:   header.MerkleRoot,
+		Hash:         header.Hash,
+		Bits:         header.Bits,
+		Nonce:        header.Nonce,
+	}
+	block.Data = make([]Transaction, d.count(minTxSize))
+	for i := range block.Data {
+		block.Data[i] = d.transaction()
+	}
+	return block
+}
+
+// MarshalBinary encodes txIn. On its own a TxIn always has the layout of
+// latestTxVersion.
+func (txIn TxIn) MarshalBinary() ([]byte, error) {
+	e := &encoder{}
+	e.txIn(txIn, true, latestTxVersion)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes a TxIn encoded by MarshalBinary
+func (txIn *TxIn) UnmarshalBinary(data []byte) error {
+	d := &decoder{buf: data}
+	decoded := d.txIn(latestTxVersion)
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*txIn = decoded
+	return nil
+}
+
+// MarshalBinary encodes txOut. On its own a TxOut always has the layout of
+// latestTxVersion.
+func (txOut TxOut) MarshalBinary() ([]byte, error) {
+	e := &encoder{}
+	e.txOut(txOut, latestTxVersion)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes a TxOut encoded by MarshalBinary
+func (txOut *TxOut) UnmarshalBinary(data []byte) error {
+	d := &decoder{buf: data}
+	decoded := d.txOut(latestTxVersion)
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*txOut = decoded
+	return nil
+}
+
+// MarshalBinary encodes tx. The ID is not part of the encoding, it is
+// derived again on decoding.
+func (tx Transaction) MarshalBinary() ([]byte, error) {
+	e := &encoder{}
+	e.transaction(tx, true)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes a Transaction encoded by MarshalBinary
+func (tx *Transaction) UnmarshalBinary(data []byte) error {
+	d := &decoder{buf: data}
+	decoded := d.transaction()
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*tx = decoded
+	return nil
+}
+
+// MarshalBinary encodes header. The hash is not part of the encoding, it is
+// derived again on decoding.
+func (header BlockHeader) MarshalBinary() ([]byte, error) {
+	e := &encoder{}
+	e.blockHeader(header)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes a BlockHeader encoded by MarshalBinary
+func (header *BlockHeader) UnmarshalBinary(data []byte) error {
+	d := &decoder{buf: data}
+	decoded := d.blockHeader()
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*header = decoded
+	return nil
+}
+
+// MarshalBinary encodes block. The hash is not part of the encoding, it is
+// derived again on decoding.
+func (block Block) MarshalBinary() ([]byte, error) {
+	e := &encoder{}
+	e.block(block)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes a Block encoded by MarshalBinary
+func (block *Block) UnmarshalBinary(data []byte) error {
+	d := &decoder{buf: data}
+	decoded := d.block()
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*block = decoded
+	return nil
+}
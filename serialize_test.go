@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The test vectors of SERIALIZATION.md
+
+const (
+	genesisIDPreimage  = "0100000001000000000000000000000000000000000000000100000082000000303462666361623837323239393161653737346462343866393334636137396366623764643939313232393135336239663733326261353333346161666364386537323636653437303736393936623535613134626639393133656533313435636530636663313337326164613861646137346264323837343530333133353334613200000000000000"
+	genesisHeader      = "01000000000000000000000000000000917c5457000000004000000033303964373366316239633439653837303662613862636366636562373238663330656535363966393266393466393634363532363038663763623239306661ffff00210000000000000000"
+	genesisEncoding    = "01000000000000000000000000000000917c5457000000004000000033303964373366316239633439653837303662613862636366636562373238663330656535363966393266393466393634363532363038663763623239306661ffff00210000000000000000010000000100000001000000000000000000000000000000000000000100000082000000303462666361623837323239393161653737346462343866393334636137396366623764643939313232393135336239663733326261353333346161666364386537323636653437303736393936623535613134626639393133656533313435636530636663313337326164613861646137346264323837343530333133353334613200000000000000"
+	signedTxEncoding   = "0100000001000000400000003430366466653531653132393633323232616335373731613065303237636637303133333430656137333762633565633035623134363662663262336431663400000000000000000800000030060201010201010200000004000000303461611e0000000000000004000000303462621400000000000000"
+	signedTxIDPreimage = "010000000100000040000000343036646665353165313239363332323261633537373161306530323763663730313333343065613733376263356563303562313436366266326233643166340000000000000000000000000200000004000000303461611e0000000000000004000000303462621400000000000000"
+)
+
+// vectorSignedTransaction is the signed transaction of the vectors. Its
+// Signature holds the 8 raw bytes, Addresses the hex text of the keys.
+func vectorSignedTransaction() Transaction {
+	tx := Transaction{
+		TxIns:  []TxIn{{TxOutID: genesisTransaction[0].ID, TxOutIndex: 0, Signature: "\x30\x06\x02\x01\x01\x02\x01\x01"}},
+		TxOuts: []TxOut{{Address: "04aa", Amount: 30}, {Address: "04bb", Amount: 20}},
+	}
+	tx.ID = getTransactionID(tx)
+	return tx
+}
+
+func checkEncoding(t *testing.T, what string, got []byte, want string) {
+	t.Helper()
+	if hex.EncodeToString(got) != want {
+		t.Errorf("%s is\n%x\nwant\n%s", what, got, want)
+	}
+}
+
+func checkHash(t *testing.T, what string, got string, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("%s is %s, want %s", what, got, want)
+	}
+}
+
+func idPreimage(tx Transaction) []byte {
+	e := &encoder{}
+	e.transaction(tx, false)
+	return e.buf
+}
+
+func TestGenesisVectors(t *testing.T) {
+	tx := genesisTransaction[0]
+	checkEncoding(t, "genesis ID preimage", idPreimage(tx), genesisIDPreimage)
+	checkHash(t, "genesis ID", getTransactionID(tx), "406dfe51e12963222ac5771a0e027cf7013340ea737bc5ec05b1466bf2b3d1f4")
+
+	header, _ := genesisBlock.Header().MarshalBinary()
+	checkEncoding(t, "genesis header", header, genesisHeader)
+	block, _ := genesisBlock.MarshalBinary()
+	checkEncoding(t, "genesis block", block, genesisEncoding)
+	checkHash(t, "genesis Merkle root", genesisBlock.MerkleRoot, "309d73f1b9c49e8706ba8bccfceb728f30ee569f92f94f964652608f7cb290fa")
+	checkHash(t, "genesis hash", calculateHashForBlock(*genesisBlock), "e13f568f1860aafc932af8e87e8af6db75898256960e357ef06b3c09068316ff")
+	checkHash(t, "pinned genesis hash", genesisBlock.Hash, "e13f568f1860aafc932af8e87e8af6db75898256960e357ef06b3c09068316ff")
+}
+
+func TestSignedTransactionVectors(t *testing.T) {
+	tx := vectorSignedTransaction()
+	b, _ := tx.MarshalBinary()
+	checkEncoding(t, "signed transaction", b, signedTxEncoding)
+	checkEncoding(t, "signed transaction ID preimage", idPreimage(tx), signedTxIDPreimage)
+	checkHash(t, "signed transaction ID", tx.ID, "21853f47e739344678079262a7347ddef09fe493d6fe414e088133c6059925bc")
+	checkHash(t, "signed transaction hash", getTransactionHash(tx), "ad1586c75a5a6133e9e510c2c056f68241e2f244dd6e15c6f0136d265235e34f")
+
+	var decoded Transaction
+	if err := decoded.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TxIns[0].Signature != tx.TxIns[0].Signature || decoded.TxOuts[0].Address != "04aa" {
+		t.Errorf("decoded %v, want %v", decoded, tx)
+	}
+}
+
+func TestMerkleVectors(t *testing.T) {
+	txs := []Transaction{genesisTransaction[0], vectorSignedTransaction(), GetCoinBaseTransaction("04aa", 1, 0)}
+	leaves := []string{
+		"309d73f1b9c49e8706ba8bccfceb728f30ee569f92f94f964652608f7cb290fa",
+		"ad1586c75a5a6133e9e510c2c056f68241e2f244dd6e15c6f0136d265235e34f",
+		"cbffb6d4aa148e16b9b3742beea189c7e85fbe9199c51d59422df89ba2244ce0",
+	}
+	for i, tx := range txs {
+		checkHash(t, "leaf", getTransactionHash(tx), leaves[i])
+	}
+	root := calculateMerkleRoot(txs)
+	checkHash(t, "Merkle root", root, "bfa20a8977a9a5f660ea6b6d645f7ae42bdf7b2f1a4c516c8a79d29e763344cd")
+	for i := range txs {
+		if proof := getMerkleProof(txs, i); !VerifyMerkleProof(*proof, root) {
+			t.Errorf("the proof of leaf %d does not verify", i)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Signature hashes. A signature signs a digest of the transaction that
+// commits to the chain, the input being signed and the output it spends,
+// and to the parts of the transaction the hash type picks. The hash type is
+// appended to the DER signature as one byte. See SERIALIZATION.md for the
+// digest.
+
+// signature hash types
+const (
+	// every input and output
+	sigHashAll = 0x01
+	// every input, no outputs: anyone may send the coins anywhere
+	sigHashNone = 0x02
+	// every input and the output at the index of the signed input
+	sigHashSingle = 0x03
+	// combined with one of the above: only the signed input, so others
+	// can add theirs
+	sigHashAnyoneCanPay = 0x80
+
+	sigHashMask = 0x1f
+)
+
+// isValidHashType reports whether hashType is one of the types above
+func isValidHashType(hashType byte) bool {
+	base := hashType &^ sigHashAnyoneCanPay
+	return base == sigHashAll || base == sigHashNone || base == sigHashSingle
+}
+
+// signatureHash is the digest the signature of input index of transaction,
+// which spends spent, signs with hashType
+func signatureHash(transaction Transaction, index int, spent UnspentTxOut, hashType byte) ([]byte, error) {
+	if !isValidHashType(hashType) {
+		return nil, fmt.Errorf("unknown signature hash type %#x", hashType)
+	}
+	if index < 0 || index >= len(transaction.TxIns) {
+		return nil, fmt.Errorf("transaction has no input %d", index)
+	}
+	if hashType&sigHashMask == sigHashSingle && index >= len(transaction.TxOuts) {
+		return nil, errors.New("SIGHASH_SINGLE input has no matching output")
+	}
+
+	e := &encoder{}
+	e.uint32(chainParams.ChainID)
+	e.uint32(uint32(hashType))
+
+	// the input signed and what it spends
+	txIn := transaction.TxIns[index]
+	e.int64(int64(index))
+	e.string(txIn.TxOutID)
+	e.int64(int64(txIn.TxOutIndex))
+	e.uint32(txIn.RelativeLock)
+	e.int64(int64(spent.Amount))
+	e.bytes(lockingScript(spent))
+
+	if hashType&sigHashAnyoneCanPay == 0 {
+		e.uint32(uint32(len(transaction.TxIns)))
+		for _, txIn := range transaction.TxIns {
+			e.string(txIn.TxOutID)
+			e.int64(int64(txIn.TxOutIndex))
+			e.uint32(txIn.RelativeLock)
+		}
+	}
+
+	switch hashType & sigHashMask {
+	case sigHashAll:
+		e.uint32(uint32(len(transaction.TxOuts)))
+		for _, txOut := range transaction.TxOuts {
+			e.txOut(txOut, latestTxVersion)
+		}
+	case sigHashSingle:
+		e.txOut(transaction.TxOuts[index], latestTxVersion)
+	}
+
+	e.int64(transaction.LockTime)
+
+	hash := sha256.Sum256(e.buf)
+	return hash[:], nil
+}
+
+// splitHashType splits a signature into its DER part and hash type
+func splitHashType(signature []byte) ([]byte, byte, error) {
+	if len(signature) == 0 {
+		return nil, 0, errors.New("empty signature")
+	}
+	return signature[:len(signature)-1], signature[len(signature)-1], nil
+}
+
+// verifySignature checks signature, with its hash type, by pubKey of input
+// index of transaction spending spent
+func verifySignature(signature []byte, pubKey []byte, transaction Transaction, index int, spent UnspentTxOut) bool {
+	der, hashType, err := splitHashType(signature)
+	if err != nil {
+		return false
+	}
+	hash, err := signatureHash(transaction, index, spent, hashType)
+	if err != nil {
+		return false
+	}
+	publicKey, err := ParsePubKey(pubKey)
+	if err != nil {
+		return false
+	}
+	sig, err := parseSig(der)
+	if err != nil {
+		return false
+	}
+	return sig.Verify(hash, publicKey)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+)
+
+// Snapshots of the unspent set. A snapshot holds the unspent set at a block
+// and the headers of the chain up to it, so a new node can start from it
+// instead of replaying every block. A node only loads a snapshot whose hash
+// is pinned in the chain parameters, and checks it by validating the blocks
+// under it in the background, see snapshotValidator.go. SERIALIZATION.md
+// describes the file.
+
+const (
+	snapshotMagic   = "UTXS"
+	snapshotVersion = 1
+	// longest header or output record we read
+	maxSnapshotRecord = 1 << 20
+)
+
+var errCorruptSnapshot = errors.New("corrupt snapshot file")
+
+// SnapshotInfo describes a snapshot
+type SnapshotInfo struct {
+	Height    int    `json:"height"`
+	BlockHash string `json:"blockHash"`
+	Outputs   int64  `json:"outputs"`
+	Hash      string `json:"hash"`
+}
+
+// writeSnapshot writes the snapshot of view, the unspent set at the last of
+// headers, to w. The outputs are written in outpoint order, so the same set
+// always gives the same hash.
+func writeSnapshot(w io.Writer, headers []BlockHeader, view UtxoView) (SnapshotInfo, error) {
+	tip := headers[len(headers)-1]
+	info := SnapshotInfo{Height: tip.Index, BlockHash: tip.Hash}
+
+	points := []outPoint{}
+	view.forEach(func(uTxO UnspentTxOut) bool {
+		points = append(points, outPoint{uTxO.TxOutID, uTxO.TxOutIndex})
+		return true
+	})
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].TxOutID != points[j].TxOutID {
+			return points[i].TxOutID < points[j].TxOutID
+		}
+		return points[i].TxOutIndex < points[j].TxOutIndex
+	})
+	info.Outputs = int64(len(points))
+
+	digest := sha256.New()
+	writer := bufio.NewWriter(io.MultiWriter(w, digest))
+	record := func(payload []byte) {
+		length := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+		writer.Write(length)
+		writer.Write(payload)
+	}
+
+	e := encoder{buf: []byte(snapshotMagic)}
+	e.uint32(snapshotVersion)
+	e.uint32(chainParams.ChainID)
+	e.int64(int64(info.Height))
+	e.string(info.BlockHash)
+	e.uint32(uint32(len(headers)))
+	writer.Write(e.buf)
+	for _, header := range headers {
+		e := encoder{}
+		e.blockHeader(header)
+		record(e.buf)
+	}
+
+	e = encoder{}
+	e.int64(info.Outputs)
+	writer.Write(e.buf)
+	for _, point := range points {
+		uTxO, ok := view.lookup(point)
+		if !ok {
+			return SnapshotInfo{}, fmt.Errorf("output %s:%d left the set while it was written", point.TxOutID, point.TxOutIndex)
+		}
+		record(encodeUnspentTxOut(uTxO))
+	}
+
+	if err := writer.Flush(); err != nil {
+		return SnapshotInfo{}, err
+	}
+	sum := digest.Sum(nil)
+	if _, err := w.Write(sum); err != nil {
+		return SnapshotInfo{}, err
+	}
+	info.Hash = hex.EncodeToString(sum)
+	return info, nil
+}
+
+// snapshotReader reads a snapshot: the header and block headers when it is
+// opened, then the outputs one by one, then the hash
+type snapshotReader struct {
+	reader *bufio.Reader
+	digest hash.Hash
+	// left is the number of outputs not read yet
+	left int64
+	err  error
+
+	Info    SnapshotInfo
+	Headers []BlockHeader
+}
+
+func openSnapshot(r io.Reader) (*snapshotReader, error) {
+	s := &snapshotReader{reader: bufio.NewReader(r), digest: sha256.New()}
+
+	if magic := s.read(len(snapshotMagic)); s.err == nil && string(magic) != snapshotMagic {
+		return nil, errors.New("not a snapshot file")
+	}
+	if version := s.uint32(); s.err == nil && version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d is not supported", version)
+	}
+	if chainID := s.uint32(); s.err == nil && chainID != chainParams.ChainID {
+		return nil, fmt.Errorf("snapshot is of chain %d, we are on %d", chainID, chainParams.ChainID)
+	}
+	s.Info.Height = int(s.int64())
+	s.Info.BlockHash = string(s.record())
+
+	count := int(s.uint32())
+	if s.err == nil && count != s.Info.Height+1 {
+		return nil, errCorruptSnapshot
+	}
+	for i := 0; i < count && s.err == nil; i++ {
+		d := decoder{buf: s.record()}
+		header := d.blockHeader()
+		if err := d.finish(); err != nil && s.err == nil {
+			s.err = errCorruptSnapshot
+		}
+		s.Headers = append(s.Headers, header)
+	}
+
+	s.Info.Outputs = s.int64()
+	s.left = s.Info.Outputs
+	if s.err != nil {
+		return nil, s.err
+	}
+	if tip := s.Headers[len(s.Headers)-1]; tip.Index != s.Info.Height || tip.Hash != s.Info.BlockHash {
+		return nil, errCorruptSnapshot
+	}
+	return s, nil
+}
+
+// read reads n bytes and adds them to the hash. The first error sticks.
+func (s *snapshotReader) read(n int) []byte {
+	if s.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(s.reader, b); err != nil {
+		s.err = errCorruptSnapshot
+		return nil
+	}
+	s.digest.Write(b)
+	return b
+}
+
+func (s *snapshotReader) uint32() uint32 {
+	b := s.read(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (s *snapshotReader) int64() int64 {
+	b := s.read(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (s *snapshotReader) record() []byte {
+	length := s.uint32()
+	if length > maxSnapshotRecord {
+		s.err = errCorruptSnapshot
+		return nil
+	}
+	return s.read(int(length))
+}
+
+// next returns the next output, false once they have all been read or
+// reading failed
+func (s *snapshotReader) next() (UnspentTxOut, bool) {
+	if s.left <= 0 || s.err != nil {
+		return UnspentTxOut{}, false
+	}
+	s.left--
+	payload := s.record()
+	if s.err != nil {
+		return UnspentTxOut{}, false
+	}
+	uTxO, err := decodeUnspentTxOut(payload)
+	if err != nil {
+		s.err = errCorruptSnapshot
+		return UnspentTxOut{}, false
+	}
+	return uTxO, true
+}
+
+// finish checks the file ends with the hash of what was read and returns
+// it. Every output must have been read.
+func (s *snapshotReader) finish() (string, error) {
+	if s.err == nil && s.left != 0 {
+		s.err = errCorruptSnapshot
+	}
+	if s.err != nil {
+		return "", s.err
+	}
+
+	sum := s.digest.Sum(nil)
+	stored := make([]byte, len(sum))
+	if _, err := io.ReadFull(s.reader, stored); err != nil || string(stored) != string(sum) {
+		return "", errCorruptSnapshot
+	}
+	if _, err := s.reader.ReadByte(); err != io.EOF {
+		return "", errCorruptSnapshot
+	}
+	s.Info.Hash = hex.EncodeToString(sum)
+	return s.Info.Hash, nil
+}
+
+// headersOf returns the headers of aBlockchain
+func headersOf(aBlockchain []Block) []BlockHeader {
+	headers := make([]BlockHeader, len(aBlockchain))
+	for i, block := range aBlockchain {
+		headers[i] = block.Header()
+	}
+	return headers
+}
+
+// dumpSnapshot writes the snapshot of the unspent set at height of the
+// current chain to path. The blocks above height are taken off a view of
+// the set with their undo data.
+func dumpSnapshot(path string, height int) (SnapshotInfo, error) {
+	if height < 0 || height >= len(blockchain) {
+		return SnapshotInfo{}, fmt.Errorf("no block at height %d", height)
+	}
+	if validator != nil && validator.status().State != snapshotStateNames[snapshotConfirmed] {
+		return SnapshotInfo{}, errors.New("the snapshot the node started from is not validated yet")
+	}
+
+	view := newUtxoOverlay(utxoDB)
+	for i := len(blockchain) - 1; i > height; i-- {
+		block := blockchain[i]
+		undo, ok := utxoDB.getUndo(block.Hash)
+		if !ok {
+			if err := utxoDB.Err(); err != nil {
+				return SnapshotInfo{}, err
+			}
+			return SnapshotInfo{}, fmt.Errorf("no undo data for block %d", block.Index)
+		}
+		disconnectBlock(block, undo, view).writeTo(view)
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	info, err := writeSnapshot(file, headersOf(blockchain[:height+1]), view)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = utxoDB.Err()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return SnapshotInfo{}, err
+	}
+	return info, nil
+}
+
+// loadSnapshot starts a new node from the snapshot at path. Its hash must be
+// pinned in the chain parameters. The chain becomes the headers of the
+// snapshot, with the unspent set of the snapshot, and the blocks under it
+// are validated in the background.
+func loadSnapshot(path string, utxoCache int) error {
+	if len(blockchain) > 1 {
+		return errors.New("the node has blocks already, a snapshot only starts a new node")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	snapshot, err := openSnapshot(file)
+	if err != nil {
+		return err
+	}
+	checkpoint, ok := chainParams.snapshotAt(snapshot.Info.Height, snapshot.Info.BlockHash)
+	if !ok {
+		return fmt.Errorf("no snapshot is pinned at block %d %s on the %s chain", snapshot.Info.Height, snapshot.Info.BlockHash, chainParams.Name)
+	}
+
+	if snapshot.Headers[0] != genesisBlock.Header() {
+		return errors.New("snapshot does not start at our genesis block")
+	}
+	blocks := []Block{*genesisBlock}
+	for _, header := range snapshot.Headers[1:] {
+		blocks = append(blocks, Block{
+			Index:        header.Index,
+			PreviousHash: header.PreviousHash,
+			Timestamp:    header.Timestamp,
+			MerkleRoot:   header.MerkleRoot,
+			Hash:         header.Hash,
+			Bits:         header.Bits,
+			Nonce:        header.Nonce,
+		})
+	}
+	if err := validateChainUnder(blocks, checkpoint.Height); err != nil {
+		return fmt.Errorf("snapshot headers are invalid: %v", err)
+	}
+
+	// the set has no tip until every output is in, so a node stopped
+	// halfway starts from genesis again
+	if err := utxoDB.reset(); err != nil {
+		return err
+	}
+	for {
+		uTxO, ok := snapshot.next()
+		if !ok {
+			break
+		}
+		utxoDB.add(uTxO)
+		if err := utxoDB.flushIfFull(); err != nil {
+			return err
+		}
+	}
+	sum, err := snapshot.finish()
+	if err == nil && sum != checkpoint.Hash {
+		err = fmt.Errorf("snapshot hash %s does not match the pinned %s", sum, checkpoint.Hash)
+	}
+	if err != nil {
+		utxoDB.resetToGenesis()
+		return err
+	}
+
+	utxoDB.setTip(checkpoint.BlockHash, checkpoint.Height)
+	if err := utxoDB.flush(); err != nil {
+		return err
+	}
+	if blockStore != nil {
+		if err := blockStore.ReplaceBlocks(blocks); err != nil {
+			return err
+		}
+	}
+
+	blockchain = blocks
+	blockTree = newBlockTree(blocks)
+	fmt.Printf("started from the snapshot at block %d: %d unspent outputs\n", checkpoint.Height, snapshot.Info.Outputs)
+
+	return startSnapshotValidation(checkpoint, utxoCache)
+}
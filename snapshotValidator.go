@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Background validation of the snapshot a node started from. The blocks
+// under the snapshot are downloaded from peers and connected from genesis
+// to an unspent set of their own, in a directory of its own next to the
+// chain. At the snapshot block the snapshot of that set must have the
+// pinned hash. The node runs on the snapshot set meanwhile. A peer that
+// sends a body not matching the pinned header is dropped.
+
+const validationDirName = "validation"
+
+const (
+	snapshotValidating = iota
+	snapshotConfirmed
+	snapshotInvalid
+)
+
+var snapshotStateNames = map[int]string{
+	snapshotValidating: "validating",
+	snapshotConfirmed:  "confirmed",
+	snapshotInvalid:    "invalid",
+}
+
+// snapshotValidator validates the blocks under the snapshot at checkpoint
+type snapshotValidator struct {
+	mutex      sync.Mutex
+	checkpoint SnapshotCheckpoint
+	// "" when the set is in memory
+	dir   string
+	db    *UtxoDB
+	state int
+	// why the snapshot was found invalid
+	reason error
+
+	requested map[string]blockRequest
+	received  map[string]receivedBlock
+}
+
+// validator is the background validation of the snapshot the node started
+// from, nil if it started from genesis
+var validator *snapshotValidator
+
+// startSnapshotValidation starts or resumes validating the blocks under the
+// snapshot at checkpoint. The validator runs once validator.run is called.
+func startSnapshotValidation(checkpoint SnapshotCheckpoint, utxoCache int) error {
+	v := &snapshotValidator{
+		checkpoint: checkpoint,
+		requested:  map[string]blockRequest{},
+		received:   map[string]receivedBlock{},
+	}
+
+	if blockStore == nil {
+		v.db = genesisUtxoDB()
+	} else {
+		v.dir = filepath.Join(blockStore.dir, validationDirName)
+		db, err := OpenUtxoDB(v.dir, utxoCache)
+		if err != nil {
+			return err
+		}
+		v.db = db
+		if db.tipHeight < 0 || db.tipHeight > checkpoint.Height || blockchain[db.tipHeight].Hash != db.tipHash {
+			if err := db.resetToGenesis(); err != nil {
+				db.Close()
+				return err
+			}
+		}
+	}
+
+	validator = v
+	fmt.Printf("validating the blocks under the snapshot at block %d from block %d\n", checkpoint.Height, v.db.tipHeight+1)
+	return nil
+}
+
+// resumeSnapshotValidation resumes validating the snapshot aBlockchain, our
+// stored chain, was started from, if it has not been confirmed yet
+func resumeSnapshotValidation(aBlockchain []Block, utxoCache int) error {
+	checkpoint, ok := chainParams.snapshotOn(aBlockchain)
+	if !ok {
+		return nil
+	}
+	pending := blockStore != nil && fileExists(filepath.Join(blockStore.dir, validationDirName))
+	for _, block := range aBlockchain[:checkpoint.Height+1] {
+		if !block.hasBody() {
+			pending = true
+			break
+		}
+	}
+	if !pending {
+		return nil
+	}
+	return startSnapshotValidation(checkpoint, utxoCache)
+}
+
+// handleBlocks takes the blocks under the snapshot we asked c for
+func (v *snapshotValidator) handleBlocks(c *Client, blocks []Block) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.state != snapshotValidating {
+		return
+	}
+
+	for _, block := range blocks {
+		if request, ok := v.requested[block.Hash]; ok && request.peer == c {
+			delete(v.requested, block.Hash)
+			v.received[block.Hash] = receivedBlock{block: block, peer: c}
+		}
+	}
+	v.advance()
+	v.requestBlocks()
+}
+
+// advance connects the blocks that are next in line and, past the last
+// one, checks the snapshot
+func (v *snapshotValidator) advance() {
+	for v.state == snapshotValidating && v.db.Err() == nil {
+		height := v.db.tipHeight + 1
+		if height > v.checkpoint.Height {
+			v.finish()
+			return
+		}
+
+		chainMutex.Lock()
+		connected, err := v.connect(height)
+		chainMutex.Unlock()
+
+		if err != nil {
+			if asRuleError(err) == nil {
+				// our files failed us, not the snapshot
+				fmt.Println("snapshot validation stopped:", err)
+				return
+			}
+			v.fail(err)
+			return
+		}
+		if !connected {
+			return
+		}
+	}
+}
+
+// connect connects the block at height if we have its body, and stores the
+// body if it came from a peer. The caller holds chainMutex.
+func (v *snapshotValidator) connect(height int) (bool, error) {
+	block := blockchain[height]
+	downloaded := !block.hasBody()
+	if downloaded {
+		received, ok := v.received[block.Hash]
+		if !ok {
+			return false, nil
+		}
+		delete(v.received, block.Hash)
+
+		body := received.block
+		if body.Header() != block.Header() || checkMerkleRoot(body, nil) != nil {
+			// the header is pinned by the snapshot, so the peer sent
+			// transactions of another block; drop it and ask again
+			if received.peer != nil {
+				received.peer.drop(fmt.Sprintf("it sent a wrong body for block %d", height))
+			}
+			return false, nil
+		}
+		block = body
+	}
+
+	err := validateNewBlock(block, blockchain[:height])
+	var changes *utxoOverlay
+	if err == nil {
+		changes, _, err = connectBlock(block, blockchain[height-1], v.db)
+	}
+	if err != nil {
+		if dbErr := v.db.Err(); dbErr != nil {
+			return false, dbErr
+		}
+		// the Merkle root commits to the whole body, signatures too, so a
+		// body that matches it and breaks the rules is the pinned block
+		return false, err
+	}
+
+	if downloaded {
+		if blockStore != nil {
+			if err := blockStore.PutBody(block); err != nil {
+				return false, err
+			}
+		}
+		blockchain[height] = block
+		if node, ok := blockTree.nodes[block.Hash]; ok {
+			node.block = block
+		}
+	}
+
+	changes.writeTo(v.db)
+	v.db.setTip(block.Hash, height)
+	return true, v.db.flushIfFull()
+}
+
+// finish compares the snapshot of the validated set with the pinned hash
+func (v *snapshotValidator) finish() {
+	chainMutex.Lock()
+	headers := headersOf(blockchain[:v.checkpoint.Height+1])
+	chainMutex.Unlock()
+
+	info, err := writeSnapshot(io.Discard, headers, v.db)
+	if err == nil {
+		err = v.db.Err()
+	}
+	if err != nil {
+		fmt.Println("snapshot validation stopped:", err)
+		return
+	}
+	if info.Hash != v.checkpoint.Hash {
+		v.fail(fmt.Errorf("the unspent set at block %d hashes to %s, the snapshot to %s", v.checkpoint.Height, info.Hash, v.checkpoint.Hash))
+		return
+	}
+
+	v.state = snapshotConfirmed
+	v.db.Close()
+	if v.dir != "" {
+		if err := os.RemoveAll(v.dir); err != nil {
+			fmt.Println("cannot remove the validation set:", err)
+		}
+	}
+	fmt.Printf("validated every block under the snapshot at block %d, the snapshot is confirmed\n", v.checkpoint.Height)
+}
+
+// fail marks the snapshot invalid. The chain past it cannot be trusted.
+func (v *snapshotValidator) fail(err error) {
+	v.state = snapshotInvalid
+	v.reason = err
+	v.requested = map[string]blockRequest{}
+	v.received = map[string]receivedBlock{}
+	fmt.Printf("the snapshot at block %d is invalid: %v\n", v.checkpoint.Height, err)
+	fmt.Println("the chain after it cannot be trusted, start again from an empty data directory")
+}
+
+// requestBlocks asks idle peers for the missing bodies of the next blocks
+func (v *snapshotValidator) requestBlocks() {
+	if v.state != snapshotValidating {
+		return
+	}
+	peers := syncer.peerList()
+
+	inFlight := map[*Client]int{}
+	for _, request := range v.requested {
+		inFlight[request.peer]++
+	}
+
+	start := v.db.tipHeight + 1
+	end := start + blockDownloadWindow
+	if end > v.checkpoint.Height+1 {
+		end = v.checkpoint.Height + 1
+	}
+	missing := []string{}
+	chainMutex.Lock()
+	for _, block := range blockchain[start:end] {
+		if block.hasBody() {
+			continue
+		}
+		if _, ok := v.requested[block.Hash]; ok {
+			continue
+		}
+		if _, ok := v.received[block.Hash]; ok {
+			continue
+		}
+		missing = append(missing, block.Hash)
+	}
+	chainMutex.Unlock()
+
+	for len(missing) > 0 {
+		var peer *Client
+		for _, c := range peers {
+			if inFlight[c] < maxRequestsPerPeer*blocksPerRequest && (peer == nil || inFlight[c] < inFlight[peer]) {
+				peer = c
+			}
+		}
+		if peer == nil {
+			return
+		}
+
+		batch := missing
+		if len(batch) > blocksPerRequest {
+			batch = batch[:blocksPerRequest]
+		}
+		missing = missing[len(batch):]
+		for _, hash := range batch {
+			v.requested[hash] = blockRequest{peer: peer, at: time.Now()}
+		}
+		inFlight[peer] += len(batch)
+		peer.sendMesssage(queryBlocksMsg(batch))
+	}
+}
+
+// run validates the blocks we have and keeps asking peers for the others,
+// retrying requests they did not answer in time, until the snapshot is
+// confirmed or found invalid
+func (v *snapshotValidator) run() {
+	ticker := time.NewTicker(syncRequestTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		v.mutex.Lock()
+		for hash, request := range v.requested {
+			if time.Since(request.at) > syncRequestTimeout {
+				delete(v.requested, hash)
+			}
+		}
+		v.advance()
+		v.requestBlocks()
+		done := v.state != snapshotValidating
+		v.mutex.Unlock()
+
+		if done {
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// close writes out the validation set
+func (v *snapshotValidator) close() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.state == snapshotConfirmed {
+		return nil
+	}
+	return v.db.Close()
+}
+
+// SnapshotStatus is the progress of validating the snapshot the node
+// started from
+type SnapshotStatus struct {
+	State           string `json:"state"`
+	Height          int    `json:"height,omitempty"`
+	BlockHash       string `json:"blockHash,omitempty"`
+	ValidatedHeight int    `json:"validatedHeight,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+}
+
+func (v *snapshotValidator) status() SnapshotStatus {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	status := SnapshotStatus{
+		State:           snapshotStateNames[v.state],
+		Height:          v.checkpoint.Height,
+		BlockHash:       v.checkpoint.BlockHash,
+		ValidatedHeight: v.db.tipHeight,
+	}
+	if v.reason != nil {
+		status.Reason = v.reason.Error()
+	}
+	return status
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+// useTestChain runs the test on a chain of only the genesis block of
+// params, held in memory, and puts the node back afterwards. The caller
+// does not hold chainMutex.
+func useTestChain(t *testing.T, params *ChainParams) {
+	savedParams, savedChain, savedTree, savedStore, savedDB, savedPool := chainParams, blockchain, blockTree, blockStore, utxoDB, mempool
+	chainParams = params
+	blockchain = []Block{*genesisBlock}
+	blockTree = newBlockTree(blockchain)
+	blockStore = nil
+	utxoDB = genesisUtxoDB()
+	mempool = newMempool(defaultMaxMempool, defaultMempoolExpiry)
+	t.Cleanup(func() {
+		utxoDB.Close()
+		chainParams, blockchain, blockTree, blockStore, utxoDB, mempool = savedParams, savedChain, savedTree, savedStore, savedDB, savedPool
+	})
+}
+
+// TestRegtestSnapshot builds the regtest snapshot chain and checks the
+// snapshots regtest pins are of it
+func TestRegtestSnapshot(t *testing.T) {
+	useTestChain(t, &regTestParams)
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	if len(regTestParams.Snapshots) == 0 {
+		t.Fatal("regtest pins no snapshot")
+	}
+	for _, checkpoint := range regTestParams.Snapshots {
+		if err := genRegtestChain(checkpoint.Height); err != nil {
+			t.Fatal(err)
+		}
+		block := blockchain[checkpoint.Height]
+		if block.Hash != checkpoint.BlockHash {
+			t.Errorf("block %d is %s, %s is pinned", checkpoint.Height, block.Hash, checkpoint.BlockHash)
+		}
+		info, err := writeSnapshot(io.Discard, headersOf(blockchain[:checkpoint.Height+1]), utxoDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Hash != checkpoint.Hash {
+			t.Errorf("the snapshot at block %d hashes to %s, %s is pinned", checkpoint.Height, info.Hash, checkpoint.Hash)
+		}
+	}
+}
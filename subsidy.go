@@ -0,0 +1,69 @@
+package main
+
+// Issuance. Every block may pay its miner a subsidy that starts at
+// InitialSubsidy and halves every HalvingInterval blocks, until the coins
+// issued reach MaxSupply. The genesis block counts as the first block.
+
+// rawSubsidy is the subsidy of the block at height before the supply cap
+func rawSubsidy(height int) int {
+	if chainParams.HalvingInterval == 0 {
+		return chainParams.InitialSubsidy
+	}
+	halvings := height / chainParams.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return chainParams.InitialSubsidy >> uint(halvings)
+}
+
+// issuedBefore is the number of coins the blocks below height issue, before
+// the supply cap
+func issuedBefore(height int) int {
+	if chainParams.HalvingInterval == 0 {
+		return chainParams.InitialSubsidy * height
+	}
+
+	issued := 0
+	for start := 0; start < height; start += chainParams.HalvingInterval {
+		subsidy := rawSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+		blocks := chainParams.HalvingInterval
+		if height-start < blocks {
+			blocks = height - start
+		}
+		issued += subsidy * blocks
+	}
+	return issued
+}
+
+// blockSubsidy is what the block at height may pay its miner on top of the
+// fees
+func blockSubsidy(height int) int {
+	subsidy := rawSubsidy(height)
+	if chainParams.MaxSupply == 0 {
+		return subsidy
+	}
+
+	left := chainParams.MaxSupply - issuedBefore(height)
+	if left <= 0 {
+		return 0
+	}
+	if subsidy > left {
+		return left
+	}
+	return subsidy
+}
+
+// isCoinbase reports whether transaction is a coinbase, which spends
+// nothing
+func isCoinbase(transaction Transaction) bool {
+	return len(transaction.TxIns) == 1 && transaction.TxIns[0].TxOutID == ""
+}
+
+// isMature reports whether uTxO can be spent in the block at. Coinbase
+// outputs must be CoinbaseMaturity blocks deep first.
+func isMature(uTxO UnspentTxOut, at chainContext) bool {
+	return !uTxO.Coinbase || at.Height-uTxO.Height >= chainParams.CoinbaseMaturity
+}
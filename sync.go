@@ -0,0 +1,492 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Headers-first synchronization. We first download the headers of a peer's
+// chain and check that they link up and meet their targets. Only when the
+// headers hold more work than our chain are the block bodies fetched, in
+// batches spread over every connected peer, and connected in order.
+
+const (
+	// most headers sent in one message
+	maxHeadersPerMessage = 500
+	// most blocks asked for in one message
+	blocksPerRequest = 16
+	// most block requests in flight to one peer
+	maxRequestsPerPeer = 4
+	// how far past the last connected block bodies are fetched
+	blockDownloadWindow = 256
+	// how long a peer has to answer before its request goes to another one
+	syncRequestTimeout = 30 * time.Second
+)
+
+const (
+	syncIdle = iota
+	syncHeaders
+	syncBlocks
+)
+
+var syncStateNames = map[int]string{
+	syncIdle:    "idle",
+	syncHeaders: "headers",
+	syncBlocks:  "blocks",
+}
+
+type blockRequest struct {
+	peer *Client
+	at   time.Time
+}
+
+// syncManager drives synchronization with the connected peers
+type syncManager struct {
+	mutex sync.Mutex
+	peers map[*Client]bool
+
+	state      int
+	headerPeer *Client
+	headerAt   time.Time
+
+	// validated headers past our chain, in chain order, and their total work
+	headers    []BlockHeader
+	headerWork *big.Int
+	// how many of headers have been connected
+	connected int
+
+	requested map[string]blockRequest
+	received  map[string]receivedBlock
+
+	// sends to peers queued while mutex is held, made once it is released
+	outbox []func()
+}
+
+type receivedBlock struct {
+	block Block
+	peer  *Client
+}
+
+func newSyncManager() *syncManager {
+	s := &syncManager{peers: map[*Client]bool{}}
+	s.reset()
+	return s
+}
+
+var syncer = newSyncManager()
+
+func (s *syncManager) reset() {
+	s.state = syncIdle
+	s.headerPeer = nil
+	s.headers = nil
+	s.headerWork = nil
+	s.connected = 0
+	s.requested = map[string]blockRequest{}
+	s.received = map[string]receivedBlock{}
+}
+
+// unlock releases mutex, then sends what was queued while it was held. A
+// peer is never sent to under the lock, so a slow or gone one cannot hold
+// up the others.
+func (s *syncManager) unlock() {
+	outbox := s.outbox
+	s.outbox = nil
+	s.mutex.Unlock()
+
+	for _, send := range outbox {
+		send()
+	}
+}
+
+// send queues message for c until mutex is released
+func (s *syncManager) send(c *Client, message Message) {
+	s.outbox = append(s.outbox, func() { c.sendMesssage(message) })
+}
+
+func (s *syncManager) addPeer(c *Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.peers[c] = true
+}
+
+// peerList returns the connected peers
+func (s *syncManager) peerList() []*Client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	peers := make([]*Client, 0, len(s.peers))
+	for c := range s.peers {
+		peers = append(peers, c)
+	}
+	return peers
+}
+
+// removePeer forgets c. Its block requests go to other peers.
+func (s *syncManager) removePeer(c *Client) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	delete(s.peers, c)
+	if s.headerPeer == c && s.state == syncHeaders {
+		s.reset()
+		return
+	}
+	for hash, request := range s.requested {
+		if request.peer == c {
+			delete(s.requested, hash)
+		}
+	}
+	s.requestBlocks()
+}
+
+// start begins to sync with c unless a sync is already running
+func (s *syncManager) start(c *Client) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if s.state != syncIdle {
+		return
+	}
+	s.startWith(c)
+}
+
+func (s *syncManager) startWith(c *Client) {
+	chainMutex.Lock()
+	locator := getBlockLocator(GetBlockchain())
+	chainMutex.Unlock()
+
+	fmt.Println("syncing headers from peer", c.conn.RemoteAddr())
+	s.state = syncHeaders
+	s.headerPeer = c
+	s.requestHeaders(locator)
+}
+
+func (s *syncManager) requestHeaders(locator []string) {
+	s.headerAt = time.Now()
+	s.send(s.headerPeer, queryHeadersMsg(locator))
+}
+
+// handleHeaders checks a batch of headers from c and either asks for more
+// or, once the peer has no more, starts downloading blocks. Headers we did
+// not ask for announce new blocks of c, and start a sync with it if we do
+// not have them.
+func (s *syncManager) handleHeaders(c *Client, headers []BlockHeader) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if s.state == syncIdle {
+		chainMutex.Lock()
+		unknown := false
+		for _, header := range headers {
+			unknown = unknown || !blockTree.hasBlock(header.Hash)
+		}
+		chainMutex.Unlock()
+		if unknown {
+			s.startWith(c)
+		}
+		return
+	}
+	if s.state != syncHeaders || c != s.headerPeer {
+		return
+	}
+
+	if err := s.appendHeaders(headers); err != nil {
+		fmt.Println("sync aborted, invalid headers:", err)
+		if rejected, ok := err.(*headerRejectedError); ok {
+			s.outbox = append(s.outbox, func() { c.sendReject("block", rejected.Hash, rejected.Reason) })
+		}
+		s.reset()
+		return
+	}
+
+	if len(headers) == maxHeadersPerMessage {
+		s.requestHeaders([]string{s.headers[len(s.headers)-1].Hash})
+		return
+	}
+
+	chainMutex.Lock()
+	ourWork := blockTree.nodes[GetLatestBlock().Hash].work
+	chainMutex.Unlock()
+
+	if len(s.headers) == 0 || s.headerWork.Cmp(ourWork) <= 0 {
+		fmt.Println("peer chain has no more work than ours")
+		s.reset()
+		return
+	}
+
+	fmt.Printf("got %d headers, downloading blocks\n", len(s.headers))
+	s.state = syncBlocks
+	s.requestBlocks()
+}
+
+// appendHeaders checks that headers continue the headers we have, or a
+// block we know if we have none, and that each one meets its target
+func (s *syncManager) appendHeaders(headers []BlockHeader) error {
+	for _, header := range headers {
+		if err := checkBlockHeader(header); err != nil {
+			return &headerRejectedError{Hash: header.Hash, Reason: asRuleError(err)}
+		}
+
+		if len(s.headers) == 0 {
+			chainMutex.Lock()
+			if blockTree.hasBlock(header.Hash) {
+				chainMutex.Unlock()
+				continue
+			}
+			parent, ok := blockTree.nodes[header.PreviousHash]
+			var parentWork *big.Int
+			if ok {
+				parentWork = new(big.Int).Set(parent.work)
+			}
+			chainMutex.Unlock()
+
+			if !ok || parent.block.Index+1 != header.Index {
+				return fmt.Errorf("header %d does not connect to our chain", header.Index)
+			}
+			s.headerWork = parentWork
+		} else {
+			previous := s.headers[len(s.headers)-1]
+			if previous.Hash != header.PreviousHash || previous.Index+1 != header.Index {
+				return fmt.Errorf("header %d does not connect to the previous header", header.Index)
+			}
+		}
+
+		s.headers = append(s.headers, header)
+		s.headerWork.Add(s.headerWork, calcWork(header.Bits))
+	}
+
+	return nil
+}
+
+// headerRejectedError is returned when a header breaks a consensus rule
+type headerRejectedError struct {
+	Hash   string
+	Reason *RuleError
+}
+
+func (e *headerRejectedError) Error() string {
+	return e.Reason.Error()
+}
+
+// requestBlocks asks idle peers for the next missing blocks in the window
+func (s *syncManager) requestBlocks() {
+	if s.state != syncBlocks {
+		return
+	}
+
+	inFlight := map[*Client]int{}
+	for _, request := range s.requested {
+		inFlight[request.peer]++
+	}
+
+	end := s.connected + blockDownloadWindow
+	if end > len(s.headers) {
+		end = len(s.headers)
+	}
+
+	batch := []string{}
+	flush := func() bool {
+		var peer *Client
+		for c := range s.peers {
+			if inFlight[c] < maxRequestsPerPeer*blocksPerRequest && (peer == nil || inFlight[c] < inFlight[peer]) {
+				peer = c
+			}
+		}
+		if peer == nil {
+			return false
+		}
+
+		for _, hash := range batch {
+			s.requested[hash] = blockRequest{peer: peer, at: time.Now()}
+		}
+		inFlight[peer] += len(batch)
+		s.send(peer, queryBlocksMsg(batch))
+		batch = []string{}
+		return true
+	}
+
+	for _, header := range s.headers[s.connected:end] {
+		if _, ok := s.requested[header.Hash]; ok {
+			continue
+		}
+		if _, ok := s.received[header.Hash]; ok {
+			continue
+		}
+		batch = append(batch, header.Hash)
+		if len(batch) == blocksPerRequest && !flush() {
+			return
+		}
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+}
+
+// handleBlocks takes blocks we asked for and connects every block that is
+// next in line
+func (s *syncManager) handleBlocks(c *Client, blocks []Block) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if s.state != syncBlocks {
+		return
+	}
+
+	for _, block := range blocks {
+		if request, ok := s.requested[block.Hash]; ok && request.peer == c {
+			delete(s.requested, block.Hash)
+			s.received[block.Hash] = receivedBlock{block: block, peer: c}
+		}
+	}
+
+	for s.connected < len(s.headers) {
+		header := s.headers[s.connected]
+		received, ok := s.received[header.Hash]
+		if !ok {
+			break
+		}
+		delete(s.received, header.Hash)
+
+		chainMutex.Lock()
+		err := addBlockToChain(received.block)
+		chainMutex.Unlock()
+
+		if err != nil {
+			fmt.Printf("sync aborted, block %d was rejected: %v\n", received.block.Index, err)
+			if ruleErr := asRuleError(err); ruleErr != nil && s.peers[received.peer] {
+				peer, hash := received.peer, received.block.Hash
+				s.outbox = append(s.outbox, func() { peer.rejectBlock(hash, ruleErr) })
+			}
+			s.reset()
+			return
+		}
+		s.connected++
+	}
+
+	if s.connected == len(s.headers) {
+		fmt.Printf("sync done, %d blocks connected\n", s.connected)
+		s.reset()
+		return
+	}
+
+	s.requestBlocks()
+}
+
+// run retries requests that peers did not answer in time
+func (s *syncManager) run() {
+	ticker := time.NewTicker(syncRequestTimeout / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mutex.Lock()
+		switch s.state {
+		case syncHeaders:
+			if time.Since(s.headerAt) > syncRequestTimeout {
+				fmt.Println("sync aborted, peer did not send headers")
+				s.reset()
+			}
+		case syncBlocks:
+			for hash, request := range s.requested {
+				if time.Since(request.at) > syncRequestTimeout {
+					delete(s.requested, hash)
+				}
+			}
+			s.requestBlocks()
+		}
+		s.unlock()
+	}
+}
+
+// announce sends the header of block, which we connected without a peer
+// sending it, to every peer. The caller does not hold chainMutex.
+func (s *syncManager) announce(block Block) {
+	message := headersMsg([]BlockHeader{block.Header()})
+	for _, c := range s.peerList() {
+		c.sendMesssage(message)
+	}
+}
+
+// SyncStatus is the progress of synchronization
+type SyncStatus struct {
+	State          string  `json:"state"`
+	Peers          int     `json:"peers"`
+	Height         int     `json:"height"`
+	HeaderHeight   int     `json:"headerHeight"`
+	BlocksInFlight int     `json:"blocksInFlight"`
+	Progress       float64 `json:"progress"`
+}
+
+func (s *syncManager) status() SyncStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	chainMutex.Lock()
+	height := GetLatestBlock().Index
+	chainMutex.Unlock()
+
+	status := SyncStatus{
+		State:          syncStateNames[s.state],
+		Peers:          len(s.peers),
+		Height:         height,
+		HeaderHeight:   height,
+		BlocksInFlight: len(s.requested),
+		Progress:       1,
+	}
+	if len(s.headers) > 0 {
+		status.HeaderHeight = s.headers[len(s.headers)-1].Index
+		status.Progress = float64(s.connected) / float64(len(s.headers))
+	}
+
+	return status
+}
+
+// getBlockLocator lists hashes of aBlockchain from the tip back to genesis,
+// one by one for the last ten blocks and then doubling the step, so a peer
+// can find where our chains fork in a single message
+func getBlockLocator(aBlockchain []Block) []string {
+	locator := []string{}
+	step := 1
+	for index := len(aBlockchain) - 1; index > 0; index -= step {
+		locator = append(locator, aBlockchain[index].Hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, aBlockchain[0].Hash)
+}
+
+// getHeadersAfter returns the headers of our chain following the first
+// locator hash that is on it
+func getHeadersAfter(locator []string) []BlockHeader {
+	start := 0
+	for _, hash := range locator {
+		if node, ok := blockTree.nodes[hash]; ok && node.block.Index < len(blockchain) && blockchain[node.block.Index].Hash == hash {
+			start = node.block.Index + 1
+			break
+		}
+	}
+
+	headers := []BlockHeader{}
+	for index := start; index < len(blockchain) && len(headers) < maxHeadersPerMessage; index++ {
+		headers = append(headers, blockchain[index].Header())
+	}
+	return headers
+}
+
+// getBlocksByHash returns the blocks we have among hashes. The blocks under
+// a snapshot we have not downloaded yet are left out.
+func getBlocksByHash(hashes []string) []Block {
+	blocks := []Block{}
+	for _, hash := range hashes {
+		if node, ok := blockTree.nodes[hash]; ok && node.block.hasBody() {
+			blocks = append(blocks, node.block)
+		}
+		if len(blocks) == blocksPerRequest {
+			break
+		}
+	}
+	return blocks
+}
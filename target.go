@@ -0,0 +1,82 @@
+package main
+
+import "math/big"
+
+// Targets are 256-bit numbers a block hash must not exceed. Blocks carry
+// them in the compact "bits" form: the high byte is the length of the
+// target in bytes and the low three bytes are its most significant bytes.
+
+// powLimitBits is the easiest target allowed, which nearly every hash meets
+const powLimitBits uint32 = 0x2100ffff
+
+var powLimit = compactToBig(powLimitBits)
+
+// compactToBig expands compact bits into the target they stand for
+func compactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+
+	if isNegative {
+		target = target.Neg(target)
+	}
+
+	return target
+}
+
+// bigToCompact packs target into compact bits, dropping everything below
+// its three most significant bytes
+func bigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(new(big.Int).Abs(target).Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		shifted := new(big.Int).Abs(target)
+		mantissa = uint32(shifted.Rsh(shifted, 8*(exponent-3)).Uint64())
+	}
+
+	// the sign bit is taken, so move a mantissa that would set it one byte down
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if target.Sign() < 0 {
+		compact |= 0x00800000
+	}
+
+	return compact
+}
+
+// calcWork is the expected number of hashes needed to meet the target of
+// bits, 2^256 / (target + 1)
+func calcWork(bits uint32) *big.Int {
+	return targetWork(compactToBig(bits))
+}
+
+// targetWork is the expected number of hashes it takes to find one not
+// exceeding target
+func targetWork(target *big.Int) *big.Int {
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
@@ -18,16 +18,23 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
+	"encoding/json"
 
 	"math/big"
 )
 
+// UnspentTxOut is an output nobody has spent yet. Height and Time are the
+// chainContext of the block that confirmed it, which relative locks and
+// coinbase maturity count from.
 type UnspentTxOut struct {
 	TxOutID    string
 	TxOutIndex int
 	Address    string
 	Amount     int
+	Script     Script `json:",omitempty"`
+	Height     int
+	Time       int64
+	Coinbase   bool `json:",omitempty"`
 }
 
 func generageUnspentTxOut(txOutID string, txOutIndex int, address string, amount int) *UnspentTxOut {
@@ -39,64 +46,108 @@ func generageUnspentTxOut(txOutID string, txOutIndex int, address string, amount
 	}
 }
 
+// TxIn spends an output. Outputs paying an Address are unlocked by a
+// Signature, the raw DER signature followed by its hash type, outputs with
+// a locking script by an unlocking Script. A RelativeLock keeps the input
+// out of blocks until the output is old enough, see lockTime.go.
 type TxIn struct {
-	TxOutID    string
-	TxOutIndex int
-	Signature  string
+	TxOutID      string
+	TxOutIndex   int
+	Signature    string
+	Script       Script `json:",omitempty"`
+	RelativeLock uint32 `json:",omitempty"`
+}
+
+// MarshalJSON encodes txIn with its Signature in hex, like a Script, since
+// the signature bytes are not text
+func (txIn TxIn) MarshalJSON() ([]byte, error) {
+	type plainTxIn TxIn
+	return json.Marshal(struct {
+		plainTxIn
+		Signature string
+	}{plainTxIn(txIn), hex.EncodeToString([]byte(txIn.Signature))})
+}
+
+// UnmarshalJSON decodes a txIn with a hex Signature
+func (txIn *TxIn) UnmarshalJSON(data []byte) error {
+	type plainTxIn TxIn
+	var decoded struct {
+		plainTxIn
+		Signature string
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	signature, err := hex.DecodeString(decoded.Signature)
+	if err != nil {
+		return err
+	}
+	*txIn = TxIn(decoded.plainTxIn)
+	txIn.Signature = string(signature)
+	return nil
 }
 
+// TxOut pays Amount either to an Address, a public key in hex, or to whoever
+// can satisfy a locking Script
 type TxOut struct {
 	Address string
 	Amount  int
+	Script  Script `json:",omitempty"`
 }
 
+// Transaction moves coins from TxIns to TxOuts. A non-zero LockTime, a
+// block height or a timestamp, keeps it out of blocks before then.
 type Transaction struct {
-	ID     string
-	TxIns  []TxIn
-	TxOuts []TxOut
+	ID       string
+	TxIns    []TxIn
+	TxOuts   []TxOut
+	LockTime int64 `json:",omitempty"`
 }
 
+// getTransactionID hashes the encoding of transaction with every signature
+// left empty, since the signatures sign the ID
 func getTransactionID(transaction Transaction) string {
-	txInContent := ""
-	for _, txIn := range transaction.TxIns {
-		txInContent += txIn.TxOutID + string(txIn.TxOutIndex)
-	}
-
-	txOutContent := ""
-
-	for _, txOut := range transaction.TxOuts {
-		txOutContent += txOut.Address + string(txOut.Amount)
-	}
-
-	h := sha256.New()
+	e := &encoder{}
+	e.transaction(transaction, false)
 
-	h.Write([]byte(txInContent + txOutContent))
+	bs := sha256.Sum256(e.buf)
 
-	bs := h.Sum(nil)
-
-	return string(bs)
+	return hex.EncodeToString(bs[:])
 }
 
-func signTxIn(transaction Transaction, txInIndex int, privateKey string, aUnspentTxOuts []UnspentTxOut) string {
-	// txIn := transaction.TxIns[txInIndex]
-	dataToSign := transaction.ID
+// signTxIn returns the signature of input txInIndex of transaction by
+// privateKey, signing the whole transaction
+func signTxIn(transaction Transaction, txInIndex int, privateKey string, aUnspentTxOuts UtxoView) string {
+	return signTxInWithHashType(transaction, txInIndex, privateKey, aUnspentTxOuts, sigHashAll)
+}
 
-	// referencedUnspentTxOut := findUnspentTxOut(txIn.TxOutID, txIn.TxOutIndex, aUnspentTxOuts)
-	// referencedAddress := referencedUnspentTxOut.Address
+// signTxInWithHashType returns the DER signature of input txInIndex of
+// transaction by privateKey followed by hashType, which picks what it signs
+func signTxInWithHashType(transaction Transaction, txInIndex int, privateKey string, aUnspentTxOuts UtxoView, hashType byte) string {
+	ecdsaPrivateKey, err := ParseRsaPrivateKeyFromPemStr(privateKey)
+	if err != nil || txInIndex < 0 || txInIndex >= len(transaction.TxIns) {
+		return ""
+	}
 
-	hash := sha256.Sum256([]byte(dataToSign))
+	txIn := transaction.TxIns[txInIndex]
+	spent := findUnspentTxOut(txIn.TxOutID, txIn.TxOutIndex, aUnspentTxOuts)
+	if spent == nil {
+		return ""
+	}
 
-	ecdsaPrivateKey, err := ParseRsaPrivateKeyFromPemStr(privateKey)
+	hash, err := signatureHash(transaction, txInIndex, *spent, hashType)
 	if err != nil {
 		return ""
 	}
 
-	r, s, err := ecdsa.Sign(rand.Reader, (*ecdsa.PrivateKey)(ecdsaPrivateKey), hash[:])
+	r, s, err := ecdsa.Sign(rand.Reader, (*ecdsa.PrivateKey)(ecdsaPrivateKey), hash)
+	if err != nil {
+		return ""
+	}
 
-	signature := r.Bytes()
-	signature = append(signature, s.Bytes()...)
+	signature := &Signature{R: r, S: s}
 
-	return string(signature)
+	return string(append(signature.Serialize(), hashType))
 }
 
 func stringToBigInt(key string) *big.Int {
@@ -109,167 +160,63 @@ func stringToBigInt(key string) *big.Int {
 	return n
 }
 
-func updateUnspentTxOuts(newTransactions []Transaction, aUnspentTxOuts []UnspentTxOut) []UnspentTxOut {
-	newUnspentTxOuts := []UnspentTxOut{}
-
-	for _, t := range newTransactions {
-		for index, out := range t.TxOuts {
-			newUnspentTxOuts = append(newUnspentTxOuts, UnspentTxOut{
-				TxOutID:    t.ID,
-				TxOutIndex: index,
-				Address:    out.Address,
-				Amount:     out.Amount,
-			})
-		}
-	}
-
-	consumedTxOuts := []UnspentTxOut{}
-	for _, t := range newTransactions {
-		for _, in := range t.TxIns {
-			consumedTxOuts = append(consumedTxOuts, UnspentTxOut{
-				TxOutID:    in.TxOutID,
-				TxOutIndex: in.TxOutIndex,
-				Address:    "",
-				Amount:     0,
-			})
-		}
-	}
-	resultingUnspentTxOuts := newUnspentTxOuts
-
-	for _, t := range aUnspentTxOuts {
-		if findUnspentTxOut(t.TxOutID, t.TxOutIndex, consumedTxOuts) != nil {
-			resultingUnspentTxOuts = append(resultingUnspentTxOuts, t)
-		}
-	}
-
-	return resultingUnspentTxOuts
-}
-
-func findUnspentTxOut(transactionID string, index int, aUnspentTxOuts []UnspentTxOut) *UnspentTxOut {
-	for _, t := range aUnspentTxOuts {
-		if t.TxOutID == transactionID && t.TxOutIndex == index {
-			return &t
-		}
-	}
-	return nil
+// updateUnspentTxOuts applies newTransactions, confirmed in the block at,
+// to aUnspentTxOuts
+func updateUnspentTxOuts(newTransactions []Transaction, aUnspentTxOuts UtxoView, at chainContext) *utxoOverlay {
+	view := newUtxoOverlay(aUnspentTxOuts)
+	view.apply(newTransactions, at)
+	return view
 }
 
-func validateTransaction(transaction Transaction, aUnspentTxOuts []UnspentTxOut) bool {
-	if getTransactionID(transaction) != transaction.ID {
-		return false
-	}
-
-	hasValidTxIns := true
-
-	for _, t := range transaction.TxIns {
-		hasValidTxIns = hasValidTxIns && validateTxIn(t, transaction, aUnspentTxOuts)
-	}
-
-	if hasValidTxIns {
-		return false
+func findUnspentTxOut(transactionID string, index int, aUnspentTxOuts UtxoView) *UnspentTxOut {
+	uTxO, ok := aUnspentTxOuts.lookup(outPoint{transactionID, index})
+	if !ok {
+		return nil
 	}
-
-	return true
+	return &uTxO
 }
 
-func validateTxIn(txIn TxIn, transaction Transaction, aUnspentTxOuts []UnspentTxOut) bool {
-	var referencedUTxOut *UnspentTxOut
-	for _, t := range aUnspentTxOuts {
-		if t.TxOutID == txIn.TxOutID && t.TxOutID == txIn.TxOutID {
-			referencedUTxOut = &t
-		}
-	}
-
-	if referencedUTxOut == nil {
-		return false
+// getTransactionFee is what the inputs of transaction hold beyond its
+// outputs. Every input must be in aUnspentTxOuts.
+func getTransactionFee(transaction Transaction, aUnspentTxOuts UtxoView) int {
+	fee := 0
+	for _, txIn := range transaction.TxIns {
+		fee += findUnspentTxOut(txIn.TxOutID, txIn.TxOutIndex, aUnspentTxOuts).Amount
 	}
-
-	address := referencedUTxOut.Address
-
-	serializedPubKey, err := hex.DecodeString(address)
-	if err != nil {
-		return false
+	for _, txOut := range transaction.TxOuts {
+		fee -= txOut.Amount
 	}
-
-	publicKey, _ := ParsePubKey(serializedPubKey)
-
-	sig, _ := parseSig([]byte(txIn.Signature))
-
-	return sig.Verify([]byte(transaction.ID), publicKey)
+	return fee
 }
 
-const COINBASE_AMOUNT = 50
-
-func validateCoinbaseTx(transaction Transaction, blockIndex int) bool {
-	if getTransactionID(transaction) != transaction.ID {
-		return false
-	}
-
-	if len(transaction.TxIns) != 1 {
-		return false
-	}
-
-	if transaction.TxIns[0].TxOutIndex != blockIndex {
-		return false
-	}
-
-	if len(transaction.TxOuts) != 1 {
-		return false
-	}
-	if transaction.TxOuts[0].Amount != COINBASE_AMOUNT {
-		return false
-	}
-
-	return true
+// getTransactionSize is the length of the encoding of transaction in bytes
+func getTransactionSize(transaction Transaction) int {
+	b, _ := transaction.MarshalBinary()
+	return len(b)
 }
-func ProcessTransactions(aTransactions []Transaction, aUnspentTxOuts []UnspentTxOut, blockIndex int) []UnspentTxOut {
-	if !validateBlockTransactions(aTransactions, aUnspentTxOuts, blockIndex) {
-		fmt.Println("invalid block transactions")
-		return []UnspentTxOut{}
-	}
-	return updateUnspentTxOuts(aTransactions, aUnspentTxOuts)
-}
-
-func validateBlockTransactions(aTransactions []Transaction, aUnspentTxOuts []UnspentTxOut, blockIndex int) bool {
-	coinbaseTx := aTransactions[0]
 
-	if !validateCoinbaseTx(coinbaseTx, blockIndex) {
-		return false
+// ProcessTransactions checks the transactions of the block at and returns
+// the unspent outputs after them
+func ProcessTransactions(aTransactions []Transaction, aUnspentTxOuts UtxoView, at chainContext) (*utxoOverlay, error) {
+	if err := validateBlockTransactions(aTransactions, aUnspentTxOuts, at); err != nil {
+		return nil, err
 	}
-	txIns := []TxIn{}
-
-	for _, tx := range aTransactions {
-		for _, txIn := range tx.TxIns {
-			txIns = append(txIns, txIn)
-		}
-	}
-
-	if hasDuplicates(txIns) {
-		return false
-	}
-	normalTransaction := aTransactions[1:]
-	result := true
-	for _, tx := range normalTransaction {
-		result = result && validateTransaction(tx, aUnspentTxOuts)
-	}
-
-	return result
+	return updateUnspentTxOuts(aTransactions, aUnspentTxOuts, at), nil
 }
 
-func hasDuplicates(txIns []TxIn) bool {
-	keyCountMap := make(map[string]int)
-
-	for _, txIn := range txIns {
-		key := txIn.TxOutID + txIn.TxOutID
-		if _, ok := keyCountMap[key]; ok {
-			return true
-		}
-		keyCountMap[key] = 1
-	}
-	return false
+// GetCoinBaseTransaction returns the coinbase of the block at blockIndex
+// paying address the block reward and fees, the fees of the block
+func GetCoinBaseTransaction(address string, blockIndex int, fees int) Transaction {
+	return getPayoutCoinbaseTransaction([]TxOut{{
+		Address: address,
+		Amount:  blockSubsidy(blockIndex) + fees,
+	}}, blockIndex)
 }
 
-func GetCoinBaseTransaction(address string, blockIndex int) Transaction {
+// getPayoutCoinbaseTransaction returns the coinbase of the block at
+// blockIndex with the outputs txOuts, which together pay no more than the
+// block reward and fees
+func getPayoutCoinbaseTransaction(txOuts []TxOut, blockIndex int) Transaction {
 	t := Transaction{}
 	txIn := TxIn{
 		Signature:  "",
@@ -278,10 +225,7 @@ func GetCoinBaseTransaction(address string, blockIndex int) Transaction {
 	}
 
 	t.TxIns = []TxIn{txIn}
-	t.TxOuts = []TxOut{TxOut{
-		Address: address,
-		Amount:  COINBASE_AMOUNT,
-	}}
+	t.TxOuts = txOuts
 	t.ID = getTransactionID(t)
 
 	return t
@@ -295,7 +239,7 @@ func getPublicKey(aPrivateKey string) string {
 	}
 	publicKey := PublicKey(ecdsaPrivateKey.PublicKey)
 
-	return string(publicKey.SerializeUncompressed())
+	return hex.EncodeToString(publicKey.SerializeUncompressed())
 }
 
 // const getPublicKey = (aPrivateKey: string): string => {
@@ -1,96 +1,288 @@
 package main
 
-import "errors"
-
-var transactionPool []Transaction = []Transaction{}
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
 
 func getTransactionPool() []Transaction {
-	b := append(transactionPool[:0:0], transactionPool...)
-
-	return b
+	return mempool.transactions()
 }
 
-func addToTransactionPool(tx *Transaction, unspentTxOuts []UnspentTxOut) error {
+func addToTransactionPool(tx *Transaction, unspentTxOuts UtxoView) error {
 	if tx == nil {
 		return errors.New("Trying to add invalid tx to pool")
 	}
 
-	if !validateTransaction(*tx, unspentTxOuts) {
-		return errors.New("Trying to add invalid tx to pool")
+	if mempool.get(tx.ID) != nil {
+		err := ruleError(ruleAlreadyInPool, "transaction %s is already in the pool", tx.ID)
+		logRejection("transaction", tx.ID, err)
+		return err
 	}
 
-	if !isValidTxForPool(*tx, transactionPool) {
-		return errors.New("Trying to add invalid tx to pool")
+	if err := checkStandard(*tx); err != nil {
+		logRejection("transaction", tx.ID, asRuleError(err))
+		return err
+	}
+
+	// a transaction may spend outputs of pool transactions
+	at := nextBlockContext()
+	view := mempool.view(unspentTxOuts, at)
+	if err := validateTransaction(*tx, view, at); err != nil {
+		logRejection("transaction", tx.ID, asRuleError(err))
+		return err
+	}
+
+	fee := getTransactionFee(*tx, view)
+	size := getTransactionSize(*tx)
+	if minFeeRate := mempool.minFeeRate(); minFeeRate > 0 && fee*1000 <= minFeeRate*size {
+		err := ruleError(ruleMempoolMinFee, "transaction %s pays %d per 1000 bytes, the pool takes more than %d", tx.ID, feeRate(fee, size), minFeeRate)
+		logRejection("transaction", tx.ID, err)
+		return err
+	}
+
+	if err := mempool.checkChainLimits(*tx, size); err != nil {
+		logRejection("transaction", tx.ID, asRuleError(err))
+		return err
+	}
+
+	// a conflicting transaction may replace the ones it conflicts with
+	if conflicts := mempool.conflicts(*tx); len(conflicts) > 0 {
+		evicted, err := checkReplacement(*tx, fee, conflicts)
+		if err != nil {
+			logRejection("transaction", tx.ID, asRuleError(err))
+			return err
+		}
+		mempool.removeWithDescendants(evicted)
+		fmt.Printf("transaction %s replaced %d pool transactions\n", tx.ID, len(evicted))
 	}
 
-	transactionPool = append(transactionPool, *tx)
+	now := time.Now()
+	mempool.add(*tx, fee, at, now)
+	if expired := mempool.expire(now); expired > 0 {
+		fmt.Printf("%d pool transactions expired\n", expired)
+	}
+	evicted := mempool.trim()
+	if len(evicted) > 0 {
+		fmt.Printf("pool is full, evicted %d transactions\n", len(evicted))
+	}
+	for _, id := range evicted {
+		if id == tx.ID {
+			err := ruleError(ruleMempoolFull, "transaction %s pays too little to stay in the full pool", tx.ID)
+			logRejection("transaction", tx.ID, err)
+			return err
+		}
+	}
 
 	return nil
 }
 
-func isValidTxForPool(tx Transaction, aTransactionPool []Transaction) bool {
-	txPoolIns := getTxPoolIns(aTransactionPool)
+func hasTxIn(txIn TxIn, unspentTxOuts UtxoView) bool {
+	_, ok := unspentTxOuts.lookup(outPoint{txIn.TxOutID, txIn.TxOutIndex})
+	return ok
+}
+
+// updateTransactionPool drops the pool transactions spending outputs that
+// are neither in unspentTxOuts nor made by another pool transaction, along
+// with those spending theirs
+func updateTransactionPool(unspentTxOuts UtxoView) error {
+	invalidTxs := []string{}
 
-	containsTxIn := func(txIns []TxIn, txIn TxIn) bool {
-		for _, txPoolIn := range txIns {
-			if txIn.TxOutIndex == txPoolIn.TxOutIndex && txIn.TxOutID == txPoolIn.TxOutID {
-				return true
+	for _, tx := range mempool.transactions() {
+		for _, txIn := range tx.TxIns {
+			if mempool.get(txIn.TxOutID) == nil && !hasTxIn(txIn, unspentTxOuts) {
+				invalidTxs = append(invalidTxs, tx.ID)
+				break
 			}
 		}
-		return false
 	}
 
-	for _, txIn := range tx.TxIns {
-		if containsTxIn(txPoolIns, txIn) {
-			return false
-		}
+	if len(invalidTxs) > 0 {
+		removed := mempool.removeWithDescendants(invalidTxs)
+		fmt.Printf("dropped %d pool transactions spending spent outputs\n", removed)
 	}
 
-	return true
+	return nil
+}
+
+// PoolEntry is a pool transaction along with its fee and size in bytes,
+// and the fee and size of it together with its ancestors, the pool
+// transactions it spends outputs of, which must go into a block first
+type PoolEntry struct {
+	Transaction     Transaction `json:"transaction"`
+	Fee             int         `json:"fee"`
+	Size            int         `json:"size"`
+	FeeRate         int         `json:"feeRate"`
+	AncestorFee     int         `json:"ancestorFee"`
+	AncestorSize    int         `json:"ancestorSize"`
+	AncestorFeeRate int         `json:"ancestorFeeRate"`
 }
 
-func getTxPoolIns(aTransactionPool []Transaction) []TxIn {
-	result := []TxIn{}
+// feeRate is fee per 1000 bytes of size
+func feeRate(fee int, size int) int {
+	return fee * 1000 / size
+}
 
-	for _, t := range aTransactionPool {
-		for _, txIn := range t.TxIns {
-			result = append(result, txIn)
+// withPoolOutputs returns aUnspentTxOuts along with the outputs of the pool
+// transactions, which transactions going into the block at may spend. Pool
+// outputs already spent in the pool are left in, so conflicts reach the
+// replace-by-fee rules.
+func withPoolOutputs(aUnspentTxOuts UtxoView, aTransactionPool []Transaction, at chainContext) UtxoView {
+	result := newUtxoOverlay(aUnspentTxOuts)
+	for _, tx := range aTransactionPool {
+		for index := range tx.TxOuts {
+			result.add(poolUnspentTxOut(tx, index, at))
 		}
 	}
-
 	return result
 }
 
-func hasTxIn(txIn TxIn, unspentTxOuts []UnspentTxOut) bool {
-	for _, uTxO := range unspentTxOuts {
-		if uTxO.TxOutID == txIn.TxOutID && uTxO.TxOutIndex == txIn.TxOutIndex {
-			return true
-		}
+// poolUnspentTxOut returns output index of the pool transaction tx as an
+// output the block at may spend
+func poolUnspentTxOut(tx Transaction, index int, at chainContext) UnspentTxOut {
+	txOut := tx.TxOuts[index]
+	return UnspentTxOut{
+		TxOutID:    tx.ID,
+		TxOutIndex: index,
+		Address:    txOut.Address,
+		Amount:     txOut.Amount,
+		Script:     txOut.Script,
+		Height:     at.Height,
+		Time:       at.Time,
 	}
+}
 
-	return false
+// getPoolEntries returns the pool transactions that can go into the next
+// block in the order blocks take them: highest fee rate together with
+// their ancestors first, each after its ancestors. Transactions paying the
+// same rate keep the order they entered the pool in.
+func getPoolEntries(aUnspentTxOuts UtxoView) []PoolEntry {
+	return mempool.selectPackages(aUnspentTxOuts, math.MaxInt32, math.MaxInt32)
 }
 
-func updateTransactionPool(unspentTxOuts []UnspentTxOut) error {
-	invalidTxs := map[string]bool{}
+// selectTransactions picks pool transactions for a block in the order of
+// getPoolEntries, while they fit in maxSize bytes and maxCount
+// transactions
+func selectTransactions(aUnspentTxOuts UtxoView, maxSize int, maxCount int) []PoolEntry {
+	return mempool.selectPackages(aUnspentTxOuts, maxSize, maxCount)
+}
 
-	for _, tx := range transactionPool {
-		for _, txIn := range tx.TxIns {
-			if !hasTxIn(txIn, unspentTxOuts) {
-				invalidTxs[tx.ID] = true
-			}
+// packageCandidate is a pool transaction a block has not taken yet, with
+// the fee and size of it together with its ancestors not taken yet
+type packageCandidate struct {
+	entry *mempoolEntry
+	fee   int
+	size  int
+	// position in the heap, -1 once out of it
+	index int
+}
+
+// packageHeap orders candidates by the fee rate of their packages, highest
+// first, and the oldest first among those paying the same
+type packageHeap []*packageCandidate
+
+func (h packageHeap) Len() int { return len(h) }
+
+func (h packageHeap) Less(i, j int) bool {
+	// compare fee/size without rounding
+	a, b := h[i].fee*h[j].size, h[j].fee*h[i].size
+	return a > b || a == b && h[i].entry.seq < h[j].entry.seq
+}
+
+func (h packageHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *packageHeap) Push(x interface{}) {
+	candidate := x.(*packageCandidate)
+	candidate.index = len(*h)
+	*h = append(*h, candidate)
+}
+
+func (h *packageHeap) Pop() interface{} {
+	old := *h
+	candidate := old[len(old)-1]
+	old[len(old)-1] = nil
+	candidate.index = -1
+	*h = old[:len(old)-1]
+	return candidate
+}
+
+// selectPackages orders the pool transactions valid in the next block
+// while they fit in maxSize bytes and maxCount transactions. Each round
+// takes the transaction paying the highest fee rate together with its
+// ancestors not taken yet, so a child paying a high fee pulls its parents
+// in, and takes those ancestors first. The packages start from the
+// ancestor totals the pool keeps, and taking a transaction takes its fee
+// and size out of those of its descendants.
+func (m *Mempool) selectPackages(aUnspentTxOuts UtxoView, maxSize int, maxCount int) []PoolEntry {
+	excluded := m.recheck(aUnspentTxOuts, nextBlockContext())
+
+	candidates := map[string]*packageCandidate{}
+	packages := packageHeap{}
+	for id, entry := range m.txs {
+		if excluded[id] {
+			continue
 		}
+		candidate := &packageCandidate{entry: entry, fee: entry.ancestorFee, size: entry.ancestorSize, index: len(packages)}
+		candidates[id] = candidate
+		packages = append(packages, candidate)
 	}
+	heap.Init(&packages)
 
-	if len(invalidTxs) > 0 {
-		newTransactionPool := []Transaction{}
+	result := []PoolEntry{}
+	size := 0
+	for packages.Len() > 0 {
+		best := heap.Pop(&packages).(*packageCandidate)
+		// a transaction skipped here may still go in as an ancestor
+		pkg := []*mempoolEntry{}
+		for _, id := range m.ancestors(best.entry.tx) {
+			if candidate, ok := candidates[id]; ok {
+				pkg = append(pkg, candidate.entry)
+			}
+		}
+		pkg = append(pkg, best.entry)
+		if size+best.size > maxSize || len(result)+len(pkg) > maxCount {
+			continue
+		}
 
-		for _, tx := range transactionPool {
-			if _, ok := invalidTxs[tx.ID]; !ok {
-				newTransactionPool = append(newTransactionPool, tx)
+		// ancestors have fewer ancestors than their descendants
+		sort.SliceStable(pkg, func(i, j int) bool {
+			return pkg[i].ancestorCount < pkg[j].ancestorCount
+		})
+		for _, entry := range pkg {
+			id := entry.tx.ID
+			if candidate := candidates[id]; candidate.index >= 0 {
+				heap.Remove(&packages, candidate.index)
 			}
+			delete(candidates, id)
+			for _, descendant := range m.descendants([]string{id})[1:] {
+				if candidate, ok := candidates[descendant]; ok {
+					candidate.fee -= entry.fee
+					candidate.size -= entry.size
+					if candidate.index >= 0 {
+						heap.Fix(&packages, candidate.index)
+					}
+				}
+			}
+			result = append(result, PoolEntry{
+				Transaction:     entry.tx,
+				Fee:             entry.fee,
+				Size:            entry.size,
+				FeeRate:         feeRate(entry.fee, entry.size),
+				AncestorFee:     entry.ancestorFee,
+				AncestorSize:    entry.ancestorSize,
+				AncestorFeeRate: feeRate(entry.ancestorFee, entry.ancestorSize),
+			})
 		}
+		size += best.size
 	}
 
-	return nil
+	return result
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestSignedTransactionJSON sends signed transactions through JSON, as the
+// HTTP API and peers do, and checks they stay valid
+func TestSignedTransactionJSON(t *testing.T) {
+	key := generatePrivateKey()
+	coinbase := GetCoinBaseTransaction(getPublicKey(key), 1, 0)
+	view := utxoViewOf([]UnspentTxOut{{
+		TxOutID:    coinbase.ID,
+		TxOutIndex: 0,
+		Address:    coinbase.TxOuts[0].Address,
+		Amount:     coinbase.TxOuts[0].Amount,
+	}})
+	receiver := getPublicKey(generatePrivateKey())
+
+	for i := 0; i < 20; i++ {
+		tx, err := createTransaction(TxOut{Address: receiver, Amount: 10}, 1, TxLocks{}, key, view, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Transaction
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.TxIns[0].Signature != tx.TxIns[0].Signature {
+			t.Fatalf("signature %x came back as %x", tx.TxIns[0].Signature, decoded.TxIns[0].Signature)
+		}
+		if err := validateTransaction(decoded, view, nextBlockContext()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -1,22 +0,0 @@
-package main
-
-func hexToBinary(str string) string {
-	ret := ""
-
-	lookupTable := map[string]string{
-		"0": "0000", "1": "0001", "2": "0010", "3": "0011", "4": "0100",
-		"5": "0101", "6": "0110", "7": "0111", "8": "1000", "9": "1001",
-		"a": "1010", "b": "1011", "c": "1100", "d": "1101",
-		"e": "1110", "f": "1111",
-	}
-
-	for _, s := range str {
-		if _, ok := lookupTable[string(s)]; ok {
-			ret += lookupTable[string(s)]
-		} else {
-			return ""
-		}
-	}
-
-	return ret
-}
@@ -0,0 +1,772 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The unspent set of the chain. UtxoDB keeps it on disk, so it can outgrow
+// memory, behind a write-back cache of the outputs read or changed lately.
+//
+// chainstate.dat is a log of records: an output becoming unspent, an output
+// being spent, the undo data of a block or its removal, and a commit naming
+// the tip the records before it bring the set to. Changes gather in the
+// cache and are written in one batch ending with a commit, at a block
+// boundary, once the cache is full and when the node shuts down. Records
+// after the last commit were cut short by a crash and are dropped on open.
+// chainstate.idx, a utxoIndex, finds the record of an output in the log. It
+// is rebuilt from the log when it does not match it, and the log is
+// rewritten once most of it is outputs spent since.
+//
+// Without a data directory the set lives in memory only.
+
+const (
+	utxoLogFileName   = "chainstate.dat"
+	utxoIndexFileName = "chainstate.idx"
+)
+
+// log record kinds. A record is kind byte | length uint32 | payload.
+const (
+	utxoRecordAdd = iota + 1
+	utxoRecordSpend
+	utxoRecordUndo
+	utxoRecordDropUndo
+	utxoRecordCommit
+)
+
+const utxoRecordHeaderSize = 5
+
+const (
+	// defaultUtxoCache is how many outputs the cache holds before it is
+	// written out
+	defaultUtxoCache = 200000
+	// the log is not rewritten before it reaches this size
+	minUtxoCompactSize = 8 << 20
+)
+
+// utxoLocation is where a record payload lives inside the log
+type utxoLocation struct {
+	Offset int64
+	Length uint32
+}
+
+// UtxoDB is the unspent set of the chain and the undo data of its blocks.
+// It is guarded by chainMutex.
+type UtxoDB struct {
+	// "" for a set in memory
+	dir     string
+	logFile *os.File
+	logSize int64
+	index   *utxoIndex
+
+	// outputs read or changed since they were last written, nil for spent
+	// ones. Without a directory it holds the whole set.
+	cache    map[outPoint]*UnspentTxOut
+	dirty    map[outPoint]bool
+	maxCache int
+
+	// undo records in the log, and undo data not written yet, nil for
+	// dropped
+	undos        map[string]utxoLocation
+	pendingUndos map[string]*BlockUndo
+
+	// the block the set is at; tipHeight is -1 for an empty set
+	tipHash   string
+	tipHeight int
+
+	// the first error reading or writing the files. Lookups failing with
+	// it look like missing outputs, so callers check Err before taking a
+	// missing output for an invalid block.
+	err error
+}
+
+func newMemoryUtxoDB() *UtxoDB {
+	return &UtxoDB{
+		cache:        map[outPoint]*UnspentTxOut{},
+		dirty:        map[outPoint]bool{},
+		undos:        map[string]utxoLocation{},
+		pendingUndos: map[string]*BlockUndo{},
+		tipHeight:    -1,
+	}
+}
+
+// genesisUtxoDB returns a set in memory holding the genesis outputs. The
+// genesis transaction is trusted as is, like the rest of the genesis block.
+func genesisUtxoDB() *UtxoDB {
+	db := newMemoryUtxoDB()
+	db.resetToGenesis()
+	return db
+}
+
+// OpenUtxoDB opens or creates the unspent set in dir, caching maxCache
+// outputs
+func OpenUtxoDB(dir string, maxCache int) (*UtxoDB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(dir, utxoLogFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	db := newMemoryUtxoDB()
+	db.dir = dir
+	db.logFile = logFile
+	db.maxCache = maxCache
+
+	if err := db.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load replays the log to find the tip and the undo records, drops the
+// records after the last commit, and opens the index, rebuilding it if it
+// does not match the log
+func (db *UtxoDB) load() error {
+	if _, err := db.logFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(db.logFile)
+
+	var offset, committed int64
+	undos := map[string]utxoLocation{}
+	uncommitted := map[string]*utxoLocation{}
+	header := make([]byte, utxoRecordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		kind := header[0]
+		length := binary.LittleEndian.Uint32(header[1:])
+		loc := utxoLocation{Offset: offset + utxoRecordHeaderSize, Length: length}
+
+		var payload []byte
+		if kind == utxoRecordAdd || kind == utxoRecordSpend {
+			if _, err := reader.Discard(int(length)); err != nil {
+				break
+			}
+		} else {
+			payload = make([]byte, length)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				break
+			}
+		}
+		offset = loc.Offset + int64(length)
+
+		switch kind {
+		case utxoRecordAdd, utxoRecordSpend:
+		case utxoRecordUndo:
+			d := decoder{buf: payload}
+			uncommitted[d.string()] = &loc
+		case utxoRecordDropUndo:
+			uncommitted[string(payload)] = nil
+		case utxoRecordCommit:
+			d := decoder{buf: payload}
+			height := int(d.int64())
+			hash := d.string()
+			if err := d.finish(); err != nil {
+				return fmt.Errorf("corrupt unspent set log at offset %d", loc.Offset)
+			}
+			for hash, loc := range uncommitted {
+				if loc == nil {
+					delete(undos, hash)
+				} else {
+					undos[hash] = *loc
+				}
+			}
+			uncommitted = map[string]*utxoLocation{}
+			committed = offset
+			db.tipHash, db.tipHeight = hash, height
+		default:
+			return fmt.Errorf("corrupt unspent set log at offset %d", loc.Offset)
+		}
+	}
+
+	if err := db.logFile.Truncate(committed); err != nil {
+		return err
+	}
+	db.logSize = committed
+	db.undos = undos
+
+	index, logSize, clean, err := openUtxoIndex(filepath.Join(db.dir, utxoIndexFileName))
+	if err != nil {
+		return err
+	}
+	db.index = index
+	if !clean || logSize != committed {
+		if committed > 0 {
+			fmt.Println("rebuilding the unspent output index")
+		}
+		return db.rebuildIndex()
+	}
+	return nil
+}
+
+// rebuildIndex builds the index again from the committed log
+func (db *UtxoDB) rebuildIndex() error {
+	path := filepath.Join(db.dir, utxoIndexFileName)
+	db.index.Close()
+	index, err := createUtxoIndex(path, utxoMinSlots)
+	if err != nil {
+		return err
+	}
+	db.index = index
+
+	reader := bufio.NewReader(io.NewSectionReader(db.logFile, 0, db.logSize))
+	var offset int64
+	header := make([]byte, utxoRecordHeaderSize)
+	for offset < db.logSize {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return err
+		}
+		length := binary.LittleEndian.Uint32(header[1:])
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return err
+		}
+		loc := utxoLocation{Offset: offset + utxoRecordHeaderSize, Length: length}
+		offset = loc.Offset + int64(length)
+
+		switch header[0] {
+		case utxoRecordAdd:
+			uTxO, err := decodeUnspentTxOut(payload)
+			if err != nil {
+				return err
+			}
+			if key, ok := keyOf(outPoint{uTxO.TxOutID, uTxO.TxOutIndex}); ok {
+				if err := db.index.reserve(1); err != nil {
+					return err
+				}
+				if err := db.index.put(key, loc); err != nil {
+					return err
+				}
+			}
+		case utxoRecordSpend:
+			var key utxoKey
+			copy(key[:], payload)
+			if err := db.index.delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return db.index.writeHeader(true, db.logSize)
+}
+
+// reset empties the set
+func (db *UtxoDB) reset() error {
+	db.cache = map[outPoint]*UnspentTxOut{}
+	db.dirty = map[outPoint]bool{}
+	db.undos = map[string]utxoLocation{}
+	db.pendingUndos = map[string]*BlockUndo{}
+	db.tipHash, db.tipHeight = "", -1
+	if db.dir == "" {
+		return nil
+	}
+
+	if err := db.logFile.Truncate(0); err != nil {
+		return err
+	}
+	db.logSize = 0
+	return db.rebuildIndex()
+}
+
+// resetToGenesis empties the set and adds the genesis outputs
+func (db *UtxoDB) resetToGenesis() error {
+	if err := db.reset(); err != nil {
+		return err
+	}
+	updateUnspentTxOuts(genesisBlock.Data, db, genesisContext()).writeTo(db)
+	db.setTip(genesisBlock.Hash, 0)
+	return nil
+}
+
+// Close writes out the cache and closes the files
+func (db *UtxoDB) Close() error {
+	if db.dir == "" {
+		return nil
+	}
+	err := db.flush()
+	if db.index != nil {
+		if indexErr := db.index.Close(); err == nil {
+			err = indexErr
+		}
+	}
+	if logErr := db.logFile.Close(); err == nil {
+		err = logErr
+	}
+	return err
+}
+
+// Err returns the first error reading or writing the set
+func (db *UtxoDB) Err() error {
+	return db.err
+}
+
+func (db *UtxoDB) fail(err error) {
+	if db.err == nil {
+		fmt.Println("unspent set failed:", err)
+		db.err = err
+	}
+}
+
+func (db *UtxoDB) lookup(point outPoint) (UnspentTxOut, bool) {
+	if uTxO, ok := db.cache[point]; ok {
+		if uTxO == nil {
+			return UnspentTxOut{}, false
+		}
+		return *uTxO, true
+	}
+	if db.dir == "" {
+		return UnspentTxOut{}, false
+	}
+
+	key, ok := keyOf(point)
+	if !ok {
+		return UnspentTxOut{}, false
+	}
+	loc, ok, err := db.index.get(key)
+	if err != nil {
+		db.fail(err)
+		return UnspentTxOut{}, false
+	}
+	if !ok {
+		return UnspentTxOut{}, false
+	}
+	uTxO, err := db.readUnspentTxOut(loc)
+	if err != nil {
+		db.fail(err)
+		return UnspentTxOut{}, false
+	}
+	db.cache[point] = &uTxO
+	return uTxO, true
+}
+
+// forEach visits the outputs changed since the cache was last written,
+// oldest first, then those on disk in index order
+func (db *UtxoDB) forEach(fn func(UnspentTxOut) bool) {
+	changed := map[outPoint]UnspentTxOut{}
+	for point, uTxO := range db.cache {
+		if uTxO != nil && (db.dir == "" || db.dirty[point]) {
+			changed[point] = *uTxO
+		}
+	}
+	for _, uTxO := range sortedUnspentTxOuts(changed) {
+		if !fn(uTxO) {
+			return
+		}
+	}
+	if db.dir == "" {
+		return
+	}
+
+	err := db.index.forEach(func(key utxoKey, loc utxoLocation) bool {
+		point := keyPoint(key)
+		if db.dirty[point] {
+			return true
+		}
+		if uTxO, ok := db.cache[point]; ok && uTxO != nil {
+			return fn(*uTxO)
+		}
+		uTxO, err := db.readUnspentTxOut(loc)
+		if err != nil {
+			db.fail(err)
+			return false
+		}
+		return fn(uTxO)
+	})
+	if err != nil {
+		db.fail(err)
+	}
+}
+
+func (db *UtxoDB) add(uTxO UnspentTxOut) {
+	point := outPoint{uTxO.TxOutID, uTxO.TxOutIndex}
+	db.cache[point] = &uTxO
+	if db.dir != "" {
+		db.dirty[point] = true
+	}
+}
+
+func (db *UtxoDB) spend(point outPoint) {
+	if db.dir == "" {
+		delete(db.cache, point)
+		return
+	}
+	db.cache[point] = nil
+	db.dirty[point] = true
+}
+
+// putUndo stores the undo data of the block hash
+func (db *UtxoDB) putUndo(hash string, undo BlockUndo) {
+	db.pendingUndos[hash] = &undo
+}
+
+// dropUndo forgets the undo data of the block hash, which left the chain
+func (db *UtxoDB) dropUndo(hash string) {
+	db.pendingUndos[hash] = nil
+}
+
+// getUndo returns the undo data of the block hash
+func (db *UtxoDB) getUndo(hash string) (BlockUndo, bool) {
+	if undo, ok := db.pendingUndos[hash]; ok {
+		if undo == nil {
+			return BlockUndo{}, false
+		}
+		return *undo, true
+	}
+	loc, ok := db.undos[hash]
+	if !ok {
+		return BlockUndo{}, false
+	}
+
+	payload, err := db.readPayload(loc)
+	if err != nil {
+		db.fail(err)
+		return BlockUndo{}, false
+	}
+	d := decoder{buf: payload}
+	d.string()
+	undo := BlockUndo{SpentTxOuts: []UnspentTxOut{}}
+	for n := d.count(1); n > 0; n-- {
+		undo.SpentTxOuts = append(undo.SpentTxOuts, d.unspentTxOut())
+	}
+	if err := d.finish(); err != nil {
+		db.fail(err)
+		return BlockUndo{}, false
+	}
+	return undo, true
+}
+
+// setTip records that the set is at the block hash at height
+func (db *UtxoDB) setTip(hash string, height int) {
+	db.tipHash, db.tipHeight = hash, height
+}
+
+// flushIfFull writes out the cache once it holds more than maxCache
+// outputs. Callers call it between blocks, so the set on disk is always
+// that of a block.
+func (db *UtxoDB) flushIfFull() error {
+	if db.dir == "" || len(db.cache) <= db.maxCache {
+		return nil
+	}
+	return db.flush()
+}
+
+// flush writes the changes in the cache to the log in one batch, then
+// updates the index
+func (db *UtxoDB) flush() error {
+	if db.dir == "" {
+		return nil
+	}
+	if db.err != nil {
+		return db.err
+	}
+
+	points := make([]outPoint, 0, len(db.dirty))
+	for point := range db.dirty {
+		points = append(points, point)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].TxOutID != points[j].TxOutID {
+			return points[i].TxOutID < points[j].TxOutID
+		}
+		return points[i].TxOutIndex < points[j].TxOutIndex
+	})
+	hashes := make([]string, 0, len(db.pendingUndos))
+	for hash := range db.pendingUndos {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	// the batch, and where its records will be
+	batch := []byte{}
+	record := func(kind byte, payload []byte) utxoLocation {
+		loc := utxoLocation{Offset: db.logSize + int64(len(batch)) + utxoRecordHeaderSize, Length: uint32(len(payload))}
+		batch = append(batch, kind)
+		batch = binary.LittleEndian.AppendUint32(batch, uint32(len(payload)))
+		batch = append(batch, payload...)
+		return loc
+	}
+
+	added := map[utxoKey]utxoLocation{}
+	spent := []utxoKey{}
+	for _, point := range points {
+		key, ok := keyOf(point)
+		if !ok {
+			continue
+		}
+		if uTxO := db.cache[point]; uTxO != nil {
+			added[key] = record(utxoRecordAdd, encodeUnspentTxOut(*uTxO))
+		} else {
+			record(utxoRecordSpend, key[:])
+			spent = append(spent, key)
+		}
+	}
+	undos := map[string]*utxoLocation{}
+	for _, hash := range hashes {
+		if undo := db.pendingUndos[hash]; undo != nil {
+			e := encoder{}
+			e.string(hash)
+			e.uint32(uint32(len(undo.SpentTxOuts)))
+			for _, uTxO := range undo.SpentTxOuts {
+				e.unspentTxOut(uTxO)
+			}
+			loc := record(utxoRecordUndo, e.buf)
+			undos[hash] = &loc
+		} else if _, ok := db.undos[hash]; ok {
+			record(utxoRecordDropUndo, []byte(hash))
+			undos[hash] = nil
+		}
+	}
+	e := encoder{}
+	e.int64(int64(db.tipHeight))
+	e.string(db.tipHash)
+	record(utxoRecordCommit, e.buf)
+
+	if _, err := db.logFile.WriteAt(batch, db.logSize); err != nil {
+		db.fail(err)
+		return err
+	}
+	if err := db.logFile.Sync(); err != nil {
+		db.fail(err)
+		return err
+	}
+	db.logSize += int64(len(batch))
+
+	if err := db.updateIndex(added, spent); err != nil {
+		db.fail(err)
+		return err
+	}
+
+	for hash, loc := range undos {
+		if loc == nil {
+			delete(db.undos, hash)
+		} else {
+			db.undos[hash] = *loc
+		}
+	}
+	db.dirty = map[outPoint]bool{}
+	db.pendingUndos = map[string]*BlockUndo{}
+	for point, uTxO := range db.cache {
+		if uTxO == nil || len(db.cache) > db.maxCache/2 {
+			delete(db.cache, point)
+		}
+	}
+
+	if db.logSize >= minUtxoCompactSize && db.logSize > 2*db.liveBytes() {
+		if err := db.compact(); err != nil {
+			db.fail(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// updateIndex points the index at the records of a batch written to the
+// log. The index is marked unclean until it is done, so a crash halfway
+// leaves it to be rebuilt.
+func (db *UtxoDB) updateIndex(added map[utxoKey]utxoLocation, spent []utxoKey) error {
+	if err := db.index.writeHeader(false, db.logSize); err != nil {
+		return err
+	}
+	for _, key := range spent {
+		if err := db.index.delete(key); err != nil {
+			return err
+		}
+	}
+	if err := db.index.reserve(len(added)); err != nil {
+		return err
+	}
+	for key, loc := range added {
+		if err := db.index.put(key, loc); err != nil {
+			return err
+		}
+	}
+	return db.index.writeHeader(true, db.logSize)
+}
+
+// liveBytes is how much of the log is still needed
+func (db *UtxoDB) liveBytes() int64 {
+	live := db.index.liveBytes + int64(db.index.live)*utxoRecordHeaderSize
+	for _, loc := range db.undos {
+		live += int64(loc.Length) + utxoRecordHeaderSize
+	}
+	return live
+}
+
+// compact rewrites the log with only the unspent outputs and the undo data
+// still needed, and builds the index for it. The cache must have been
+// written out.
+func (db *UtxoDB) compact() error {
+	logPath := filepath.Join(db.dir, utxoLogFileName)
+	indexPath := filepath.Join(db.dir, utxoIndexFileName)
+	tmpLogPath := logPath + ".tmp"
+
+	tmpLog, err := os.OpenFile(tmpLogPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmpLog)
+	var size int64
+	copyRecord := func(kind byte, loc utxoLocation) (utxoLocation, error) {
+		payload, err := db.readPayload(loc)
+		if err != nil {
+			return utxoLocation{}, err
+		}
+		header := []byte{kind, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(header[1:], loc.Length)
+		writer.Write(header)
+		writer.Write(payload)
+		newLoc := utxoLocation{Offset: size + utxoRecordHeaderSize, Length: loc.Length}
+		size = newLoc.Offset + int64(loc.Length)
+		return newLoc, nil
+	}
+
+	added := map[utxoKey]utxoLocation{}
+	var copyErr error
+	err = db.index.forEach(func(key utxoKey, loc utxoLocation) bool {
+		var newLoc utxoLocation
+		if newLoc, copyErr = copyRecord(utxoRecordAdd, loc); copyErr != nil {
+			return false
+		}
+		added[key] = newLoc
+		return true
+	})
+	if err == nil {
+		err = copyErr
+	}
+	undos := map[string]utxoLocation{}
+	for hash, loc := range db.undos {
+		if err != nil {
+			break
+		}
+		undos[hash], err = copyRecord(utxoRecordUndo, loc)
+	}
+	if err == nil {
+		e := encoder{}
+		e.int64(int64(db.tipHeight))
+		e.string(db.tipHash)
+		header := []byte{utxoRecordCommit, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(header[1:], uint32(len(e.buf)))
+		writer.Write(header)
+		writer.Write(e.buf)
+		size += utxoRecordHeaderSize + int64(len(e.buf))
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmpLog.Sync()
+	}
+	if err != nil {
+		tmpLog.Close()
+		os.Remove(tmpLogPath)
+		return err
+	}
+
+	// without an index the new log is indexed again on open, should the
+	// node stop before the new index is written
+	db.index.Close()
+	if err := os.Remove(indexPath); err != nil {
+		tmpLog.Close()
+		return err
+	}
+	if err := os.Rename(tmpLogPath, logPath); err != nil {
+		tmpLog.Close()
+		return err
+	}
+	db.logFile.Close()
+	db.logFile = tmpLog
+	db.logSize = size
+	db.undos = undos
+
+	slots := uint64(utxoMinSlots)
+	for slots*3 < uint64(len(added))*4*2 {
+		slots *= 2
+	}
+	index, err := createUtxoIndex(indexPath, slots)
+	if err != nil {
+		return err
+	}
+	db.index = index
+	if err := db.updateIndex(added, nil); err != nil {
+		return err
+	}
+	fmt.Printf("compacted the unspent set to %d bytes\n", size)
+	return nil
+}
+
+func (db *UtxoDB) readPayload(loc utxoLocation) ([]byte, error) {
+	payload := make([]byte, loc.Length)
+	if _, err := db.logFile.ReadAt(payload, loc.Offset); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (db *UtxoDB) readUnspentTxOut(loc utxoLocation) (UnspentTxOut, error) {
+	payload, err := db.readPayload(loc)
+	if err != nil {
+		return UnspentTxOut{}, err
+	}
+	return decodeUnspentTxOut(payload)
+}
+
+// unspent output record: txid string | index uint32 | address string |
+// amount int64 | script bytes | height int64 | time int64 | coinbase uint32
+
+func (e *encoder) unspentTxOut(uTxO UnspentTxOut) {
+	e.string(uTxO.TxOutID)
+	e.uint32(uint32(uTxO.TxOutIndex))
+	e.string(uTxO.Address)
+	e.int64(int64(uTxO.Amount))
+	e.bytes(uTxO.Script)
+	e.int64(int64(uTxO.Height))
+	e.int64(uTxO.Time)
+	if uTxO.Coinbase {
+		e.uint32(1)
+	} else {
+		e.uint32(0)
+	}
+}
+
+func (d *decoder) unspentTxOut() UnspentTxOut {
+	uTxO := UnspentTxOut{
+		TxOutID:    d.string(),
+		TxOutIndex: int(d.uint32()),
+		Address:    d.string(),
+		Amount:     int(d.int64()),
+	}
+	if script := d.bytes(); len(script) > 0 {
+		uTxO.Script = Script(script)
+	}
+	uTxO.Height = int(d.int64())
+	uTxO.Time = d.int64()
+	uTxO.Coinbase = d.uint32() == 1
+	return uTxO
+}
+
+func encodeUnspentTxOut(uTxO UnspentTxOut) []byte {
+	e := encoder{}
+	e.unspentTxOut(uTxO)
+	return e.buf
+}
+
+func decodeUnspentTxOut(data []byte) (UnspentTxOut, error) {
+	d := decoder{buf: data}
+	uTxO := d.unspentTxOut()
+	if err := d.finish(); err != nil {
+		return UnspentTxOut{}, errors.New("corrupt unspent output record")
+	}
+	return uTxO, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// testUnspentTxOut returns output i of a made-up transaction
+func testUnspentTxOut(i int) UnspentTxOut {
+	id := sha256.Sum256([]byte(strconv.Itoa(i)))
+	return UnspentTxOut{
+		TxOutID:    hex.EncodeToString(id[:]),
+		TxOutIndex: i % 3,
+		Address:    "04aa",
+		Amount:     i + 1,
+		Height:     1,
+	}
+}
+
+func testPoint(i int) outPoint {
+	uTxO := testUnspentTxOut(i)
+	return outPoint{uTxO.TxOutID, uTxO.TxOutIndex}
+}
+
+// checkUnspent fails unless db holds outputs 0 to n-1 but those spent
+func checkUnspent(t *testing.T, db *UtxoDB, n int, spent func(i int) bool) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		uTxO, ok := db.lookup(testPoint(i))
+		if spent(i) {
+			if ok {
+				t.Fatalf("output %d is spent but found", i)
+			}
+			continue
+		}
+		want := testUnspentTxOut(i)
+		if !ok || uTxO.Address != want.Address || uTxO.Amount != want.Amount || uTxO.Height != want.Height {
+			t.Fatalf("output %d: got %v, %v", i, uTxO, ok)
+		}
+	}
+	if err := db.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func noneSpent(i int) bool { return false }
+
+func TestUtxoDBReopen(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenUtxoDB(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 100
+	for i := 0; i < n; i++ {
+		db.add(testUnspentTxOut(i))
+	}
+	db.setTip(genesisBlock.Hash, 0)
+	if err := db.flush(); err != nil {
+		t.Fatal(err)
+	}
+	odd := func(i int) bool { return i%2 == 1 }
+	for i := 0; i < n; i++ {
+		if odd(i) {
+			db.spend(testPoint(i))
+		}
+	}
+	db.setTip("next", 1)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenUtxoDB(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.tipHash != "next" || db.tipHeight != 1 {
+		t.Fatalf("tip is %s at %d", db.tipHash, db.tipHeight)
+	}
+	checkUnspent(t, db, n, odd)
+}
+
+func TestUtxoDBCompact(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenUtxoDB(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 200
+	for i := 0; i < n; i++ {
+		db.add(testUnspentTxOut(i))
+	}
+	db.setTip(genesisBlock.Hash, 0)
+	if err := db.flush(); err != nil {
+		t.Fatal(err)
+	}
+	low := func(i int) bool { return i < n/2 }
+	for i := 0; i < n/2; i++ {
+		db.spend(testPoint(i))
+	}
+	if err := db.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	before := db.logSize
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if db.logSize >= before {
+		t.Fatalf("log is %d bytes after compacting, %d before", db.logSize, before)
+	}
+	checkUnspent(t, db, n, low)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenUtxoDB(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkUnspent(t, db, n, low)
+}
+
+func TestUtxoDBCompactReadFailure(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenUtxoDB(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 50
+	for i := 0; i < n; i++ {
+		db.add(testUnspentTxOut(i))
+	}
+	db.setTip(genesisBlock.Hash, 0)
+	if err := db.flush(); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, utxoLogFileName)
+	before, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reading the records to copy fails
+	db.logFile.Close()
+	if err := db.compact(); err == nil {
+		t.Fatal("compacting an unreadable log succeeded")
+	}
+	db.index.Close()
+
+	after, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != before.Size() {
+		t.Fatalf("log went from %d to %d bytes", before.Size(), after.Size())
+	}
+	if _, err := os.Stat(logPath + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("the unfinished log was left behind")
+	}
+
+	db, err = OpenUtxoDB(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkUnspent(t, db, n, noneSpent)
+}
+
+func TestUtxoIndexReserveWriteFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), utxoIndexFileName)
+	x, err := createUtxoIndex(path, 2*utxoMinSlots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	n := utxoMinSlots + 100
+	for i := 0; i < n; i++ {
+		key, _ := keyOf(testPoint(i))
+		if err := x.put(key, utxoLocation{Offset: int64(i + 1), Length: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// counts too low size the new table too small for the outputs, so
+	// writing them to it fails halfway
+	x.live = 0
+	x.used = x.slots
+	if err := x.reserve(1); err == nil {
+		t.Fatal("rehashing into a full table succeeded")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("the unfinished table was left behind")
+	}
+
+	for i := 0; i < n; i++ {
+		key, _ := keyOf(testPoint(i))
+		loc, ok, err := x.get(key)
+		if err != nil || !ok || loc.Offset != int64(i+1) {
+			t.Fatalf("output %d: got %v, %v, %v", i, loc, ok, err)
+		}
+	}
+}
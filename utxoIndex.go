@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+)
+
+// utxoIndex is an on-disk open-addressing hash table from the outpoint of
+// an unspent output to its record in the log of the UtxoDB. A lookup reads
+// a few slots, however large the set grows; the table doubles when it is
+// three quarters full.
+//
+// The file is a header followed by slots of
+// txid [32]byte | index uint32 | offset uint64 | length uint32. An offset of
+// 0 marks an empty slot, which ends a probe, and utxoSlotDeleted a slot
+// emptied by a spend, which does not.
+type utxoIndex struct {
+	path string
+	file *os.File
+	// slots in the table, a power of two
+	slots uint64
+	// slots holding an output or emptied by a spend
+	used uint64
+	// slots holding an output
+	live uint64
+	// bytes of the log records of the outputs in the table
+	liveBytes int64
+}
+
+// utxoKey is the outpoint as the index stores it
+type utxoKey [36]byte
+
+const (
+	utxoIndexMagic      = "UTXI"
+	utxoIndexHeaderSize = 64
+	utxoSlotSize        = 48
+	utxoMinSlots        = 1 << 12
+	utxoSlotDeleted     = ^uint64(0)
+	// slots read at once when walking the table
+	utxoScanSlots = 1024
+)
+
+var errCorruptUtxoIndex = errors.New("corrupt unspent output index")
+
+// keyOf returns the index key of point. Outputs are only ever created by
+// transactions with hex IDs, so other points have none.
+func keyOf(point outPoint) (utxoKey, bool) {
+	var key utxoKey
+	id, err := hex.DecodeString(point.TxOutID)
+	if err != nil || len(id) != 32 || point.TxOutIndex < 0 {
+		return key, false
+	}
+	copy(key[:], id)
+	binary.LittleEndian.PutUint32(key[32:], uint32(point.TxOutIndex))
+	return key, true
+}
+
+// createUtxoIndex creates an empty table of slots at path, replacing any
+// file there
+func createUtxoIndex(path string, slots uint64) (*utxoIndex, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(utxoIndexHeaderSize + int64(slots)*utxoSlotSize); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &utxoIndex{path: path, file: file, slots: slots}, nil
+}
+
+// openUtxoIndex opens the table at path. It returns the size of the log the
+// table matches, and false if the table was being updated when the node
+// stopped; either way it needs rebuilding if it does not match the log.
+func openUtxoIndex(path string) (*utxoIndex, int64, bool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	header := make([]byte, utxoIndexHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:4]) != utxoIndexMagic {
+		// new or cut short
+		return &utxoIndex{path: path, file: file}, 0, false, nil
+	}
+
+	x := &utxoIndex{
+		path:      path,
+		file:      file,
+		slots:     binary.LittleEndian.Uint64(header[8:]),
+		used:      binary.LittleEndian.Uint64(header[16:]),
+		live:      binary.LittleEndian.Uint64(header[24:]),
+		liveBytes: int64(binary.LittleEndian.Uint64(header[40:])),
+	}
+	logSize := int64(binary.LittleEndian.Uint64(header[32:]))
+	clean := header[4] == 1
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, false, err
+	}
+	if x.slots == 0 || x.slots&(x.slots-1) != 0 || info.Size() != utxoIndexHeaderSize+int64(x.slots)*utxoSlotSize {
+		clean = false
+	}
+	return x, logSize, clean, nil
+}
+
+// writeHeader records the counts of the table and the size of the log it
+// matches. The table is marked unclean while it is being changed.
+func (x *utxoIndex) writeHeader(clean bool, logSize int64) error {
+	header := make([]byte, utxoIndexHeaderSize)
+	copy(header, utxoIndexMagic)
+	if clean {
+		header[4] = 1
+	}
+	binary.LittleEndian.PutUint64(header[8:], x.slots)
+	binary.LittleEndian.PutUint64(header[16:], x.used)
+	binary.LittleEndian.PutUint64(header[24:], x.live)
+	binary.LittleEndian.PutUint64(header[32:], uint64(logSize))
+	binary.LittleEndian.PutUint64(header[40:], uint64(x.liveBytes))
+
+	if _, err := x.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return x.file.Sync()
+}
+
+func (x *utxoIndex) Close() error {
+	return x.file.Close()
+}
+
+// home is the slot a probe for key starts at. Transaction IDs are hashes,
+// so their first bytes are spread evenly already.
+func (x *utxoIndex) home(key utxoKey) uint64 {
+	h := binary.LittleEndian.Uint64(key[:8]) ^ uint64(binary.LittleEndian.Uint32(key[32:]))*0x9e3779b97f4a7c15
+	return h & (x.slots - 1)
+}
+
+func (x *utxoIndex) slotOffset(i uint64) int64 {
+	return utxoIndexHeaderSize + int64(i)*utxoSlotSize
+}
+
+// slot reads slot i
+func (x *utxoIndex) slot(i uint64) (utxoKey, uint64, uint32, error) {
+	var key utxoKey
+	b := make([]byte, utxoSlotSize)
+	if _, err := x.file.ReadAt(b, x.slotOffset(i)); err != nil {
+		return key, 0, 0, err
+	}
+	copy(key[:], b)
+	return key, binary.LittleEndian.Uint64(b[36:]), binary.LittleEndian.Uint32(b[44:]), nil
+}
+
+func (x *utxoIndex) setSlot(i uint64, key utxoKey, offset uint64, length uint32) error {
+	b := make([]byte, utxoSlotSize)
+	copy(b, key[:])
+	binary.LittleEndian.PutUint64(b[36:], offset)
+	binary.LittleEndian.PutUint32(b[44:], length)
+	_, err := x.file.WriteAt(b, x.slotOffset(i))
+	return err
+}
+
+// find returns the slot holding key
+func (x *utxoIndex) find(key utxoKey) (uint64, utxoLocation, bool, error) {
+	h := x.home(key)
+	for probe := uint64(0); probe < x.slots; probe++ {
+		i := (h + probe) & (x.slots - 1)
+		k, offset, length, err := x.slot(i)
+		if err != nil {
+			return 0, utxoLocation{}, false, err
+		}
+		if offset == 0 {
+			break
+		}
+		if offset != utxoSlotDeleted && k == key {
+			return i, utxoLocation{Offset: int64(offset), Length: length}, true, nil
+		}
+	}
+	return 0, utxoLocation{}, false, nil
+}
+
+// get returns where the record of the output key is in the log
+func (x *utxoIndex) get(key utxoKey) (utxoLocation, bool, error) {
+	_, loc, ok, err := x.find(key)
+	return loc, ok, err
+}
+
+// put points key at loc. The caller reserved room for it.
+func (x *utxoIndex) put(key utxoKey, loc utxoLocation) error {
+	h := x.home(key)
+	free, haveFree := uint64(0), false
+	for probe := uint64(0); probe < x.slots; probe++ {
+		i := (h + probe) & (x.slots - 1)
+		k, offset, length, err := x.slot(i)
+		if err != nil {
+			return err
+		}
+		if offset == utxoSlotDeleted {
+			if !haveFree {
+				free, haveFree = i, true
+			}
+			continue
+		}
+		if offset == 0 {
+			if !haveFree {
+				free, haveFree = i, true
+				x.used++
+			}
+			break
+		}
+		if k == key {
+			x.liveBytes += int64(loc.Length) - int64(length)
+			return x.setSlot(i, key, uint64(loc.Offset), loc.Length)
+		}
+	}
+	if !haveFree {
+		return errCorruptUtxoIndex
+	}
+
+	x.live++
+	x.liveBytes += int64(loc.Length)
+	return x.setSlot(free, key, uint64(loc.Offset), loc.Length)
+}
+
+// delete empties the slot of key, if it has one
+func (x *utxoIndex) delete(key utxoKey) error {
+	i, loc, ok, err := x.find(key)
+	if err != nil || !ok {
+		return err
+	}
+	x.live--
+	x.liveBytes -= int64(loc.Length)
+	return x.setSlot(i, key, utxoSlotDeleted, 0)
+}
+
+// forEach calls fn with every key in the table and where its record is,
+// in slot order, until fn returns false
+func (x *utxoIndex) forEach(fn func(utxoKey, utxoLocation) bool) error {
+	b := make([]byte, utxoScanSlots*utxoSlotSize)
+	for start := uint64(0); start < x.slots; start += utxoScanSlots {
+		n := x.slots - start
+		if n > utxoScanSlots {
+			n = utxoScanSlots
+		}
+		chunk := b[:n*utxoSlotSize]
+		if _, err := x.file.ReadAt(chunk, x.slotOffset(start)); err != nil {
+			return err
+		}
+
+		for j := uint64(0); j < n; j++ {
+			s := chunk[j*utxoSlotSize:]
+			offset := binary.LittleEndian.Uint64(s[36:])
+			if offset == 0 || offset == utxoSlotDeleted {
+				continue
+			}
+			var key utxoKey
+			copy(key[:], s)
+			if !fn(key, utxoLocation{Offset: int64(offset), Length: binary.LittleEndian.Uint32(s[44:])}) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// reserve makes sure n more keys fit, rehashing into a larger table if the
+// table would be more than three quarters full. Rehashing drops the slots
+// emptied by spends too.
+func (x *utxoIndex) reserve(n int) error {
+	if (x.used+uint64(n))*4 <= x.slots*3 {
+		return nil
+	}
+
+	slots := uint64(utxoMinSlots)
+	for slots*3 < (x.live+uint64(n))*4*2 {
+		slots *= 2
+	}
+
+	path := x.path
+	tmpPath := path + ".tmp"
+	table, err := createUtxoIndex(tmpPath, slots)
+	if err != nil {
+		return err
+	}
+	var putErr error
+	err = x.forEach(func(key utxoKey, loc utxoLocation) bool {
+		putErr = table.put(key, loc)
+		return putErr == nil
+	})
+	if err == nil {
+		err = putErr
+	}
+	if err == nil {
+		err = table.file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		table.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	x.file.Close()
+	*x = *table
+	x.path = path
+	return nil
+}
+
+// keyPoint is the outpoint of key
+func keyPoint(key utxoKey) outPoint {
+	return outPoint{hex.EncodeToString(key[:32]), int(binary.LittleEndian.Uint32(key[32:]))}
+}
@@ -0,0 +1,153 @@
+package main
+
+import "sort"
+
+// UtxoView is a set of unspent outputs transactions are checked against:
+// the unspent set of the chain, or that set with the changes of some
+// transactions on top.
+type UtxoView interface {
+	// lookup returns the unspent output at point
+	lookup(point outPoint) (UnspentTxOut, bool)
+	// forEach calls fn with every unspent output until fn returns false
+	forEach(fn func(UnspentTxOut) bool)
+}
+
+// utxoOverlay is the outputs some transactions add to base, less those
+// they spend. Checking a block or the pool builds one instead of copying
+// the unspent set.
+type utxoOverlay struct {
+	// nil for an overlay on an empty set
+	base  UtxoView
+	added map[outPoint]UnspentTxOut
+	spent map[outPoint]bool
+}
+
+func newUtxoOverlay(base UtxoView) *utxoOverlay {
+	return &utxoOverlay{
+		base:  base,
+		added: map[outPoint]UnspentTxOut{},
+		spent: map[outPoint]bool{},
+	}
+}
+
+func (v *utxoOverlay) lookup(point outPoint) (UnspentTxOut, bool) {
+	if uTxO, ok := v.added[point]; ok {
+		return uTxO, true
+	}
+	if v.spent[point] || v.base == nil {
+		return UnspentTxOut{}, false
+	}
+	return v.base.lookup(point)
+}
+
+// forEach visits the outputs of the overlay, oldest first, then those of
+// base it leaves alone
+func (v *utxoOverlay) forEach(fn func(UnspentTxOut) bool) {
+	for _, uTxO := range sortedUnspentTxOuts(v.added) {
+		if !fn(uTxO) {
+			return
+		}
+	}
+	if v.base == nil {
+		return
+	}
+
+	done := false
+	v.base.forEach(func(uTxO UnspentTxOut) bool {
+		point := outPoint{uTxO.TxOutID, uTxO.TxOutIndex}
+		if v.spent[point] {
+			return true
+		}
+		if _, ok := v.added[point]; ok {
+			return true
+		}
+		done = !fn(uTxO)
+		return !done
+	})
+}
+
+// utxoViewOf returns a view holding only uTxOs
+func utxoViewOf(uTxOs []UnspentTxOut) *utxoOverlay {
+	view := newUtxoOverlay(nil)
+	for _, uTxO := range uTxOs {
+		view.add(uTxO)
+	}
+	return view
+}
+
+// add makes uTxO unspent
+func (v *utxoOverlay) add(uTxO UnspentTxOut) {
+	point := outPoint{uTxO.TxOutID, uTxO.TxOutIndex}
+	delete(v.spent, point)
+	v.added[point] = uTxO
+}
+
+// spend takes the output at point out of the set
+func (v *utxoOverlay) spend(point outPoint) {
+	delete(v.added, point)
+	v.spent[point] = true
+}
+
+// apply adds the outputs of newTransactions, confirmed in the block at, and
+// spends their inputs. Outputs spent by another of the transactions are
+// gone too.
+func (v *utxoOverlay) apply(newTransactions []Transaction, at chainContext) {
+	for _, t := range newTransactions {
+		for index, out := range t.TxOuts {
+			v.add(UnspentTxOut{
+				TxOutID:    t.ID,
+				TxOutIndex: index,
+				Address:    out.Address,
+				Amount:     out.Amount,
+				Script:     out.Script,
+				Height:     at.Height,
+				Time:       at.Time,
+				Coinbase:   isCoinbase(t),
+			})
+		}
+	}
+	for _, t := range newTransactions {
+		if isCoinbase(t) {
+			continue
+		}
+		for _, in := range t.TxIns {
+			v.spend(outPoint{in.TxOutID, in.TxOutIndex})
+		}
+	}
+}
+
+// utxoWriter is a set the changes of an overlay can be written to
+type utxoWriter interface {
+	add(uTxO UnspentTxOut)
+	spend(point outPoint)
+}
+
+// writeTo makes the changes of the overlay to target, usually its base
+func (v *utxoOverlay) writeTo(target utxoWriter) {
+	for point := range v.spent {
+		target.spend(point)
+	}
+	for _, uTxO := range sortedUnspentTxOuts(v.added) {
+		target.add(uTxO)
+	}
+}
+
+// sortedUnspentTxOuts returns the outputs of uTxOs by height, transaction
+// and index, so walking a set does not depend on map order
+func sortedUnspentTxOuts(uTxOs map[outPoint]UnspentTxOut) []UnspentTxOut {
+	result := make([]UnspentTxOut, 0, len(uTxOs))
+	for _, uTxO := range uTxOs {
+		result = append(result, uTxO)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Height != b.Height {
+			return a.Height < b.Height
+		}
+		if a.TxOutID != b.TxOutID {
+			return a.TxOutID < b.TxOutID
+		}
+		return a.TxOutIndex < b.TxOutIndex
+	})
+	return result
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 const privateKeyLocation = "./node/wallet/private_key"
@@ -25,6 +28,7 @@ func GetPrivateFromWallet() (string, error) {
 	return string(b), nil
 }
 
+// GetPublicFromWallet returns the address of our wallet
 func GetPublicFromWallet() (string, error) {
 	privateKey, err := GetPrivateFromWallet()
 
@@ -32,26 +36,11 @@ func GetPublicFromWallet() (string, error) {
 		return "", err
 	}
 
-	key, err := ParseRsaPrivateKeyFromPemStr(privateKey)
-
-	if err != nil {
+	if _, err := ParseRsaPrivateKeyFromPemStr(privateKey); err != nil {
 		return "", err
 	}
 
-	x := key.PublicKey.X
-	y := key.PublicKey.Y
-
-	publicKey := x.Bytes()
-	publicKey = append(publicKey, y.Bytes()...)
-
-	dst := make([]byte, hex.DecodedLen(len(publicKey)))
-	n, err := hex.Decode(dst, publicKey)
-
-	if err != nil {
-		return "", err
-	}
-
-	return string(dst[:n]), nil
+	return getPublicKey(privateKey), nil
 }
 
 func generatePrivateKey() string {
@@ -60,7 +49,12 @@ func generatePrivateKey() string {
 		return ""
 	}
 
-	return privateKey.GetSerialize()
+	encoded, err := privateKey.EncodePEM()
+	if err != nil {
+		return ""
+	}
+
+	return encoded
 }
 
 func initWallet() error {
@@ -69,9 +63,16 @@ func initWallet() error {
 	}
 
 	newPrivateKey := generatePrivateKey()
+	if newPrivateKey == "" {
+		return errors.New("failed to generate a private key")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(privateKeyLocation), 0700); err != nil {
+		return err
+	}
 
 	d1 := []byte(newPrivateKey)
-	if err := ioutil.WriteFile(privateKeyLocation, d1, 0644); err != nil {
+	if err := ioutil.WriteFile(privateKeyLocation, d1, 0600); err != nil {
 		return err
 	}
 
@@ -86,13 +87,14 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-func getBalance(address string, unspentTxOuts []UnspentTxOut) int {
+func getBalance(address string, unspentTxOuts UtxoView) int {
 	sum := 0
-	for _, uTxO := range unspentTxOuts {
+	unspentTxOuts.forEach(func(uTxO UnspentTxOut) bool {
 		if uTxO.Address == address {
 			sum += uTxO.Amount
 		}
-	}
+		return true
+	})
 
 	return sum
 }
@@ -120,14 +122,9 @@ func findTxOutsForAmount(amount int, myUnspentTxOuts []UnspentTxOut) (*TxOutsFor
 	return nil, errors.New("Not enough coins to send transaction")
 }
 
-func createTxOuts(receiverAddress string, myAddress string, amount, leftOverAmount int) []TxOut {
-	txOut1 := TxOut{
-		Address: receiverAddress,
-		Amount:  amount,
-	}
-
+func createTxOuts(receiver TxOut, myAddress string, leftOverAmount int) []TxOut {
 	if leftOverAmount == 0 {
-		return []TxOut{txOut1}
+		return []TxOut{receiver}
 	}
 
 	leftOverTx := TxOut{
@@ -135,19 +132,85 @@ func createTxOuts(receiverAddress string, myAddress string, amount, leftOverAmou
 		Amount:  leftOverAmount,
 	}
 
-	return []TxOut{txOut1, leftOverTx}
+	return []TxOut{receiver, leftOverTx}
 }
 
-func createTransaction(receiveAddress string, amount int, privateKey string, unspentTxOuts []UnspentTxOut, txPool []Transaction) (*Transaction, error) {
+// TxLocks are the time locks the wallet puts on a transaction: LockTime on
+// the transaction and RelativeLock on each of its inputs. Replaceable lets
+// the transaction be replaced in the pool by one paying a higher fee.
+type TxLocks struct {
+	LockTime     int64  `json:"lockTime"`
+	RelativeLock uint32 `json:"relativeLock"`
+	Replaceable  bool   `json:"replaceable"`
+}
+
+// inputLock is the RelativeLock of an input spending an output that needs
+// required
+func (locks TxLocks) inputLock(required uint32) uint32 {
+	lock := locks.RelativeLock
+	// a relative lock script needs the input to carry its lock
+	if required != 0 && checkRelativeLockCovers(lock, required) != nil {
+		lock = required
+	}
+	if locks.Replaceable {
+		lock |= replaceableFlag
+	}
+	return lock
+}
+
+// spendableBy reports whether myAddress can spend uTxO in the block at,
+// directly or through a pay-to-pubkey-hash, time lock or relative lock
+// script, along with the relative lock the input needs
+func spendableBy(uTxO UnspentTxOut, myAddress string, at chainContext) (uint32, bool) {
+	if len(uTxO.Script) == 0 {
+		return 0, uTxO.Address == myAddress
+	}
+
+	pubKey, err := hex.DecodeString(myAddress)
+	if err != nil {
+		return 0, false
+	}
+	myKeyHash := pubKeyHash(pubKey)
+
+	switch classifyScript(uTxO.Script) {
+	case payToPubKeyHashScript:
+		return 0, bytes.Equal(uTxO.Script, payToPubKeyHashLockingScript(myKeyHash))
+	case timeLockScript:
+		keyHash, lockTime := lockedKeyHash(uTxO.Script)
+		return 0, bytes.Equal(keyHash, myKeyHash) && checkLockTime(lockTime, at) == nil
+	case relativeLockScript:
+		keyHash, lock := lockedKeyHash(uTxO.Script)
+		if !bytes.Equal(keyHash, myKeyHash) || lock < 0 || lock > 0xffffffff {
+			return 0, false
+		}
+		return uint32(lock), checkRelativeLock(uint32(lock), uTxO, at) == nil
+	}
+	return 0, false
+}
+
+// createTransaction pays receiver, an address or a locking script, from the
+// outputs of privateKey that no pool transaction spends and that can go
+// into the next block, leaving fee to the miner. Immature coinbase outputs
+// are left alone.
+func createTransaction(receiver TxOut, fee int, locks TxLocks, privateKey string, unspentTxOuts UtxoView, txPool []Transaction) (*Transaction, error) {
+	if receiver.Amount <= 0 || fee < 0 {
+		return nil, errors.New("amount must be positive and fee not negative")
+	}
+
+	at := nextBlockContext()
 	myAddress := getPublicKey(privateKey)
 	myUnspentTxOuts := []UnspentTxOut{}
-	for _, utx := range unspentTxOuts {
-		if utx.Address == myAddress {
+	relativeLocks := map[string]uint32{}
+	unspentTxOuts.forEach(func(utx UnspentTxOut) bool {
+		lock, ok := spendableBy(utx, myAddress, at)
+		if ok && isMature(utx, at) && !isSpentInPool(utx, txPool) {
 			myUnspentTxOuts = append(myUnspentTxOuts, utx)
+			relativeLocks[fmt.Sprintf("%s:%d", utx.TxOutID, utx.TxOutIndex)] = lock
 		}
-	}
+		return true
+	})
 
-	txOutsForAmount, err := findTxOutsForAmount(amount, myUnspentTxOuts)
+	txOutsForAmount, err := findTxOutsForAmount(receiver.Amount+fee, myUnspentTxOuts)
 
 	if err != nil {
 		return nil, err
@@ -155,8 +218,9 @@ func createTransaction(receiveAddress string, amount int, privateKey string, uns
 
 	toUnsignedTxIn := func(unspentTxOut UnspentTxOut) TxIn {
 		return TxIn{
-			TxOutID:    unspentTxOut.TxOutID,
-			TxOutIndex: unspentTxOut.TxOutIndex,
+			TxOutID:      unspentTxOut.TxOutID,
+			TxOutIndex:   unspentTxOut.TxOutIndex,
+			RelativeLock: locks.inputLock(relativeLocks[fmt.Sprintf("%s:%d", unspentTxOut.TxOutID, unspentTxOut.TxOutIndex)]),
 		}
 	}
 
@@ -167,14 +231,175 @@ func createTransaction(receiveAddress string, amount int, privateKey string, uns
 	}
 
 	tx := &Transaction{
-		TxIns:  unsignedTxIns,
-		TxOuts: createTxOuts(receiveAddress, myAddress, amount, txOutsForAmount.LeftOverAmount),
+		TxIns:    unsignedTxIns,
+		TxOuts:   createTxOuts(receiver, myAddress, txOutsForAmount.LeftOverAmount),
+		LockTime: locks.LockTime,
 	}
 	tx.ID = getTransactionID(*tx)
+	signInputs(tx, privateKey, unspentTxOuts, sigHashAll)
 
+	return tx, nil
+}
+
+// signInputs signs the inputs of tx that privateKey can spend with
+// hashType and returns how many it signed. Other inputs are left as they
+// are, for the other parties of a collaborative transaction to sign.
+func signInputs(tx *Transaction, privateKey string, unspentTxOuts UtxoView, hashType byte) int {
+	at := nextBlockContext()
+	myAddress := getPublicKey(privateKey)
+	myPubKey, _ := hex.DecodeString(myAddress)
+
+	signed := 0
 	for index, txIn := range tx.TxIns {
-		txIn.Signature = signTxIn(*tx, index, privateKey, unspentTxOuts)
+		uTxO := findUnspentTxOut(txIn.TxOutID, txIn.TxOutIndex, unspentTxOuts)
+		if uTxO == nil {
+			continue
+		}
+		if _, ok := spendableBy(*uTxO, myAddress, at); !ok {
+			continue
+		}
+
+		signature := signTxInWithHashType(*tx, index, privateKey, unspentTxOuts, hashType)
+		if signature == "" {
+			continue
+		}
+		if len(uTxO.Script) > 0 {
+			tx.TxIns[index].Script = pubKeyHashUnlockingScript([]byte(signature), myPubKey)
+		} else {
+			tx.TxIns[index].Signature = signature
+		}
+		signed++
 	}
+	return signed
+}
 
-	return tx, nil
+// createTransactionWithFeeRate is createTransaction with a fee of at least
+// rate per 1000 bytes of the signed transaction
+func createTransactionWithFeeRate(receiver TxOut, rate int, locks TxLocks, privateKey string, unspentTxOuts UtxoView, txPool []Transaction) (*Transaction, error) {
+	fee := 0
+	for {
+		tx, err := createTransaction(receiver, fee, locks, privateKey, unspentTxOuts, txPool)
+		if err != nil {
+			return nil, err
+		}
+
+		// more inputs or a longer signature make the transaction bigger,
+		// so try again until the fee covers its size
+		needed := (rate*getTransactionSize(*tx) + 999) / 1000
+		if fee >= needed {
+			return tx, nil
+		}
+		fee = needed
+	}
+}
+
+func isSpentInPool(uTxO UnspentTxOut, txPool []Transaction) bool {
+	for _, tx := range txPool {
+		for _, txIn := range tx.TxIns {
+			if txIn.TxOutID == uTxO.TxOutID && txIn.TxOutIndex == uTxO.TxOutIndex {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bumpFee builds a transaction replacing the replaceable pool transaction
+// txID of privateKey that pays at least rate per 1000 bytes, and more in
+// total and per byte than the original. The extra fee comes out of the
+// change and, when that runs out, from more outputs of privateKey.
+func bumpFee(txID string, rate int, privateKey string, unspentTxOuts UtxoView, txPool []Transaction) (*Transaction, error) {
+	var original *Transaction
+	for i := range txPool {
+		if txPool[i].ID == txID {
+			original = &txPool[i]
+		}
+	}
+	if original == nil {
+		return nil, fmt.Errorf("transaction %s is not in the pool", txID)
+	}
+	if !signalsReplacement(*original) {
+		return nil, fmt.Errorf("transaction %s is not replaceable", txID)
+	}
+
+	at := nextBlockContext()
+	myAddress := getPublicKey(privateKey)
+	txIns := []TxIn{}
+	inputs := 0
+	for _, txIn := range original.TxIns {
+		uTxO := findUnspentTxOut(txIn.TxOutID, txIn.TxOutIndex, unspentTxOuts)
+		if uTxO == nil {
+			return nil, fmt.Errorf("transaction %s spends an output that is gone", txID)
+		}
+		if _, ok := spendableBy(*uTxO, myAddress, at); !ok {
+			return nil, fmt.Errorf("transaction %s spends outputs of others", txID)
+		}
+		txIns = append(txIns, TxIn{TxOutID: txIn.TxOutID, TxOutIndex: txIn.TxOutIndex, RelativeLock: txIn.RelativeLock})
+		inputs += uTxO.Amount
+	}
+
+	// everything but the change is paid again
+	payments := []TxOut{}
+	paid := 0
+	for _, txOut := range original.TxOuts {
+		if txOut.Address == myAddress && len(txOut.Script) == 0 {
+			continue
+		}
+		payments = append(payments, txOut)
+		paid += txOut.Amount
+	}
+
+	// more outputs to take the fee from, if the change is not enough. Those
+	// of pool transactions are left alone, as the replacement could evict
+	// them.
+	inPool := map[string]bool{}
+	for _, tx := range txPool {
+		inPool[tx.ID] = true
+	}
+	extra := []UnspentTxOut{}
+	unspentTxOuts.forEach(func(utx UnspentTxOut) bool {
+		lock, ok := spendableBy(utx, myAddress, at)
+		if ok && lock == 0 && isMature(utx, at) && !inPool[utx.TxOutID] && !isSpentInPool(utx, txPool) {
+			extra = append(extra, utx)
+		}
+		return true
+	})
+
+	oldFee := getTransactionFee(*original, unspentTxOuts)
+	oldSize := getTransactionSize(*original)
+	locks := TxLocks{Replaceable: true}
+	fee := oldFee + 1
+	for {
+		for inputs < paid+fee {
+			if len(extra) == 0 {
+				return nil, errors.New("Not enough coins to bump the fee")
+			}
+			txIns = append(txIns, TxIn{TxOutID: extra[0].TxOutID, TxOutIndex: extra[0].TxOutIndex, RelativeLock: locks.inputLock(0)})
+			inputs += extra[0].Amount
+			extra = extra[1:]
+		}
+
+		tx := &Transaction{
+			TxIns:    append([]TxIn{}, txIns...),
+			TxOuts:   append([]TxOut{}, payments...),
+			LockTime: original.LockTime,
+		}
+		if change := inputs - paid - fee; change > 0 {
+			tx.TxOuts = append(tx.TxOuts, TxOut{Address: myAddress, Amount: change})
+		}
+		tx.ID = getTransactionID(*tx)
+		signInputs(tx, privateKey, unspentTxOuts, sigHashAll)
+
+		// more inputs or a longer signature make the transaction bigger,
+		// so try again until the fee covers its size
+		size := getTransactionSize(*tx)
+		needed := (rate*size + 999) / 1000
+		if byRate := oldFee*size/oldSize + 1; byRate > needed {
+			needed = byRate
+		}
+		if fee >= needed {
+			return tx, nil
+		}
+		fee = needed
+	}
 }